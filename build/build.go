@@ -0,0 +1,186 @@
+// Package build turns .pkt files back into pcaps.
+//
+// ExpandTCP and ExpandUDP wrap the records in a synthetic conversation,
+// ExpandRaw writes them as raw IP packets and ExpandWithHeaders writes
+// records that already carry their own headers.
+package build
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"time"
+
+	"github.com/JustinAzoff/pcap_simplify/extract"
+	"github.com/JustinAzoff/pcap_simplify/pkt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// PcapPacketWriter is a PacketWriter that writes to a pcap file instead of
+// a network interface.
+type PcapPacketWriter struct {
+	file    io.WriteCloser
+	writer  FileWriter
+	comment string
+}
+
+// NewPcapPacketWriter writes the pcap file header for Ethernet frames to f.
+func NewPcapPacketWriter(f io.WriteCloser) (*PcapPacketWriter, error) {
+	return NewFilePacketWriter(f, FileOptions{})
+}
+
+// NewFilePacketWriter is like NewPcapPacketWriter, but can write pcapng as
+// well.
+func NewFilePacketWriter(f io.WriteCloser, opts FileOptions) (*PcapPacketWriter, error) {
+	writer, err := NewFileWriter(f, 65536, extract.LinkType(layers.LinkTypeEthernet), opts)
+	if err != nil {
+		return nil, err
+	}
+	return &PcapPacketWriter{
+		file:   f,
+		writer: writer,
+	}, nil
+}
+
+func (w *PcapPacketWriter) WritePacketData(data []byte) error {
+	info := gopacket.CaptureInfo{
+		Timestamp:     time.Now(), // a bit cheap
+		CaptureLength: len(data),
+		Length:        len(data),
+	}
+	return w.writer.WritePacket(info, data, w.comment)
+}
+
+// Annotate sets the comment for the packets written from now on.
+func (w *PcapPacketWriter) Annotate(comment string) {
+	w.comment = comment
+}
+
+// Close closes the file, returning the error of writing out what was left
+// of it.
+func (w *PcapPacketWriter) Close() error {
+	return w.file.Close()
+}
+
+// Annotator is implemented by PacketWriters that can attach a comment to
+// the packets they write, such as the .pkt record a packet came from.
+type Annotator interface {
+	Annotate(comment string)
+}
+
+// annotate sets the comment of handle, if it supports comments.
+func annotate(handle PacketWriter, format string, args ...interface{}) {
+	if a, ok := handle.(Annotator); ok {
+		a.Annotate(fmt.Sprintf(format, args...))
+	}
+}
+
+// Pacing of the rebuilt conversations, so the packets don't all arrive at
+// once when sent to an interface. The tests turn it off.
+var (
+	recordDelay = 10 * time.Millisecond
+	closeDelay  = 1 * time.Second
+)
+
+// ExpandTCP sends the records read from r as a single TCP connection to
+// port through handle, from the client port recorded in the .pkt file if
+// there is one. It returns the number of records sent.
+func ExpandTCP(r io.Reader, handle PacketWriter, port int) (int, error) {
+	return ExpandTCPWithOptions(r, handle, ExpandOptions{Port: port})
+}
+
+// ExpandTCPWithOptions is like ExpandTCP, but can use the original
+// addresses and wrap the conversation in TLS.
+func ExpandTCPWithOptions(r io.Reader, handle PacketWriter, opts ExpandOptions) (int, error) {
+	//just slurp it up
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return 0, err
+	}
+	b, err := pkt.NewReader(data)
+	if err != nil {
+		return 0, err
+	}
+	totalPackets := 0
+	t, err := NewTCPPacketGenerator(handle)
+	if err != nil {
+		return 0, err
+	}
+	client, server, err := opts.addresses(b.Metadata)
+	if err != nil {
+		return 0, err
+	}
+	if client != nil {
+		t.SourceIP, t.DestIP = client, server
+	}
+	annotate(handle, "handshake")
+	if err := t.Connect(metadataPort(b.Metadata, "orig_port"), opts.Port); err != nil {
+		return 0, err
+	}
+	var session *tlsSession
+	if opts.TLS != nil {
+		annotate(handle, "tls handshake")
+		if session, err = startTLS(opts.TLS, b.Metadata, t); err != nil {
+			return 0, err
+		}
+	}
+	for {
+		is_orig, payload, err := b.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return totalPackets, err
+		}
+		annotate(handle, "pkt record #%d, %s", totalPackets, direction(is_orig))
+		totalPackets++
+		if session != nil {
+			err = session.Write(payload, is_orig)
+		} else {
+			err = writeSegments(t, payload, is_orig)
+		}
+		if err != nil {
+			return totalPackets, err
+		}
+		time.Sleep(recordDelay)
+	}
+	time.Sleep(closeDelay)
+	annotate(handle, "teardown")
+	if session != nil {
+		if err := session.Close(); err != nil {
+			return totalPackets, err
+		}
+	}
+	if err := t.Close(); err != nil {
+		return totalPackets, err
+	}
+	return totalPackets, nil
+}
+
+// writeSegments sends payload from the client if isOrig is set, or from
+// the server otherwise, in segments of at most 1400 bytes.
+func writeSegments(t *TCPPacketGenerator, payload []byte, isOrig bool) error {
+	var pl []byte
+	for len(payload) > 0 {
+		if len(payload) > 1400 {
+			pl = payload[0:1400]
+		} else {
+			pl = payload
+		}
+		log.Printf("is_orig %v sending %d bytes\n", isOrig, len(pl))
+		if err := t.Write(pl, isOrig, false); err != nil {
+			return err
+		}
+		payload = payload[len(pl):len(payload)]
+	}
+	return nil
+}
+
+func direction(isOrig bool) string {
+	if isOrig {
+		return "client to server"
+	}
+	return "server to client"
+}
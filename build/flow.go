@@ -0,0 +1,104 @@
+package build
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/JustinAzoff/pcap_simplify/pkt"
+)
+
+// Flow is what the metadata of a .pkt file says about the conversation it
+// was extracted from. Files extracted before the protocol was recorded
+// leave everything empty.
+type Flow struct {
+	Protocol   string
+	ClientAddr string
+	ClientPort int
+	ServerAddr string
+	ServerPort int
+}
+
+// ReadFlow returns the protocol, addresses and ports of the first data
+// record of the .pkt file in data. Every record has to be of the same
+// protocol, since a pcap can only be built from one conversation.
+func ReadFlow(data []byte) (Flow, error) {
+	var flow Flow
+	r, err := pkt.NewReader(data)
+	if err != nil {
+		return flow, err
+	}
+	seen := map[string]bool{}
+	for n := 0; ; n++ {
+		_, _, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return flow, err
+		}
+		seen[r.Metadata["protocol"]] = true
+		if n == 0 {
+			flow.Protocol = r.Metadata["protocol"]
+			flow.ClientAddr = r.Metadata["orig_addr"]
+			flow.ServerAddr = r.Metadata["resp_addr"]
+			flow.ClientPort = metadataPort(r.Metadata, "orig_port")
+			flow.ServerPort = metadataPort(r.Metadata, "resp_port")
+		}
+	}
+	if len(seen) > 1 {
+		var protocols []string
+		for p := range seen {
+			if p == "" {
+				p = "unknown"
+			}
+			protocols = append(protocols, p)
+		}
+		sort.Strings(protocols)
+		return flow, fmt.Errorf("Records of several protocols (%s), split the file with extract -split first", strings.Join(protocols, ", "))
+	}
+	return flow, nil
+}
+
+// metadataPort returns the port in the metadata key, or 0 if there is no
+// valid one.
+func metadataPort(m pkt.Metadata, key string) int {
+	port, err := strconv.ParseUint(m[key], 10, 16)
+	if err != nil {
+		return 0
+	}
+	return int(port)
+}
+
+// ExpandOptions controls the conversation built from a .pkt file.
+type ExpandOptions struct {
+	// Port is the server port, for the protocols that have ports
+	Port int
+	// OriginalAddresses makes the conversation use the client and server
+	// addresses recorded in the .pkt file instead of 10.0.0.1 and
+	// 10.0.0.2
+	OriginalAddresses bool
+	// TLS, if set, wraps a TCP conversation in TLS
+	TLS *TLSOptions
+}
+
+// addresses returns the client and server addresses recorded in m if opts
+// asks for them, or nil to keep the ones of the generator.
+func (opts ExpandOptions) addresses(m pkt.Metadata) (net.IP, net.IP, error) {
+	if !opts.OriginalAddresses {
+		return nil, nil, nil
+	}
+	client, server := net.ParseIP(m["orig_addr"]), net.ParseIP(m["resp_addr"])
+	if client == nil || server == nil {
+		return nil, nil, fmt.Errorf("No original addresses recorded, extract the pcap again to record them")
+	}
+	if (client.To4() == nil) != (server.To4() == nil) {
+		return nil, nil, fmt.Errorf("The original addresses %s and %s are not of the same IP version", client, server)
+	}
+	log.Printf("Using the original addresses %s and %s", client, server)
+	return client, server, nil
+}
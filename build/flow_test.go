@@ -0,0 +1,23 @@
+package build
+
+import (
+	"testing"
+)
+
+func TestReadFlow(t *testing.T) {
+	flow, err := ReadFlow(readGolden(t, "udp.pkt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (Flow{Protocol: "udp", ClientAddr: "10.0.0.1", ClientPort: 40000, ServerAddr: "10.0.0.2", ServerPort: 53}); flow != want {
+		t.Errorf("got %+v, expected %+v", flow, want)
+	}
+
+	flow, err = ReadFlow([]byte("\x01PKT\x01old"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if flow != (Flow{}) {
+		t.Errorf("got %+v for a file without metadata", flow)
+	}
+}
@@ -0,0 +1,99 @@
+package build
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"log"
+	"testing"
+
+	"github.com/JustinAzoff/pcap_simplify/checksum"
+	"github.com/JustinAzoff/pcap_simplify/extract"
+	"github.com/JustinAzoff/pcap_simplify/internal/fixtures"
+	"github.com/JustinAzoff/pcap_simplify/pkt"
+)
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
+
+// extractPcap runs the payload or the headers extractor over a pcap.
+func extractPcap(data []byte, headers bool) ([]byte, error) {
+	r, err := extract.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	var out bytes.Buffer
+	if headers {
+		_, err = extract.SimplifyWithHeaders(r, &out, extract.Options{})
+	} else {
+		_, _, err = extract.Simplify(r, &out, extract.Options{})
+	}
+	return out.Bytes(), err
+}
+
+// FuzzRoundTrip extracts arbitrary capture files, builds them again and
+// extracts the result. The payload streams have to survive a TCP rebuild,
+// and the headers extracted from a raw or headers rebuild have to be the
+// ones that went in.
+func FuzzRoundTrip(f *testing.F) {
+	fixtures.AddCaptures(f)
+	log.SetOutput(ioutil.Discard)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		// A payload containing the record marker splits its record
+		if bytes.Contains(data, pkt.MAGIC) {
+			t.Skip()
+		}
+
+		extracted, err := extractPcap(data, false)
+		if err == nil && len(extracted) > 0 {
+			var rebuilt bytes.Buffer
+			handle, err := NewPcapPacketWriter(nopCloser{&rebuilt})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := ExpandTCP(bytes.NewReader(extracted), handle, 80); err != nil {
+				t.Fatalf("tcp: %v", err)
+			}
+			if err := handle.Close(); err != nil {
+				t.Fatal(err)
+			}
+			got, err := extractPcap(rebuilt.Bytes(), false)
+			if err != nil {
+				t.Fatalf("tcp: %v", err)
+			}
+			c, err := pkt.Compare(extracted, got)
+			if err != nil {
+				t.Fatalf("tcp: %v", err)
+			}
+			if len(c.Divergences) > 0 {
+				t.Fatalf("tcp: %v", c.Divergences)
+			}
+		}
+
+		extracted, err = extractPcap(data, true)
+		if err != nil || len(extracted) == 0 {
+			return
+		}
+		for _, mode := range []string{"raw", "headers"} {
+			var rebuilt bytes.Buffer
+			if mode == "raw" {
+				_, err = ExpandRaw(bytes.NewReader(extracted), &rebuilt, FileOptions{})
+			} else {
+				_, err = ExpandWithHeaders(bytes.NewReader(extracted), &rebuilt, 0, checksum.None, FileOptions{})
+			}
+			if err != nil {
+				t.Fatalf("%s: %v", mode, err)
+			}
+			got, err := extractPcap(rebuilt.Bytes(), true)
+			if err != nil {
+				t.Fatalf("%s: %v", mode, err)
+			}
+			if !bytes.Equal(got, extracted) {
+				t.Fatalf("%s: headers changed\ngot  %x\nwant %x", mode, got, extracted)
+			}
+		}
+	})
+}
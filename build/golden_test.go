@@ -0,0 +1,258 @@
+package build
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/JustinAzoff/pcap_simplify/checksum"
+	"github.com/JustinAzoff/pcap_simplify/extract"
+	"github.com/JustinAzoff/pcap_simplify/pkt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func TestMain(m *testing.M) {
+	recordDelay = 0
+	closeDelay = 0
+	os.Exit(m.Run())
+}
+
+func readGolden(t *testing.T, name string) []byte {
+	data, err := ioutil.ReadFile(filepath.Join("..", "testdata", "golden", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// readPcap returns the link type and the packets of a pcap.
+func readPcap(t *testing.T, data []byte) (extract.LinkType, [][]byte) {
+	r, err := extract.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var packets [][]byte
+	for {
+		data, _, err := r.ReadPacketData()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		packets = append(packets, data)
+	}
+	return r.LinkType(), packets
+}
+
+// records returns the data records of a .pkt file.
+func records(t *testing.T, data []byte) [][]byte {
+	r, err := pkt.NewReader(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var records [][]byte
+	for {
+		_, payload, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, payload)
+	}
+	return records
+}
+
+type tcpPacket struct {
+	fromClient bool
+	flags      string
+	payload    string
+}
+
+func tcpFlags(tcp *layers.TCP) string {
+	flags := ""
+	for _, f := range []struct {
+		set  bool
+		name string
+	}{{tcp.SYN, "S"}, {tcp.FIN, "F"}, {tcp.RST, "R"}, {tcp.PSH, "P"}, {tcp.ACK, "A"}} {
+		if f.set {
+			flags += f.name
+		}
+	}
+	return flags
+}
+
+var handshake = []tcpPacket{
+	{true, "S", ""},
+	{false, "SA", ""},
+	{true, "A", ""},
+}
+
+var teardown = []tcpPacket{
+	{true, "FPA", ""},
+	{false, "A", ""},
+	{false, "FA", ""},
+	{true, "A", ""},
+}
+
+func TestExpandTCPGolden(t *testing.T) {
+	for _, tt := range []struct {
+		golden string
+		want   []tcpPacket
+	}{
+		{"tcp.pkt", []tcpPacket{
+			{true, "PA", "GET / HTTP/1.0\r\n\r\n"},
+			{false, "PA", "HTTP/1.0 200 OK\r\nContent-Length: 2\r\n\r\nhi"},
+		}},
+		{"udp.pkt", []tcpPacket{
+			{true, "PA", "query"},
+			{false, "PA", "answer"},
+		}},
+		{"fragments.pkt", []tcpPacket{
+			{true, "PA", string(records(t, readGolden(t, "fragments.pkt"))[0][:1400])},
+			{true, "PA", string(records(t, readGolden(t, "fragments.pkt"))[0][1400:])},
+			{false, "PA", "ok"},
+		}},
+	} {
+		t.Run(tt.golden, func(t *testing.T) {
+			w := &memoryWriter{}
+			if _, err := ExpandTCP(bytes.NewReader(readGolden(t, tt.golden)), w, 8080); err != nil {
+				t.Fatal(err)
+			}
+			want := append(append(append([]tcpPacket{}, handshake...), tt.want...), teardown...)
+			if len(w.packets) != len(want) {
+				t.Fatalf("got %d packets, expected %d", len(w.packets), len(want))
+			}
+			next := map[bool]uint32{}
+			for i, p := range w.packets {
+				eth, _ := p.Layer(layers.LayerTypeEthernet).(*layers.Ethernet)
+				ip, _ := p.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+				tcp, _ := p.Layer(layers.LayerTypeTCP).(*layers.TCP)
+				if eth == nil || ip == nil || tcp == nil {
+					t.Fatalf("packet %d is missing a layer: %v", i, p)
+				}
+				fromClient := tcp.DstPort == 8080
+				if !fromClient && tcp.SrcPort != 8080 {
+					t.Errorf("packet %d is not to or from port 8080: %v -> %v", i, tcp.SrcPort, tcp.DstPort)
+				}
+				got := tcpPacket{fromClient, tcpFlags(tcp), string(tcp.Payload)}
+				if got != want[i] {
+					t.Errorf("packet %d: got %+v, expected %+v", i, got, want[i])
+				}
+				// Data has to continue where the last segment ended
+				if len(tcp.Payload) > 0 {
+					if n, ok := next[fromClient]; ok && tcp.Seq != n {
+						t.Errorf("packet %d: seq %d, expected %d", i, tcp.Seq, n)
+					}
+					next[fromClient] = tcp.Seq + uint32(len(tcp.Payload))
+				}
+			}
+		})
+	}
+}
+
+func TestExpandWithHeadersGolden(t *testing.T) {
+	for _, tt := range []struct {
+		golden  string
+		fixture string
+		link    bool
+	}{
+		{"tcp.headers.pkt", "tcp.pcap", false},
+		{"udp.headers.pkt", "udp.pcap", false},
+		{"fragments.headers.pkt", "fragments.pcap", false},
+		{"ipv6.headers.pkt", "ipv6.pcap", false},
+		{"vlan.link.pkt", "vlan.pcap", true},
+		{"pcapng.link.pkt", "ethernet.pcapng", true},
+	} {
+		t.Run(tt.golden, func(t *testing.T) {
+			var out bytes.Buffer
+			if _, err := ExpandWithHeaders(bytes.NewReader(readGolden(t, tt.golden)), &out, 0, checksum.None, FileOptions{}); err != nil {
+				t.Fatal(err)
+			}
+			fixture, err := ioutil.ReadFile(filepath.Join("..", "testdata", tt.fixture))
+			if err != nil {
+				t.Fatal(err)
+			}
+			wantLinkType, wantPackets := readPcap(t, fixture)
+			linkType, packets := readPcap(t, out.Bytes())
+			if tt.link && linkType != wantLinkType {
+				t.Errorf("link type %v, expected %v", linkType, wantLinkType)
+			}
+			if !tt.link && linkType != extract.LinkType(layers.LinkTypeEthernet) {
+				t.Errorf("link type %v, expected Ethernet", linkType)
+			}
+			if len(packets) != len(wantPackets) {
+				t.Fatalf("got %d packets, expected %d", len(packets), len(wantPackets))
+			}
+			dec, err := extract.LinkDecoder(wantLinkType)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := range packets {
+				got := gopacket.NewPacket(packets[i], layers.LayerTypeEthernet, gopacket.Default)
+				want := gopacket.NewPacket(wantPackets[i], dec, gopacket.Default)
+				if tt.link {
+					// Frames kept with the link layer come back unchanged
+					if !bytes.Equal(packets[i], wantPackets[i]) {
+						t.Errorf("packet %d differs\ngot  %x\nwant %x", i, packets[i], wantPackets[i])
+					}
+					continue
+				}
+				if got.NetworkLayer() == nil {
+					t.Fatalf("packet %d has no network layer: %v", i, got)
+				}
+				gotIP := packets[i][extract.NetworkOffset(got, got.NetworkLayer()):]
+				wantIP := wantPackets[i][extract.NetworkOffset(want, want.NetworkLayer()):]
+				if !bytes.Equal(gotIP, wantIP) {
+					t.Errorf("packet %d differs from the network layer on\ngot  %x\nwant %x", i, gotIP, wantIP)
+				}
+			}
+		})
+	}
+}
+
+func TestExpandRawGolden(t *testing.T) {
+	data := readGolden(t, "tcp.headers.pkt")
+	var out bytes.Buffer
+	if _, err := ExpandRaw(bytes.NewReader(data), &out, FileOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	linkType, packets := readPcap(t, out.Bytes())
+	if linkType != extract.LinkType(layers.LinkTypeRaw) {
+		t.Errorf("link type %v, expected Raw", linkType)
+	}
+	want := records(t, data)
+	if len(packets) != len(want) {
+		t.Fatalf("got %d packets, expected %d", len(packets), len(want))
+	}
+	for i := range packets {
+		if !bytes.Equal(packets[i], want[i]) {
+			t.Errorf("packet %d differs\ngot  %x\nwant %x", i, packets[i], want[i])
+		}
+		if p := gopacket.NewPacket(packets[i], layers.LayerTypeIPv4, gopacket.Default); p.TransportLayer() == nil {
+			t.Errorf("packet %d has no transport layer: %v", i, p)
+		}
+	}
+}
+
+// TestReplayUDP makes sure both sides can send, the server used to fail
+// every write since its socket isn't connected.
+func TestReplayUDP(t *testing.T) {
+	r, err := pkt.NewReader(readGolden(t, "udp.pkt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := replayUDP(r, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("sent %d records, expected 2", n)
+	}
+}
@@ -0,0 +1,231 @@
+package build
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/JustinAzoff/pcap_simplify/checksum"
+	"github.com/JustinAzoff/pcap_simplify/extract"
+	"github.com/JustinAzoff/pcap_simplify/pkt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// writeFileHeader writes a pcap file header. pcapgo.Writer.WriteFileHeader
+// can't be used since it only takes 8 bit link types.
+func writeFileHeader(w io.Writer, snaplen uint32, linkType extract.LinkType) error {
+	var buf [24]byte
+	binary.LittleEndian.PutUint32(buf[0:4], 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(buf[4:6], 2)
+	binary.LittleEndian.PutUint16(buf[6:8], 4)
+	binary.LittleEndian.PutUint32(buf[16:20], snaplen)
+	binary.LittleEndian.PutUint32(buf[20:24], uint32(linkType))
+	_, err := w.Write(buf[:])
+	return err
+}
+
+// ExpandWithHeaders writes the records read from r to out. Records that
+// start at the network layer get a fresh Ethernet header using IP version,
+// or the version in the record if version is 0. Records written with the
+// link layer are copied as they are. It returns the number of records
+// written.
+func ExpandWithHeaders(r io.Reader, out io.Writer, version int, checksums checksum.Mode, fo FileOptions) (int, error) {
+	//just slurp it up
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return 0, err
+	}
+	b, err := pkt.NewReader(data)
+	if err != nil {
+		return 0, err
+	}
+
+	// Files written with pcap-to-pkt-with-headers -link already contain
+	// the link layer, everything else gets a fresh Ethernet header.
+	linkType := extract.LinkType(layers.LinkTypeEthernet)
+	linkLayer := false
+	if lt, ok := b.Metadata["linktype"]; ok {
+		n, err := strconv.ParseUint(lt, 10, 16)
+		if err != nil {
+			return 0, fmt.Errorf("Invalid linktype %q in file header", lt)
+		}
+		linkType = extract.LinkType(n)
+		linkLayer = true
+	}
+	var linkDecoder gopacket.Decoder
+	if linkLayer && checksums != checksum.None {
+		linkDecoder, err = extract.LinkDecoder(linkType)
+		if err != nil {
+			return 0, err
+		}
+	}
+	w, err := NewFileWriter(out, 65536, linkType, fo)
+	if err != nil {
+		return 0, err
+	}
+	totalPackets := 0
+	badChecksums := 0
+	start := time.Now()
+	ts := start
+
+	sMac, _ := net.ParseMAC("00:00:00:00:00:01")
+	dMac, _ := net.ParseMAC("00:00:00:00:00:02")
+
+	opts := gopacket.SerializeOptions{
+		FixLengths:       true,
+		ComputeChecksums: true,
+	}
+
+	eth := layers.Ethernet{
+		SrcMAC: sMac,
+		DstMAC: dMac,
+		//TODO: FIXME: determine automatically
+		EthernetType: layers.EthernetTypeIPv6,
+	}
+
+	for {
+		ts = ts.Add(time.Duration(200) * time.Millisecond)
+		_, payload, err := b.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return totalPackets, err
+		}
+
+		var errs []checksum.Error
+		if linkLayer {
+			if checksums != checksum.None {
+				packet := gopacket.NewPacket(payload, linkDecoder, gopacket.NoCopy)
+				if nl := packet.NetworkLayer(); nl != nil {
+					errs = checksums.Apply(payload[extract.NetworkOffset(packet, nl):])
+					for _, err := range errs {
+						log.Printf("Packet %d: %v", totalPackets+1, err)
+					}
+					badChecksums += len(errs)
+				}
+			}
+			ci := gopacket.CaptureInfo{
+				Timestamp:     ts,
+				CaptureLength: len(payload),
+				Length:        len(payload),
+			}
+			if err := w.WritePacket(ci, payload, recordComment(totalPackets, checksums, errs)); err != nil {
+				return totalPackets, fmt.Errorf("Error writing packet %w", err)
+			}
+			log.Printf("Wrote packet of length %d with link type %v", len(payload), linkType)
+			totalPackets += 1
+			continue
+		}
+
+		if len(payload) == 0 {
+			return totalPackets, fmt.Errorf("Record #%d is empty, expected a packet starting at the IP header", totalPackets)
+		}
+
+		// If the user didn't set a version, use the one from
+		// from the payload.
+		payload_version := version
+		if payload_version == 0 {
+			payload_version = int(payload[0] & 0xF0 >> 4)
+		}
+
+		errs = checksums.Apply(payload)
+		for _, err := range errs {
+			log.Printf("Packet %d: %v", totalPackets+1, err)
+		}
+		badChecksums += len(errs)
+
+		if payload_version == 4 {
+			eth.EthernetType = layers.EthernetTypeIPv4
+		} else {
+			eth.EthernetType = layers.EthernetTypeIPv6
+		}
+
+		buf := gopacket.NewSerializeBuffer()
+		/*
+			err = eth.SerializeTo(buf, opts)
+			if err != nil {
+				return totalPackets, fmt.Errorf("eth.SerializeTo: %w", err)
+			}
+			bytes, err := buf.AppendBytes(len(payload))
+			if err != nil {
+				return totalPackets, fmt.Errorf("buf.Apppend: %w", err)
+			}
+			copy(bytes, payload)
+		*/
+		gopacket.SerializeLayers(buf, opts,
+			&eth,
+			gopacket.Payload(payload),
+		)
+
+		packetData := buf.Bytes()
+		length := len(packetData)
+		// Padding a short frame is only harmless when the IP header
+		// says where the packet ends. A packet cut short by the
+		// snaplen of the original capture stays that way, and one
+		// without a length, as written with segmentation offload,
+		// would get the padding added to its data
+		if n, ok := ipLength(payload); ok && n != len(payload) {
+			packetData = packetData[:ethernetHeaderLength+len(payload)]
+			if n > len(payload) {
+				length = ethernetHeaderLength + n
+			} else {
+				length = len(packetData)
+			}
+		}
+
+		ci := gopacket.CaptureInfo{
+			Timestamp:     ts,
+			CaptureLength: len(packetData),
+			Length:        length,
+		}
+
+		err = w.WritePacket(ci, packetData, recordComment(totalPackets, checksums, errs))
+		log.Printf("Wrote packet of length %d with version %d", len(packetData), payload_version)
+		if err != nil {
+			return totalPackets, fmt.Errorf("Error writing packet %w", err)
+		}
+		totalPackets += 1
+	}
+	if checksums != checksum.None {
+		log.Printf("%d bad checksums found", badChecksums)
+	}
+	return totalPackets, nil
+}
+
+const ethernetHeaderLength = 14
+
+// ipLength returns the length of the IP packet in data according to its
+// header, which is 0 for packets written with segmentation offload. ok is
+// false if data doesn't start with an IP header.
+func ipLength(data []byte) (n int, ok bool) {
+	switch {
+	case len(data) >= 20 && data[0]>>4 == 4:
+		return int(binary.BigEndian.Uint16(data[2:4])), true
+	case len(data) >= 40 && data[0]>>4 == 6:
+		if l := binary.BigEndian.Uint16(data[4:6]); l != 0 {
+			return 40 + int(l), true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// recordComment is the packet comment for record index, noting the checksum
+// problems found in it.
+func recordComment(index int, checksums checksum.Mode, errs []checksum.Error) string {
+	comment := fmt.Sprintf("pkt record #%d", index)
+	for _, err := range errs {
+		comment += "; " + err.Error()
+		if checksums == checksum.Fix {
+			comment += ", fixed"
+		}
+	}
+	return comment
+}
@@ -0,0 +1,164 @@
+package build
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"time"
+
+	"github.com/JustinAzoff/pcap_simplify/extract"
+	"github.com/JustinAzoff/pcap_simplify/pkt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// maxDatagram is the most a record sent as a single IP packet can hold,
+// after the IP header and the header of the protocol.
+func maxDatagram(header int) int {
+	return 65535 - 20 - header
+}
+
+// ICMPPacketGenerator builds ping conversations, the client sending echo
+// requests and the server answering with echo replies. The records are
+// the echo data.
+type ICMPPacketGenerator struct {
+	handle    PacketWriter
+	SourceMAC net.HardwareAddr
+	DestMAC   net.HardwareAddr
+	SourceIP  net.IP
+	DestIP    net.IP
+	// SourceIP6 and DestIP6 are used for ICMPv6
+	SourceIP6 net.IP
+	DestIP6   net.IP
+	ID        uint16
+
+	seq  uint16
+	buf  gopacket.SerializeBuffer
+	opts gopacket.SerializeOptions
+}
+
+// NewICMPPacketGenerator returns a generator using the same addresses as
+// NewTCPPacketGenerator. They may be changed before the first Write.
+func NewICMPPacketGenerator(handle PacketWriter) (*ICMPPacketGenerator, error) {
+	t, err := NewTCPPacketGenerator(handle)
+	if err != nil {
+		return nil, err
+	}
+	return &ICMPPacketGenerator{
+		handle:    handle,
+		SourceMAC: t.SourceMAC,
+		DestMAC:   t.DestMAC,
+		SourceIP:  t.SourceIP,
+		DestIP:    t.DestIP,
+		SourceIP6: net.ParseIP("fd00::1"),
+		DestIP6:   net.ParseIP("fd00::2"),
+		ID:        uint16(randomPort()),
+		buf:       t.buf,
+		opts:      t.opts,
+	}, nil
+}
+
+// Write sends data as an echo request from the client if isOrig is set,
+// or as the reply to the last request from the server otherwise. With v6
+// it uses ICMPv6 over IPv6.
+func (g *ICMPPacketGenerator) Write(data []byte, isOrig bool, v6 bool) error {
+	if len(data) > maxDatagram(8) {
+		return fmt.Errorf("Record of %d bytes is too large for a single echo", len(data))
+	}
+	if isOrig {
+		g.seq++
+	}
+	src, dst := g.SourceIP, g.DestIP
+	proto := layers.IPProtocolICMPv4
+	if v6 {
+		src, dst = g.SourceIP6, g.DestIP6
+		proto = layers.IPProtocolICMPv6
+	}
+	eth, ip := frameLayers(g.SourceMAC, g.DestMAC, src, dst, proto)
+	if !isOrig {
+		eth, ip = frameLayers(g.DestMAC, g.SourceMAC, dst, src, proto)
+	}
+	payload := gopacket.Payload(data)
+	if !v6 {
+		typ := uint8(layers.ICMPv4TypeEchoRequest)
+		if !isOrig {
+			typ = layers.ICMPv4TypeEchoReply
+		}
+		icmp := layers.ICMPv4{TypeCode: layers.CreateICMPv4TypeCode(typ, 0), Id: g.ID, Seq: g.seq}
+		if err := gopacket.SerializeLayers(g.buf, g.opts, &eth, ip, &icmp, &payload); err != nil {
+			return err
+		}
+		return g.handle.WritePacketData(g.buf.Bytes())
+	}
+	typ := uint8(layers.ICMPv6TypeEchoRequest)
+	if !isOrig {
+		typ = layers.ICMPv6TypeEchoReply
+	}
+	icmp := layers.ICMPv6{TypeCode: layers.CreateICMPv6TypeCode(typ, 0)}
+	icmp.SetNetworkLayerForChecksum(ip)
+	echo := layers.ICMPv6Echo{Identifier: g.ID, SeqNumber: g.seq}
+	if err := gopacket.SerializeLayers(g.buf, g.opts, &eth, ip, &icmp, &echo, &payload); err != nil {
+		return err
+	}
+	return g.handle.WritePacketData(g.buf.Bytes())
+}
+
+func ipv6Layer(src, dst net.IP, proto layers.IPProtocol) layers.IPv6 {
+	return layers.IPv6{
+		SrcIP:      src,
+		DstIP:      dst,
+		Version:    6,
+		HopLimit:   64,
+		NextHeader: proto,
+	}
+}
+
+// ExpandICMP sends the records read from r as pings through handle, using
+// ICMPv6 for the records with the icmpv6 protocol metadata. It returns the
+// number of records sent.
+func ExpandICMP(r io.Reader, handle PacketWriter, opts ExpandOptions) (int, error) {
+	//just slurp it up
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return 0, err
+	}
+	b, err := pkt.NewReader(data)
+	if err != nil {
+		return 0, err
+	}
+	g, err := NewICMPPacketGenerator(handle)
+	if err != nil {
+		return 0, err
+	}
+	client, server, err := opts.addresses(b.Metadata)
+	if err != nil {
+		return 0, err
+	}
+	switch {
+	case client == nil:
+	case client.To4() == nil:
+		g.SourceIP6, g.DestIP6 = client, server
+	default:
+		g.SourceIP, g.DestIP = client, server
+	}
+	totalPackets := 0
+	for {
+		is_orig, payload, err := b.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return totalPackets, err
+		}
+		annotate(handle, "pkt record #%d, %s", totalPackets, direction(is_orig))
+		totalPackets++
+		log.Printf("is_orig %v sending %d bytes\n", is_orig, len(payload))
+		if err := g.Write(payload, is_orig, b.Metadata["protocol"] == extract.ProtoICMPv6); err != nil {
+			return totalPackets, err
+		}
+		time.Sleep(recordDelay)
+	}
+	return totalPackets, nil
+}
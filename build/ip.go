@@ -0,0 +1,111 @@
+package build
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/JustinAzoff/pcap_simplify/pkt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// IPPacketGenerator sends records as the payload of IPv4 packets of any
+// protocol, such as GRE.
+type IPPacketGenerator struct {
+	handle    PacketWriter
+	SourceMAC net.HardwareAddr
+	DestMAC   net.HardwareAddr
+	SourceIP  net.IP
+	DestIP    net.IP
+
+	buf  gopacket.SerializeBuffer
+	opts gopacket.SerializeOptions
+}
+
+// NewIPPacketGenerator returns a generator using the same addresses as
+// NewTCPPacketGenerator. They may be changed before the first Write.
+func NewIPPacketGenerator(handle PacketWriter) (*IPPacketGenerator, error) {
+	t, err := NewTCPPacketGenerator(handle)
+	if err != nil {
+		return nil, err
+	}
+	return &IPPacketGenerator{
+		handle:    handle,
+		SourceMAC: t.SourceMAC,
+		DestMAC:   t.DestMAC,
+		SourceIP:  t.SourceIP,
+		DestIP:    t.DestIP,
+		buf:       t.buf,
+		opts:      t.opts,
+	}, nil
+}
+
+// Write sends data as the payload of a packet of proto from the client if
+// isOrig is set, or from the server otherwise.
+func (g *IPPacketGenerator) Write(data []byte, isOrig bool, proto layers.IPProtocol) error {
+	if len(data) > maxDatagram(0) {
+		return fmt.Errorf("Record of %d bytes is too large for a single IP packet", len(data))
+	}
+	eth, ip := frameLayers(g.SourceMAC, g.DestMAC, g.SourceIP, g.DestIP, proto)
+	if !isOrig {
+		eth, ip = frameLayers(g.DestMAC, g.SourceMAC, g.DestIP, g.SourceIP, proto)
+	}
+	payload := gopacket.Payload(data)
+	if err := gopacket.SerializeLayers(g.buf, g.opts, &eth, ip, &payload); err != nil {
+		return err
+	}
+	return g.handle.WritePacketData(g.buf.Bytes())
+}
+
+// ExpandIP sends the records read from r through handle as IP packets of
+// the protocol in the ip_protocol metadata. It returns the number of
+// records sent.
+func ExpandIP(r io.Reader, handle PacketWriter, opts ExpandOptions) (int, error) {
+	//just slurp it up
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return 0, err
+	}
+	b, err := pkt.NewReader(data)
+	if err != nil {
+		return 0, err
+	}
+	g, err := NewIPPacketGenerator(handle)
+	if err != nil {
+		return 0, err
+	}
+	client, server, err := opts.addresses(b.Metadata)
+	if err != nil {
+		return 0, err
+	}
+	if client != nil {
+		g.SourceIP, g.DestIP = client, server
+	}
+	totalPackets := 0
+	for {
+		is_orig, payload, err := b.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return totalPackets, err
+		}
+		proto, err := strconv.ParseUint(b.Metadata["ip_protocol"], 10, 8)
+		if err != nil {
+			return totalPackets, fmt.Errorf("Record #%d has no valid ip_protocol metadata, which says what protocol to send it as", totalPackets)
+		}
+		annotate(handle, "pkt record #%d, %s", totalPackets, direction(is_orig))
+		totalPackets++
+		log.Printf("is_orig %v sending %d bytes\n", is_orig, len(payload))
+		if err := g.Write(payload, is_orig, layers.IPProtocol(proto)); err != nil {
+			return totalPackets, err
+		}
+		time.Sleep(recordDelay)
+	}
+	return totalPackets, nil
+}
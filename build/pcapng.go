@@ -0,0 +1,207 @@
+package build
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/JustinAzoff/pcap_simplify/extract"
+	"github.com/JustinAzoff/pcap_simplify/internal/pcapng"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// Format is the file format the rebuilt packets are written in.
+type Format int
+
+const (
+	FormatPcap Format = iota
+	// FormatPcapng keeps the section info and the packet comments
+	FormatPcapng
+)
+
+// ParseFormat parses the value of the -format flag.
+func ParseFormat(s string) (Format, error) {
+	switch s {
+	case "", "pcap":
+		return FormatPcap, nil
+	case "pcapng":
+		return FormatPcapng, nil
+	}
+	return FormatPcap, fmt.Errorf("Invalid format %q, expected pcap or pcapng", s)
+}
+
+// SectionInfo describes how a file was made. It ends up in the section
+// header of pcapng files and is dropped for classic pcap.
+type SectionInfo struct {
+	// Application is the tool that generated the file
+	Application string
+	// Comment holds the options the tool was run with
+	Comment string
+}
+
+// FileOptions says how the Expand functions write their output.
+type FileOptions struct {
+	Format  Format
+	Section SectionInfo
+	// Stats, if set, counts the packets written
+	Stats *Stats
+}
+
+// FileWriter writes packets to a pcap or pcapng file. The comment is only
+// kept by pcapng files, where it shows up as the packet comment in
+// Wireshark.
+type FileWriter interface {
+	WritePacket(ci gopacket.CaptureInfo, data []byte, comment string) error
+}
+
+// NewFileWriter writes the file header for packets of linkType to w.
+func NewFileWriter(w io.Writer, snaplen uint32, linkType extract.LinkType, opts FileOptions) (FileWriter, error) {
+	fw, err := newFileWriter(w, snaplen, linkType, opts)
+	if err != nil || opts.Stats == nil {
+		return fw, err
+	}
+	return countingFileWriter{fw, opts.Stats}, nil
+}
+
+func newFileWriter(w io.Writer, snaplen uint32, linkType extract.LinkType, opts FileOptions) (FileWriter, error) {
+	if opts.Format == FormatPcapng {
+		return newNgWriter(w, snaplen, linkType, opts.Section)
+	}
+	if err := writeFileHeader(w, snaplen, linkType); err != nil {
+		return nil, err
+	}
+	return pcapWriter{pcapgo.NewWriter(w)}, nil
+}
+
+type pcapWriter struct {
+	*pcapgo.Writer
+}
+
+func (w pcapWriter) WritePacket(ci gopacket.CaptureInfo, data []byte, comment string) error {
+	return w.Writer.WritePacket(ci, data)
+}
+
+// What the pcapng writer puts in its blocks, the block types and option
+// codes are in internal/pcapng.
+const (
+	ngSectionLengthUnknown = 0xFFFFFFFFFFFFFFFF
+	ngNanosecondResolution = 9
+	// type and length before the body, and the length again after it
+	ngBlockOverhead = 12
+
+	ngInterfaceName        = "pcapsimplify"
+	ngInterfaceDescription = "Packets rebuilt from a .pkt file"
+)
+
+// ngWriter writes pcapng files. pcapgo.NgWriter can't write packet
+// comments, so this writes the blocks itself, all in little endian.
+type ngWriter struct {
+	w   io.Writer
+	buf []byte
+}
+
+func newNgWriter(w io.Writer, snaplen uint32, linkType extract.LinkType, section SectionInfo) (*ngWriter, error) {
+	n := &ngWriter{w: w}
+
+	var body []byte
+	body = appendUint32(body, pcapng.ByteOrderMagic)
+	body = appendUint16(body, 1)
+	body = appendUint16(body, 0)
+	body = appendUint64(body, ngSectionLengthUnknown)
+	var opts []byte
+	opts = appendOption(opts, pcapng.OptionComment, section.Comment)
+	opts = appendOption(opts, pcapng.OptionShbUserAppl, section.Application)
+	if err := n.writeBlock(pcapng.BlockSectionHeader, body, opts); err != nil {
+		return nil, err
+	}
+
+	body = body[:0]
+	body = appendUint16(body, uint16(linkType))
+	body = appendUint16(body, 0)
+	body = appendUint32(body, snaplen)
+	opts = opts[:0]
+	opts = appendOption(opts, pcapng.OptionIfName, ngInterfaceName)
+	opts = appendOption(opts, pcapng.OptionIfDescription, ngInterfaceDescription)
+	opts = appendOption(opts, pcapng.OptionIfTsResol, string([]byte{ngNanosecondResolution}))
+	if err := n.writeBlock(pcapng.BlockInterface, body, opts); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+func (n *ngWriter) WritePacket(ci gopacket.CaptureInfo, data []byte, comment string) error {
+	if ci.CaptureLength != len(data) {
+		return fmt.Errorf("Capture length %d does not match data length %d", ci.CaptureLength, len(data))
+	}
+	ts := uint64(ci.Timestamp.UnixNano())
+	body := n.buf[:0]
+	body = appendUint32(body, 0) // interface id
+	body = appendUint32(body, uint32(ts>>32))
+	body = appendUint32(body, uint32(ts))
+	body = appendUint32(body, uint32(ci.CaptureLength))
+	body = appendUint32(body, uint32(ci.Length))
+	body = append(body, data...)
+	body = appendPadding(body)
+	var opts []byte
+	opts = appendOption(opts, pcapng.OptionComment, comment)
+	n.buf = body
+	return n.writeBlock(pcapng.BlockEnhancedPacket, body, opts)
+}
+
+// writeBlock writes a block made of body followed by the options, if there
+// are any.
+func (n *ngWriter) writeBlock(blockType uint32, body, opts []byte) error {
+	if len(opts) > 0 {
+		opts = appendUint32(opts, pcapng.OptionEnd)
+	}
+	length := uint32(ngBlockOverhead + len(body) + len(opts))
+	var head []byte
+	head = appendUint32(head, blockType)
+	head = appendUint32(head, length)
+	for _, b := range [][]byte{head, body, opts, head[4:8]} {
+		if _, err := n.w.Write(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// appendOption appends an option with a string value, unless it is empty.
+func appendOption(b []byte, code uint16, value string) []byte {
+	if value == "" {
+		return b
+	}
+	if len(value) > 0xffff {
+		value = value[:0xffff]
+	}
+	b = appendUint16(b, code)
+	b = appendUint16(b, uint16(len(value)))
+	b = append(b, value...)
+	return appendPadding(b)
+}
+
+func appendPadding(b []byte) []byte {
+	for len(b)%4 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	var buf [2]byte
+	binary.LittleEndian.PutUint16(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	var buf [4]byte
+	binary.LittleEndian.PutUint32(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], v)
+	return append(b, buf[:]...)
+}
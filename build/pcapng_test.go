@@ -0,0 +1,104 @@
+package build
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/JustinAzoff/pcap_simplify/extract"
+	"github.com/JustinAzoff/pcap_simplify/internal/pcapng"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// ngOptions returns the string options of every block in a pcapng file.
+func ngOptions(t *testing.T, data []byte) []map[uint16]string {
+	var blocks []map[uint16]string
+	for len(data) > 0 {
+		blockType := binary.LittleEndian.Uint32(data[0:4])
+		length := binary.LittleEndian.Uint32(data[4:8])
+		if length%4 != 0 || int(length) > len(data) || binary.LittleEndian.Uint32(data[length-4:length]) != length {
+			t.Fatalf("bad block length %d", length)
+		}
+		body := data[8 : length-4]
+		switch blockType {
+		case pcapng.BlockSectionHeader:
+			body = body[16:]
+		case pcapng.BlockInterface:
+			body = body[8:]
+		case pcapng.BlockEnhancedPacket:
+			captured := binary.LittleEndian.Uint32(body[12:16])
+			body = body[20+(captured+3)/4*4:]
+		}
+		opts := map[uint16]string{}
+		for len(body) >= 4 {
+			code := binary.LittleEndian.Uint16(body[0:2])
+			n := binary.LittleEndian.Uint16(body[2:4])
+			if code == pcapng.OptionEnd {
+				break
+			}
+			opts[code] = string(body[4 : 4+n])
+			body = body[4+(int(n)+3)/4*4:]
+		}
+		blocks = append(blocks, opts)
+		data = data[length:]
+	}
+	return blocks
+}
+
+func TestPcapngWriter(t *testing.T) {
+	var buf bytes.Buffer
+	section := SectionInfo{Application: "pcapsimplify", Comment: "pcapsimplify build -format=pcapng in.pkt"}
+	w, err := NewFileWriter(&buf, 65536, extract.LinkType(layers.LinkTypeRaw), FileOptions{Format: FormatPcapng, Section: section})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := time.Unix(1600000000, 123456789)
+	packets := [][]byte{[]byte("hello"), []byte("four"), []byte("no comment")}
+	comments := []string{"pkt record #0", "pkt record #1; bad TCP checksum", ""}
+	for i, p := range packets {
+		ci := gopacket.CaptureInfo{Timestamp: ts, CaptureLength: len(p), Length: len(p)}
+		if err := w.WritePacket(ci, p, comments[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r, err := pcapgo.NewNgReader(bytes.NewReader(buf.Bytes()), pcapgo.DefaultNgReaderOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.LinkType() != layers.LinkTypeRaw {
+		t.Errorf("link type %v, expected %v", r.LinkType(), layers.LinkTypeRaw)
+	}
+	for i, want := range packets {
+		data, ci, err := r.ReadPacketData()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, want) {
+			t.Errorf("packet %d is %q, expected %q", i, data, want)
+		}
+		if !ci.Timestamp.Equal(ts) {
+			t.Errorf("packet %d timestamp %v, expected %v", i, ci.Timestamp, ts)
+		}
+	}
+	if _, _, err := r.ReadPacketData(); err != io.EOF {
+		t.Errorf("expected EOF after the last packet, got %v", err)
+	}
+
+	blocks := ngOptions(t, buf.Bytes())
+	if len(blocks) != 2+len(packets) {
+		t.Fatalf("got %d blocks, expected %d", len(blocks), 2+len(packets))
+	}
+	if blocks[0][pcapng.OptionShbUserAppl] != section.Application || blocks[0][pcapng.OptionComment] != section.Comment {
+		t.Errorf("section header options %q, expected %+v", blocks[0], section)
+	}
+	for i, comment := range comments {
+		if got := blocks[2+i][pcapng.OptionComment]; got != comment {
+			t.Errorf("packet %d comment %q, expected %q", i, got, comment)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package build
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+
+	"github.com/JustinAzoff/pcap_simplify/extract"
+	"github.com/JustinAzoff/pcap_simplify/pkt"
+)
+
+type protocolRecord struct {
+	isOrig  bool
+	payload string
+	meta    pkt.Metadata
+}
+
+// writeProtocolRecords writes records to a .pkt file, along with the
+// metadata each of them needs.
+func writeProtocolRecords(t *testing.T, records []protocolRecord) []byte {
+	var buf bytes.Buffer
+	w := pkt.NewWriter(&buf)
+	for _, rec := range records {
+		if rec.meta != nil {
+			if err := w.WriteMetadata(rec.meta); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.Write(rec.isOrig, []byte(rec.payload)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+// readProtocolRecords returns the data records of a .pkt file, each with
+// the metadata in effect when it was read.
+func readProtocolRecords(t *testing.T, data []byte, keys ...string) []protocolRecord {
+	r, err := pkt.NewReader(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var records []protocolRecord
+	for {
+		isOrig, payload, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		meta := pkt.Metadata{}
+		for _, k := range keys {
+			meta[k] = r.Metadata[k]
+		}
+		records = append(records, protocolRecord{isOrig, string(payload), meta})
+	}
+	return records
+}
+
+// TestExpandProtocolsRoundTrip builds pcaps from .pkt files and makes sure
+// extracting them gives the same records and metadata back.
+func TestExpandProtocolsRoundTrip(t *testing.T) {
+	icmp := pkt.Metadata{"protocol": "icmp"}
+	icmpv6 := pkt.Metadata{"protocol": "icmpv6"}
+	gre := pkt.Metadata{"protocol": "ip", "ip_protocol": "47"}
+	experimental := pkt.Metadata{"protocol": "ip", "ip_protocol": "253"}
+	for _, tt := range []struct {
+		name   string
+		expand func(io.Reader, PacketWriter, ExpandOptions) (int, error)
+		keys   []string
+		in     []protocolRecord
+	}{
+		{"icmp", ExpandICMP, []string{"protocol"}, []protocolRecord{
+			{true, "ping", icmp},
+			{false, "ping", nil},
+			{true, "pong", nil},
+			{false, "pong", nil},
+		}},
+		{"icmpv6", ExpandICMP, []string{"protocol"}, []protocolRecord{
+			{true, "ping6", icmpv6},
+			{false, "ping6", nil},
+		}},
+		{"sctp", ExpandSCTP, []string{"protocol", "sctp_stream", "sctp_ppid"}, []protocolRecord{
+			{true, "hello", pkt.Metadata{"protocol": "sctp", "sctp_stream": "0", "sctp_ppid": "0"}},
+			{false, "on stream 3", pkt.Metadata{"sctp_stream": "3", "sctp_ppid": "46"}},
+			{true, "back on 0", pkt.Metadata{"sctp_stream": "0", "sctp_ppid": "0"}},
+		}},
+		{"ip", ExpandIP, []string{"protocol", "ip_protocol"}, []protocolRecord{
+			{true, "\x00\x00\x88\xbe", gre},
+			{false, "anything", experimental},
+		}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var rebuilt bytes.Buffer
+			handle, err := NewPcapPacketWriter(nopCloser{&rebuilt})
+			if err != nil {
+				t.Fatal(err)
+			}
+			n, err := tt.expand(bytes.NewReader(writeProtocolRecords(t, tt.in)), handle, ExpandOptions{Port: 2905})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != len(tt.in) {
+				t.Errorf("sent %d records, expected %d", n, len(tt.in))
+			}
+
+			r, err := extract.NewReader(&rebuilt)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var extracted bytes.Buffer
+			protocols, _ := extract.ParseProtocols("all")
+			if _, _, err := extract.Simplify(r, &extracted, extract.Options{Protocols: protocols}); err != nil {
+				t.Fatal(err)
+			}
+			got := readProtocolRecords(t, extracted.Bytes(), tt.keys...)
+			want := readProtocolRecords(t, writeProtocolRecords(t, tt.in), tt.keys...)
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got records\n%v\nexpected\n%v", got, want)
+			}
+		})
+	}
+}
+
+func TestExpandIPWithoutProtocol(t *testing.T) {
+	var rebuilt bytes.Buffer
+	handle, err := NewPcapPacketWriter(nopCloser{&rebuilt})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := writeProtocolRecords(t, []protocolRecord{{true, "data", nil}})
+	if _, err := ExpandIP(bytes.NewReader(data), handle, ExpandOptions{}); err == nil {
+		t.Error("expected an error for a record without ip_protocol")
+	}
+}
+
+// TestExpandOriginalAddresses makes sure the conversations built with the
+// original addresses extract to the same flow as the .pkt file they were
+// built from.
+func TestExpandOriginalAddresses(t *testing.T) {
+	icmpv6 := writeProtocolRecords(t, []protocolRecord{
+		{true, "ping", pkt.Metadata{"protocol": "icmpv6", "orig_addr": "2001:db8::1", "resp_addr": "2001:db8::2"}},
+		{false, "ping", nil},
+	})
+	for _, tt := range []struct {
+		name   string
+		data   []byte
+		expand func(io.Reader, PacketWriter, ExpandOptions) (int, error)
+	}{
+		{"tcp ipv6", readGolden(t, "ipv6.pkt"), ExpandTCPWithOptions},
+		{"udp", readGolden(t, "udp.pkt"), ExpandUDPPackets},
+		{"icmpv6", icmpv6, ExpandICMP},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			want, err := ReadFlow(tt.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var rebuilt bytes.Buffer
+			handle, err := NewPcapPacketWriter(nopCloser{&rebuilt})
+			if err != nil {
+				t.Fatal(err)
+			}
+			opts := ExpandOptions{Port: want.ServerPort, OriginalAddresses: true}
+			if _, err := tt.expand(bytes.NewReader(tt.data), handle, opts); err != nil {
+				t.Fatal(err)
+			}
+			r, err := extract.NewReader(&rebuilt)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var extracted bytes.Buffer
+			protocols, _ := extract.ParseProtocols("all")
+			if _, _, err := extract.Simplify(r, &extracted, extract.Options{Protocols: protocols}); err != nil {
+				t.Fatal(err)
+			}
+			got, err := ReadFlow(extracted.Bytes())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != want {
+				t.Errorf("rebuilt flow %+v, expected %+v", got, want)
+			}
+		})
+	}
+
+	// Files without addresses can't be restored
+	var rebuilt bytes.Buffer
+	handle, err := NewPcapPacketWriter(nopCloser{&rebuilt})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := writeProtocolRecords(t, []protocolRecord{{true, "data", pkt.Metadata{"protocol": "tcp"}}})
+	if _, err := ExpandTCPWithOptions(bytes.NewReader(data), handle, ExpandOptions{Port: 80, OriginalAddresses: true}); err == nil {
+		t.Error("expected an error for a file without addresses")
+	}
+}
@@ -0,0 +1,60 @@
+package build
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"time"
+
+	"github.com/JustinAzoff/pcap_simplify/extract"
+	"github.com/JustinAzoff/pcap_simplify/pkt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// ExpandRaw writes the records read from r to out as a pcap of raw IP
+// packets. It returns the number of records written.
+func ExpandRaw(r io.Reader, out io.Writer, fo FileOptions) (int, error) {
+	//just slurp it up
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return 0, err
+	}
+	b, err := pkt.NewReader(data)
+	if err != nil {
+		return 0, err
+	}
+	w, err := NewFileWriter(out, 65536, extract.LinkType(layers.LinkTypeRaw), fo)
+	if err != nil {
+		return 0, err
+	}
+	totalPackets := 0
+	start := time.Now()
+	ts := start
+
+	for {
+		ts = ts.Add(time.Duration(200) * time.Millisecond)
+		_, payload, err := b.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return totalPackets, err
+		}
+
+		ci := gopacket.CaptureInfo{
+			Timestamp:     ts,
+			CaptureLength: len(payload),
+			Length:        len(payload),
+		}
+
+		err = w.WritePacket(ci, payload, fmt.Sprintf("pkt record #%d", totalPackets))
+		log.Printf("Wrote packet of length %d", len(payload))
+		if err != nil {
+			return totalPackets, fmt.Errorf("Error writing packet %w", err)
+		}
+		totalPackets += 1
+	}
+	return totalPackets, nil
+}
@@ -0,0 +1,315 @@
+package build
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// A Scenario describes a conversation by hand instead of extracting it from
+// a pcap. Scenarios are written in YAML, or in JSON since that is valid
+// YAML as well:
+//
+//	protocol: tcp
+//	client: {ip: 10.0.0.1, port: 40000}
+//	server: {ip: 10.0.0.2, port: 80}
+//	messages:
+//	  - from: client
+//	    data: "GET / HTTP/1.1\r\n\r\n"
+//	  - from: server
+//	    hex: "48 54 54 50"
+//	    segment: 2
+//	  - from: server
+//	    data: "more"
+//	    delay: 2s
+//	teardown: {style: rst, from: server, delay: 1s}
+//
+// Delays are waited for before sending, as a duration like "2s" or a number
+// of seconds. Segment splits a message into segments of at most that many
+// bytes, 1400 by default for TCP, and ack makes the receiver acknowledge
+// every segment. Delay, segment and ack can be set for all messages at the
+// top level too. The teardown style is fin, rst or none, and may be given on
+// its own as in "teardown: rst".
+type Scenario struct {
+	Protocol string           `yaml:"protocol"`
+	Client   ScenarioEndpoint `yaml:"client"`
+	Server   ScenarioEndpoint `yaml:"server"`
+	Delay    Duration         `yaml:"delay"`
+	Segment  int              `yaml:"segment"`
+	Ack      bool             `yaml:"ack"`
+	Messages []Message        `yaml:"messages"`
+	Teardown Teardown         `yaml:"teardown"`
+}
+
+// ScenarioEndpoint is the client or server side of a Scenario.
+type ScenarioEndpoint struct {
+	MAC  string `yaml:"mac"`
+	IP   string `yaml:"ip"`
+	Port int    `yaml:"port"`
+}
+
+// Message is a single message of a Scenario, given either as a string in
+// Data or as hex bytes in Hex. Either may be empty: an empty UDP message is
+// an empty datagram, an empty TCP message sends nothing.
+type Message struct {
+	From    string    `yaml:"from"`
+	Data    *string   `yaml:"data"`
+	Hex     *string   `yaml:"hex"`
+	Delay   *Duration `yaml:"delay"`
+	Segment int       `yaml:"segment"`
+	Ack     *bool     `yaml:"ack"`
+
+	payload []byte
+}
+
+// Teardown says how the conversation of a Scenario ends.
+type Teardown struct {
+	Style string   `yaml:"style"`
+	From  string   `yaml:"from"`
+	Delay Duration `yaml:"delay"`
+}
+
+// UnmarshalYAML accepts the style on its own as well as the full mapping.
+func (t *Teardown) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		t.Style = value.Value
+		return nil
+	}
+	type plain Teardown
+	return value.Decode((*plain)(t))
+}
+
+// Duration is a time.Duration that can be written as "2s" or as a number
+// of seconds.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalYAML(value *yaml.Node) error {
+	if secs, err := strconv.ParseFloat(value.Value, 64); err == nil {
+		*d = Duration(secs * float64(time.Second))
+		return nil
+	}
+	v, err := time.ParseDuration(value.Value)
+	if err != nil {
+		return fmt.Errorf("Invalid duration %q on line %d", value.Value, value.Line)
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// IsScenario reports whether data holds a scenario rather than a .pkt file.
+// A scenario is text, so data that starts with anything but a printable
+// character, like a pcap or a .pkt file with a broken magic, is not one.
+func IsScenario(data []byte) bool {
+	data = bytes.TrimLeft(data, " \t\r\n")
+	if bytes.HasPrefix(data, []byte("\xef\xbb\xbf")) {
+		// A UTF-8 byte order mark
+		return true
+	}
+	return len(data) > 0 && data[0] >= 0x20 && data[0] < 0x7f
+}
+
+// ParseScenario parses and checks a scenario. protocol and port are used
+// when the scenario leaves the protocol or the server port out.
+func ParseScenario(data []byte, protocol string, port int) (*Scenario, error) {
+	s := &Scenario{}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(s); err != nil {
+		return nil, fmt.Errorf("Can't parse scenario: %v", err)
+	}
+
+	if s.Protocol == "" {
+		s.Protocol = protocol
+	}
+	if s.Protocol != "tcp" && s.Protocol != "udp" {
+		return nil, fmt.Errorf("Invalid protocol %q, expected tcp or udp", s.Protocol)
+	}
+	if s.Server.Port == 0 {
+		s.Server.Port = port
+	}
+	for _, e := range []ScenarioEndpoint{s.Client, s.Server} {
+		if e.MAC != "" {
+			if _, err := net.ParseMAC(e.MAC); err != nil {
+				return nil, fmt.Errorf("Invalid mac: %v: %w", e.MAC, err)
+			}
+		}
+		if e.IP != "" {
+			if ip := net.ParseIP(e.IP); ip == nil || ip.To4() == nil {
+				return nil, fmt.Errorf("Invalid ip: %v, only IPv4 addresses are supported", e.IP)
+			}
+		}
+		if e.Port < 0 || e.Port > 65535 {
+			return nil, fmt.Errorf("Invalid port: %d", e.Port)
+		}
+	}
+
+	if len(s.Messages) == 0 {
+		return nil, fmt.Errorf("Scenario has no messages")
+	}
+	for i := range s.Messages {
+		m := &s.Messages[i]
+		if m.From != "client" && m.From != "server" {
+			return nil, fmt.Errorf("Message %d: invalid from %q, expected client or server", i+1, m.From)
+		}
+		if (m.Data == nil) == (m.Hex == nil) {
+			return nil, fmt.Errorf("Message %d: needs either data or hex", i+1)
+		}
+		if m.Data != nil {
+			m.payload = []byte(*m.Data)
+		} else {
+			var err error
+			if m.payload, err = hex.DecodeString(strings.Join(strings.Fields(*m.Hex), "")); err != nil {
+				return nil, fmt.Errorf("Message %d: invalid hex: %v", i+1, err)
+			}
+		}
+		if m.Segment < 0 {
+			return nil, fmt.Errorf("Message %d: invalid segment size %d", i+1, m.Segment)
+		}
+	}
+	if s.Segment < 0 {
+		return nil, fmt.Errorf("Invalid segment size %d", s.Segment)
+	}
+
+	switch s.Teardown.Style {
+	case "":
+		s.Teardown.Style = "fin"
+	case "fin", "rst", "none":
+	default:
+		return nil, fmt.Errorf("Invalid teardown style %q, expected fin, rst or none", s.Teardown.Style)
+	}
+	switch s.Teardown.From {
+	case "":
+		s.Teardown.From = "client"
+	case "client", "server":
+	default:
+		return nil, fmt.Errorf("Invalid teardown from %q, expected client or server", s.Teardown.From)
+	}
+	if s.Protocol == "udp" && s.Teardown.Style == "rst" {
+		return nil, fmt.Errorf("UDP conversations can't be reset")
+	}
+	return s, nil
+}
+
+// addresses overrides the default addresses with the ones the scenario sets.
+func (s *Scenario) addresses(sourceMAC, destMAC *net.HardwareAddr, sourceIP, destIP *net.IP) {
+	if s.Client.MAC != "" {
+		*sourceMAC, _ = net.ParseMAC(s.Client.MAC)
+	}
+	if s.Server.MAC != "" {
+		*destMAC, _ = net.ParseMAC(s.Server.MAC)
+	}
+	if s.Client.IP != "" {
+		*sourceIP = net.ParseIP(s.Client.IP)
+	}
+	if s.Server.IP != "" {
+		*destIP = net.ParseIP(s.Server.IP)
+	}
+}
+
+// segments splits the payload of m the way the scenario asks for.
+func (s *Scenario) segments(m *Message) [][]byte {
+	size := m.Segment
+	if size == 0 {
+		size = s.Segment
+	}
+	if size == 0 && s.Protocol == "tcp" {
+		// The same default as ExpandTCP
+		size = 1400
+	}
+	if size == 0 || (len(m.payload) == 0 && s.Protocol == "udp") {
+		return [][]byte{m.payload}
+	}
+	var segments [][]byte
+	payload := m.payload
+	for len(payload) > 0 {
+		pl := payload
+		if len(pl) > size {
+			pl = pl[:size]
+		}
+		segments = append(segments, pl)
+		payload = payload[len(pl):]
+	}
+	return segments
+}
+
+func (s *Scenario) wait(m *Message) {
+	delay := s.Delay
+	if m.Delay != nil {
+		delay = *m.Delay
+	}
+	time.Sleep(time.Duration(delay))
+}
+
+// Run sends the conversation through handle. It returns the number of
+// messages sent.
+func (s *Scenario) Run(handle PacketWriter) (int, error) {
+	if s.Protocol == "udp" {
+		return s.runUDP(handle)
+	}
+	return s.runTCP(handle)
+}
+
+func (s *Scenario) runTCP(handle PacketWriter) (int, error) {
+	t, err := NewTCPPacketGenerator(handle)
+	if err != nil {
+		return 0, err
+	}
+	s.addresses(&t.SourceMAC, &t.DestMAC, &t.SourceIP, &t.DestIP)
+	annotate(handle, "handshake")
+	if err := t.Connect(s.Client.Port, s.Server.Port); err != nil {
+		return 0, err
+	}
+	for i := range s.Messages {
+		m := &s.Messages[i]
+		s.wait(m)
+		ack := s.Ack
+		if m.Ack != nil {
+			ack = *m.Ack
+		}
+		annotate(handle, "scenario message %d, %s", i+1, direction(m.From == "client"))
+		for _, pl := range s.segments(m) {
+			log.Printf("%s sending %d bytes", m.From, len(pl))
+			if err := t.Write(pl, m.From == "client", ack); err != nil {
+				return i, err
+			}
+		}
+	}
+	time.Sleep(time.Duration(s.Teardown.Delay))
+	annotate(handle, "teardown")
+	isOrig := s.Teardown.From == "client"
+	switch s.Teardown.Style {
+	case "fin":
+		err = t.Shutdown(isOrig)
+	case "rst":
+		err = t.Reset(isOrig)
+	}
+	return len(s.Messages), err
+}
+
+func (s *Scenario) runUDP(handle PacketWriter) (int, error) {
+	u, err := NewUDPPacketGenerator(handle, s.Client.Port, s.Server.Port)
+	if err != nil {
+		return 0, err
+	}
+	s.addresses(&u.SourceMAC, &u.DestMAC, &u.SourceIP, &u.DestIP)
+	for i := range s.Messages {
+		m := &s.Messages[i]
+		s.wait(m)
+		annotate(handle, "scenario message %d, %s", i+1, direction(m.From == "client"))
+		// Every segment becomes a datagram of its own
+		for _, pl := range s.segments(m) {
+			log.Printf("%s sending %d bytes", m.From, len(pl))
+			if err := u.Write(pl, m.From == "client"); err != nil {
+				return i, err
+			}
+		}
+	}
+	return len(s.Messages), nil
+}
@@ -0,0 +1,154 @@
+package build
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// memoryWriter keeps every packet written to it.
+type memoryWriter struct {
+	packets []gopacket.Packet
+}
+
+func (w *memoryWriter) WritePacketData(data []byte) error {
+	buf := make([]byte, len(data))
+	copy(buf, data)
+	w.packets = append(w.packets, gopacket.NewPacket(buf, layers.LayerTypeEthernet, gopacket.Default))
+	return nil
+}
+
+func (w *memoryWriter) Close() error { return nil }
+
+func TestScenarioTCP(t *testing.T) {
+	scenario := `
+client: {ip: 192.168.1.1, port: 40000}
+server: {ip: 192.168.1.2}
+messages:
+  - from: client
+    data: "GET / HTTP/1.1\r\n\r\n"
+  - from: server
+    hex: "48 54 54 50"
+    segment: 3
+    ack: true
+teardown: {style: rst, from: server}
+`
+	s, err := ParseScenario([]byte(scenario), "tcp", 8080)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := &memoryWriter{}
+	n, err := s.Run(w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("Run returned %d messages, expected 2", n)
+	}
+
+	type want struct {
+		src     string
+		payload string
+		syn     bool
+		rst     bool
+	}
+	wants := []want{
+		{src: "192.168.1.1:40000", syn: true},
+		{src: "192.168.1.2:8080", syn: true},
+		{src: "192.168.1.1:40000"},
+		{src: "192.168.1.1:40000", payload: "GET / HTTP/1.1\r\n\r\n"},
+		{src: "192.168.1.2:8080", payload: "HTT"},
+		{src: "192.168.1.1:40000"},
+		{src: "192.168.1.2:8080", payload: "P"},
+		{src: "192.168.1.1:40000"},
+		{src: "192.168.1.2:8080", rst: true},
+	}
+	if len(w.packets) != len(wants) {
+		t.Fatalf("got %d packets, expected %d", len(w.packets), len(wants))
+	}
+	for i, p := range w.packets {
+		ip := p.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+		tcp := p.Layer(layers.LayerTypeTCP).(*layers.TCP)
+		src := fmt.Sprintf("%v:%d", ip.SrcIP, tcp.SrcPort)
+		got := want{src: src, payload: string(tcp.Payload), syn: tcp.SYN, rst: tcp.RST}
+		if got != wants[i] {
+			t.Errorf("packet %d: got %+v, expected %+v", i, got, wants[i])
+		}
+	}
+}
+
+func TestScenarioUDP(t *testing.T) {
+	scenario := `{
+  "protocol": "udp",
+  "client": {"port": 5353},
+  "messages": [
+    {"from": "client", "data": "query"},
+    {"from": "server", "hex": "0102", "delay": 0},
+    {"from": "client", "data": "", "segment": 4}
+  ]
+}`
+	s, err := ParseScenario([]byte(scenario), "tcp", 53)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := &memoryWriter{}
+	if _, err := s.Run(w); err != nil {
+		t.Fatal(err)
+	}
+	if len(w.packets) != 3 {
+		t.Fatalf("got %d packets, expected 3", len(w.packets))
+	}
+	for i, want := range []struct {
+		src, dst layers.UDPPort
+		payload  string
+	}{{5353, 53, "query"}, {53, 5353, "\x01\x02"}, {5353, 53, ""}} {
+		udp := w.packets[i].Layer(layers.LayerTypeUDP).(*layers.UDP)
+		if udp.SrcPort != want.src || udp.DstPort != want.dst || string(udp.Payload) != want.payload {
+			t.Errorf("packet %d: got %d->%d %q, expected %d->%d %q", i, udp.SrcPort, udp.DstPort, udp.Payload, want.src, want.dst, want.payload)
+		}
+	}
+}
+
+func TestScenarioErrors(t *testing.T) {
+	for _, scenario := range []string{
+		"messages: []",
+		"messages: [{from: nobody, data: x}]",
+		"messages: [{from: client}]",
+		"messages: [{from: client, data: '', hex: ''}]",
+		"messages: [{from: client, data: x, hex: '01'}]",
+		"messages: [{from: client, hex: zz}]",
+		"messages: [{from: client, data: x, delay: soon}]",
+		"messages: [{from: client, data: x}]\nteardown: slam",
+		"messages: [{from: client, data: x}]\nclient: {ip: '::1'}",
+		"messages: [{from: client, data: x}]\ntypo: 1",
+		"protocol: sctp\nmessages: [{from: client, data: x}]",
+		"protocol: udp\nmessages: [{from: client, data: x}]\nteardown: rst",
+	} {
+		if _, err := ParseScenario([]byte(scenario), "tcp", 80); err == nil {
+			t.Errorf("ParseScenario(%q) succeeded, expected an error", scenario)
+		}
+	}
+}
+
+func TestIsScenario(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		data     string
+		scenario bool
+	}{
+		{"yaml", "messages: []", true},
+		{"json", "\n  {\"messages\": []}", true},
+		{"comment", "# scenario\nmessages: []", true},
+		{"pkt", "\x01PKT\x00hello", false},
+		{"broken pkt", "\x01PKX\x00hello", false},
+		{"pcap", "\xd4\xc3\xb2\xa1\x02\x00\x04\x00", false},
+		{"pcapng", "\x0a\x0d\x0d\x0a\x1c\x00\x00\x00", false},
+		{"empty", "", false},
+	} {
+		if got := IsScenario([]byte(tt.data)); got != tt.scenario {
+			t.Errorf("%s: IsScenario is %v, expected %v", tt.name, got, tt.scenario)
+		}
+	}
+}
@@ -0,0 +1,307 @@
+package build
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/JustinAzoff/pcap_simplify/pkt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// SCTP chunk types and flags, see RFC 9260. gopacket can't serialize DATA
+// chunks with the right length, so the chunks are built here.
+const (
+	sctpData             = 0
+	sctpInit             = 1
+	sctpInitAck          = 2
+	sctpSack             = 3
+	sctpShutdown         = 7
+	sctpShutdownAck      = 8
+	sctpCookieEcho       = 10
+	sctpCookieAck        = 11
+	sctpShutdownComplete = 14
+
+	sctpEndFragment   = 0x01
+	sctpBeginFragment = 0x02
+
+	sctpStateCookie   = 7
+	sctpDataHeaderLen = 16
+)
+
+var sctpCookie = []byte("pcapsimplify")
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// sctpEndpoint is the state of one side of an SCTP association.
+type sctpEndpoint struct {
+	eth  layers.Ethernet
+	ip   networkLayer
+	port uint16
+	// tag is the verification tag the other side has to use
+	tag uint32
+	tsn uint32
+	ssn map[uint16]uint16
+}
+
+// SCTPPacketGenerator builds SCTP associations, sending every record as a
+// user message in DATA chunks, each acknowledged by a SACK.
+type SCTPPacketGenerator struct {
+	handle     PacketWriter
+	SourceMAC  net.HardwareAddr
+	DestMAC    net.HardwareAddr
+	SourceIP   net.IP
+	DestIP     net.IP
+	SourcePort uint16
+	DestPort   uint16
+
+	buf  gopacket.SerializeBuffer
+	opts gopacket.SerializeOptions
+
+	c_s sctpEndpoint
+	s_c sctpEndpoint
+}
+
+// NewSCTPPacketGenerator returns a generator using the same addresses as
+// NewTCPPacketGenerator. They may be changed before calling Connect.
+func NewSCTPPacketGenerator(handle PacketWriter) (*SCTPPacketGenerator, error) {
+	t, err := NewTCPPacketGenerator(handle)
+	if err != nil {
+		return nil, err
+	}
+	return &SCTPPacketGenerator{
+		handle:    handle,
+		SourceMAC: t.SourceMAC,
+		DestMAC:   t.DestMAC,
+		SourceIP:  t.SourceIP,
+		DestIP:    t.DestIP,
+		buf:       t.buf,
+		opts:      t.opts,
+	}, nil
+}
+
+// sctpChunk returns a chunk holding value, padded to 4 bytes.
+func sctpChunk(typ, flags uint8, value []byte) []byte {
+	length := 4 + len(value)
+	chunk := make([]byte, (length+3)&^3)
+	chunk[0] = typ
+	chunk[1] = flags
+	binary.BigEndian.PutUint16(chunk[2:4], uint16(length))
+	copy(chunk[4:], value)
+	return chunk
+}
+
+// sctpInitChunk is an INIT or INIT ACK chunk, the latter with a cookie.
+func sctpInitChunk(typ uint8, e *sctpEndpoint) []byte {
+	value := make([]byte, 16)
+	binary.BigEndian.PutUint32(value[0:4], e.tag)
+	binary.BigEndian.PutUint32(value[4:8], 65535)
+	binary.BigEndian.PutUint16(value[8:10], 65535)
+	binary.BigEndian.PutUint16(value[10:12], 65535)
+	binary.BigEndian.PutUint32(value[12:16], e.tsn)
+	if typ == sctpInitAck {
+		param := make([]byte, 4, 4+len(sctpCookie))
+		binary.BigEndian.PutUint16(param[0:2], sctpStateCookie)
+		binary.BigEndian.PutUint16(param[2:4], uint16(4+len(sctpCookie)))
+		value = append(value, append(param, sctpCookie...)...)
+	}
+	return sctpChunk(typ, 0, value)
+}
+
+func uint32Value(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
+
+// endpoints returns the endpoint of the sender and of the receiver.
+func (g *SCTPPacketGenerator) endpoints(isOrig bool) (*sctpEndpoint, *sctpEndpoint) {
+	if isOrig {
+		return &g.c_s, &g.s_c
+	}
+	return &g.s_c, &g.c_s
+}
+
+// send sends chunks from a to b.
+func (g *SCTPPacketGenerator) send(a, b *sctpEndpoint, tag uint32, chunks ...[]byte) error {
+	data := make([]byte, 12)
+	binary.BigEndian.PutUint16(data[0:2], a.port)
+	binary.BigEndian.PutUint16(data[2:4], b.port)
+	binary.BigEndian.PutUint32(data[4:8], tag)
+	for _, c := range chunks {
+		data = append(data, c...)
+	}
+	binary.LittleEndian.PutUint32(data[8:12], crc32.Checksum(data, castagnoli))
+	payload := gopacket.Payload(data)
+	if err := gopacket.SerializeLayers(g.buf, g.opts, &a.eth, a.ip, &payload); err != nil {
+		return err
+	}
+	return g.handle.WritePacketData(g.buf.Bytes())
+}
+
+// Connect sets up the association with the four way handshake. A
+// sourcePort of 0 picks a random port.
+func (g *SCTPPacketGenerator) Connect(sourcePort, destPort int) error {
+	if sourcePort == 0 {
+		sourcePort = randomPort()
+	}
+	g.SourcePort = uint16(sourcePort)
+	g.DestPort = uint16(destPort)
+	log.Printf("Generating initial association from %d to %d", sourcePort, destPort)
+	g.c_s = sctpEndpoint{
+		port: g.SourcePort,
+		tag:  uint32(randomPort()),
+		tsn:  1,
+		ssn:  map[uint16]uint16{},
+	}
+	g.s_c = sctpEndpoint{
+		port: g.DestPort,
+		tag:  uint32(randomPort()),
+		tsn:  1,
+		ssn:  map[uint16]uint16{},
+	}
+	g.c_s.eth, g.c_s.ip = frameLayers(g.SourceMAC, g.DestMAC, g.SourceIP, g.DestIP, layers.IPProtocolSCTP)
+	g.s_c.eth, g.s_c.ip = frameLayers(g.DestMAC, g.SourceMAC, g.DestIP, g.SourceIP, layers.IPProtocolSCTP)
+	c, s := &g.c_s, &g.s_c
+	if err := g.send(c, s, 0, sctpInitChunk(sctpInit, c)); err != nil {
+		return fmt.Errorf("Error sending INIT: %w", err)
+	}
+	if err := g.send(s, c, c.tag, sctpInitChunk(sctpInitAck, s)); err != nil {
+		return fmt.Errorf("Error sending INIT ACK: %w", err)
+	}
+	if err := g.send(c, s, s.tag, sctpChunk(sctpCookieEcho, 0, sctpCookie)); err != nil {
+		return fmt.Errorf("Error sending COOKIE ECHO: %w", err)
+	}
+	if err := g.send(s, c, c.tag, sctpChunk(sctpCookieAck, 0, nil)); err != nil {
+		return fmt.Errorf("Error sending COOKIE ACK: %w", err)
+	}
+	return nil
+}
+
+// Write sends data as a user message on stream with the payload protocol
+// identifier ppid, from the client if isOrig is set or from the server
+// otherwise, and the SACK of the other side. Every message goes in a single
+// DATA chunk, as extraction writes a record per chunk. SCTP has no empty
+// messages, so nothing is sent for empty data.
+func (g *SCTPPacketGenerator) Write(data []byte, isOrig bool, stream uint16, ppid uint32) error {
+	if len(data) == 0 {
+		return nil
+	}
+	if len(data) > maxDatagram(12+sctpDataHeaderLen) {
+		return fmt.Errorf("Record of %d bytes is too large for a single DATA chunk", len(data))
+	}
+	a, b := g.endpoints(isOrig)
+	value := make([]byte, 12, 12+len(data))
+	binary.BigEndian.PutUint32(value[0:4], a.tsn)
+	binary.BigEndian.PutUint16(value[4:6], stream)
+	binary.BigEndian.PutUint16(value[6:8], a.ssn[stream])
+	binary.BigEndian.PutUint32(value[8:12], ppid)
+	flags := uint8(sctpBeginFragment | sctpEndFragment)
+	if err := g.send(a, b, b.tag, sctpChunk(sctpData, flags, append(value, data...))); err != nil {
+		return fmt.Errorf("Error sending %d bytes: %w", len(data), err)
+	}
+	sack := make([]byte, 12)
+	binary.BigEndian.PutUint32(sack[0:4], a.tsn)
+	binary.BigEndian.PutUint32(sack[4:8], 65535)
+	if err := g.send(b, a, a.tag, sctpChunk(sctpSack, 0, sack)); err != nil {
+		return fmt.Errorf("Error sending SACK: %w", err)
+	}
+	a.tsn++
+	a.ssn[stream]++
+	return nil
+}
+
+// Close shuts the association down from the client side.
+func (g *SCTPPacketGenerator) Close() error {
+	c, s := &g.c_s, &g.s_c
+	if err := g.send(c, s, s.tag, sctpChunk(sctpShutdown, 0, uint32Value(s.tsn-1))); err != nil {
+		return err
+	}
+	if err := g.send(s, c, c.tag, sctpChunk(sctpShutdownAck, 0, nil)); err != nil {
+		return err
+	}
+	return g.send(c, s, s.tag, sctpChunk(sctpShutdownComplete, 0, nil))
+}
+
+// ExpandSCTP sends the records read from r as a single SCTP association to
+// opts.Port through handle, from the client port recorded in the .pkt file
+// if there is one. Records go on the stream and with the payload protocol in
+// the sctp_stream and sctp_ppid metadata. It returns the number of records
+// sent.
+func ExpandSCTP(r io.Reader, handle PacketWriter, opts ExpandOptions) (int, error) {
+	//just slurp it up
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return 0, err
+	}
+	b, err := pkt.NewReader(data)
+	if err != nil {
+		return 0, err
+	}
+	g, err := NewSCTPPacketGenerator(handle)
+	if err != nil {
+		return 0, err
+	}
+	client, server, err := opts.addresses(b.Metadata)
+	if err != nil {
+		return 0, err
+	}
+	if client != nil {
+		g.SourceIP, g.DestIP = client, server
+	}
+	annotate(handle, "handshake")
+	if err := g.Connect(metadataPort(b.Metadata, "orig_port"), opts.Port); err != nil {
+		return 0, err
+	}
+	totalPackets := 0
+	for {
+		is_orig, payload, err := b.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return totalPackets, err
+		}
+		stream, ppid, err := sctpStream(b.Metadata)
+		if err != nil {
+			return totalPackets, fmt.Errorf("Record #%d: %v", totalPackets, err)
+		}
+		annotate(handle, "pkt record #%d, %s", totalPackets, direction(is_orig))
+		totalPackets++
+		log.Printf("is_orig %v sending %d bytes on stream %d\n", is_orig, len(payload), stream)
+		if err := g.Write(payload, is_orig, stream, ppid); err != nil {
+			return totalPackets, err
+		}
+		time.Sleep(recordDelay)
+	}
+	annotate(handle, "teardown")
+	if err := g.Close(); err != nil {
+		return totalPackets, err
+	}
+	return totalPackets, nil
+}
+
+// sctpStream returns the stream and payload protocol in the metadata,
+// stream 0 and protocol 0 if there are none.
+func sctpStream(m pkt.Metadata) (uint16, uint32, error) {
+	var stream, ppid uint64
+	var err error
+	if v := m["sctp_stream"]; v != "" {
+		if stream, err = strconv.ParseUint(v, 10, 16); err != nil {
+			return 0, 0, fmt.Errorf("Invalid sctp_stream %q", v)
+		}
+	}
+	if v := m["sctp_ppid"]; v != "" {
+		if ppid, err = strconv.ParseUint(v, 10, 32); err != nil {
+			return 0, 0, fmt.Errorf("Invalid sctp_ppid %q", v)
+		}
+	}
+	return uint16(stream), uint32(ppid), nil
+}
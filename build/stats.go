@@ -0,0 +1,69 @@
+package build
+
+import (
+	"time"
+
+	"github.com/google/gopacket"
+)
+
+// Stats counts the packets a build generated. Set FileOptions.Stats to
+// count what goes into a file, or wrap the PacketWriter with CountPackets.
+type Stats struct {
+	Packets int
+	Bytes   int
+	// First and Last are the timestamps of the first and last packet
+	First time.Time
+	Last  time.Time
+}
+
+// Add counts a packet.
+func (s *Stats) Add(ci gopacket.CaptureInfo) {
+	s.Packets++
+	s.Bytes += ci.CaptureLength
+	if s.First.IsZero() {
+		s.First = ci.Timestamp
+	}
+	s.Last = ci.Timestamp
+}
+
+// Duration is the time between the first and the last packet.
+func (s *Stats) Duration() time.Duration {
+	return s.Last.Sub(s.First)
+}
+
+// countingFileWriter counts the packets written to a FileWriter.
+type countingFileWriter struct {
+	FileWriter
+	stats *Stats
+}
+
+func (w countingFileWriter) WritePacket(ci gopacket.CaptureInfo, data []byte, comment string) error {
+	if err := w.FileWriter.WritePacket(ci, data, comment); err != nil {
+		return err
+	}
+	w.stats.Add(ci)
+	return nil
+}
+
+// CountPackets counts the packets sent through handle into stats, timed
+// when they were sent.
+func CountPackets(handle PacketWriter, stats *Stats) PacketWriter {
+	return &countingPacketWriter{handle, stats}
+}
+
+type countingPacketWriter struct {
+	PacketWriter
+	stats *Stats
+}
+
+func (w *countingPacketWriter) WritePacketData(data []byte) error {
+	if err := w.PacketWriter.WritePacketData(data); err != nil {
+		return err
+	}
+	w.stats.Add(gopacket.CaptureInfo{Timestamp: time.Now(), CaptureLength: len(data), Length: len(data)})
+	return nil
+}
+
+func (w *countingPacketWriter) Annotate(comment string) {
+	annotate(w.PacketWriter, "%s", comment)
+}
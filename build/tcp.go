@@ -0,0 +1,275 @@
+package build
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+var (
+	snapshotLen uint32 = 1500
+)
+
+type Endpoint struct {
+	eth layers.Ethernet
+	ip  networkLayer
+	tcp layers.TCP
+}
+
+type PacketWriter interface {
+	WritePacketData(data []byte) error
+	Close() error
+}
+
+type TCPPacketGenerator struct {
+	handle     PacketWriter
+	SourceMAC  net.HardwareAddr
+	DestMAC    net.HardwareAddr
+	SourceIP   net.IP
+	DestIP     net.IP
+	SourcePort layers.TCPPort
+	DestPort   layers.TCPPort
+
+	buf  gopacket.SerializeBuffer
+	opts gopacket.SerializeOptions
+
+	s_c Endpoint
+	c_s Endpoint
+}
+
+func NewTCPPacketGenerator(handle PacketWriter) (*TCPPacketGenerator, error) {
+	//TODO: move to params or whatever
+	smac := "00:00:00:00:00:01"
+	dmac := "00:00:00:00:00:02"
+	sip := "10.0.0.1"
+	dip := "10.0.0.2"
+
+	sourceMAC, err := net.ParseMAC(smac)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid mac: %v: %w", smac, err)
+	}
+
+	destMAC, err := net.ParseMAC(dmac)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid mac: %v: %w", dmac, err)
+	}
+	sourceIP := net.ParseIP(sip)
+	if sourceIP == nil {
+		return nil, fmt.Errorf("Invalid ip: %v", sip)
+	}
+	destIP := net.ParseIP(dip)
+	if destIP == nil {
+		return nil, fmt.Errorf("Invalid ip: %v", dip)
+	}
+	t := TCPPacketGenerator{
+		opts: gopacket.SerializeOptions{
+			FixLengths:       true,
+			ComputeChecksums: true,
+		},
+		buf:       gopacket.NewSerializeBuffer(),
+		handle:    handle,
+		SourceMAC: sourceMAC,
+		DestMAC:   destMAC,
+		SourceIP:  sourceIP,
+		DestIP:    destIP,
+	}
+	return &t, nil
+}
+
+// Connect sends the three way handshake between the source and destination
+// addresses of t, which may be changed before calling it, to IPv6 addresses
+// as well. A sourcePort of 0 picks a random port.
+func (t *TCPPacketGenerator) Connect(sourcePort, destPort int) error {
+	if sourcePort == 0 {
+		sourcePort = randomPort()
+	}
+
+	t.SourcePort = layers.TCPPort(sourcePort)
+	t.DestPort = layers.TCPPort(destPort)
+	log.Printf("Generating initial connection from %d to %d", sourcePort, destPort)
+	t.c_s = Endpoint{
+		tcp: layers.TCP{
+			SrcPort: t.SourcePort,
+			DstPort: t.DestPort,
+		},
+	}
+	t.s_c = Endpoint{
+		tcp: layers.TCP{
+			SrcPort: t.DestPort,
+			DstPort: t.SourcePort,
+		},
+	}
+	t.c_s.eth, t.c_s.ip = frameLayers(t.SourceMAC, t.DestMAC, t.SourceIP, t.DestIP, layers.IPProtocolTCP)
+	t.s_c.eth, t.s_c.ip = frameLayers(t.DestMAC, t.SourceMAC, t.DestIP, t.SourceIP, layers.IPProtocolTCP)
+	// SYN
+	t.c_s.tcp.Window = 55000
+	t.c_s.tcp.SYN = true
+	t.c_s.tcp.SetNetworkLayerForChecksum(t.c_s.ip)
+	if err := t.send(&t.c_s.eth, t.c_s.ip, &t.c_s.tcp); err != nil {
+		return fmt.Errorf("Error sending SYN: %w", err)
+	}
+
+	//synack
+	t.s_c.tcp.SYN = true
+	t.s_c.tcp.ACK = true
+	t.s_c.tcp.Seq++
+	t.s_c.tcp.Ack++
+	t.s_c.tcp.SetNetworkLayerForChecksum(t.s_c.ip)
+	t.s_c.tcp.Window = 55000
+
+	if err := t.send(&t.s_c.eth, t.s_c.ip, &t.s_c.tcp); err != nil {
+		return fmt.Errorf("Error sending SYN/ACK: %w", err)
+	}
+	t.s_c.tcp.Seq++
+	//ack
+	t.c_s.tcp.ACK = true
+	t.c_s.tcp.SYN = false
+	t.c_s.tcp.Seq++
+	t.c_s.tcp.Ack++
+	t.c_s.tcp.Ack++ //TODO:WTF is going on here.. it says it's 1, but sends 0
+	t.c_s.tcp.SetNetworkLayerForChecksum(t.c_s.ip)
+	//log.Printf("Sending final ack packet with ack=%d %+v", t.c_s.tcp.Ack, t.c_s.tcp)
+	if err := t.send(&t.c_s.eth, t.c_s.ip, &t.c_s.tcp); err != nil {
+		return fmt.Errorf("Error sending ACK: %w", err)
+	}
+
+	t.c_s.tcp.SYN = false
+	t.s_c.tcp.SYN = false
+	return nil
+}
+
+// Write sends data from the client if isOrig is set, or from the server
+// otherwise. With autoAck the other side acknowledges it right away.
+func (t *TCPPacketGenerator) Write(data []byte, isOrig bool, autoAck bool) error {
+	//Client or server endpoints, depending on isOrig
+	a, b := t.endpoints(isOrig)
+	a.tcp.ACK = true
+	a.tcp.PSH = true
+	payload := gopacket.Payload(data)
+	//log.Printf("Writing packet seq number %d %q to %+v", a.tcp.Seq, data, a.tcp)
+	if err := t.send(&a.eth, a.ip, &a.tcp, &payload); err != nil {
+		return fmt.Errorf("Error sending %d bytes: %w", len(data), err)
+	}
+	a.tcp.Seq += uint32(len(payload))
+	b.tcp.Ack += uint32(len(payload))
+
+	if autoAck {
+		b.tcp.ACK = true
+		if err := t.send(&b.eth, b.ip, &b.tcp); err != nil {
+			return fmt.Errorf("Error sending ACK: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// Close closes the connection from the client side.
+func (t *TCPPacketGenerator) Close() error {
+	return t.Shutdown(true)
+}
+
+// endpoints returns the endpoint of the sender and of the receiver.
+func (t *TCPPacketGenerator) endpoints(isOrig bool) (*Endpoint, *Endpoint) {
+	if isOrig {
+		return &t.c_s, &t.s_c
+	}
+	return &t.s_c, &t.c_s
+}
+
+// Shutdown closes the connection with a FIN from the client if isOrig is
+// set, or from the server otherwise, and the FIN and ACK of the other side.
+func (t *TCPPacketGenerator) Shutdown(isOrig bool) error {
+	a, b := t.endpoints(isOrig)
+	//send fin
+	a.tcp.FIN = true
+	if err := t.send(&a.eth, a.ip, &a.tcp); err != nil {
+		return err
+	}
+	a.tcp.Seq++
+
+	//ack the fin, then send our own
+	b.tcp.Ack++
+	b.tcp.ACK = true
+	b.tcp.PSH = false
+	if err := t.send(&b.eth, b.ip, &b.tcp); err != nil {
+		return err
+	}
+	b.tcp.FIN = true
+	b.tcp.ACK = true
+	if err := t.send(&b.eth, b.ip, &b.tcp); err != nil {
+		return err
+	}
+	//ack the other fin
+	a.tcp.FIN = false
+	a.tcp.PSH = false
+	a.tcp.ACK = true
+	a.tcp.Ack++
+	return t.send(&a.eth, a.ip, &a.tcp)
+}
+
+// Reset aborts the connection with a RST from the client if isOrig is set,
+// or from the server otherwise.
+func (t *TCPPacketGenerator) Reset(isOrig bool) error {
+	a, _ := t.endpoints(isOrig)
+	a.tcp.RST = true
+	a.tcp.ACK = true
+	a.tcp.PSH = false
+	err := t.send(&a.eth, a.ip, &a.tcp)
+	a.tcp.RST = false
+	return err
+}
+
+func (t *TCPPacketGenerator) send(l ...gopacket.SerializableLayer) error {
+	if err := gopacket.SerializeLayers(t.buf, t.opts, l...); err != nil {
+		return err
+	}
+	return t.handle.WritePacketData(t.buf.Bytes())
+}
+
+func randomPort() int {
+	s1 := rand.NewSource(time.Now().UnixNano())
+	r1 := rand.New(s1)
+	return 32000 + r1.Intn(32000)
+}
+
+func ethernetLayer(src, dst net.HardwareAddr) layers.Ethernet {
+	return layers.Ethernet{
+		SrcMAC:       src,
+		DstMAC:       dst,
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+}
+
+// networkLayer is the IPv4 or IPv6 header of a generated packet.
+type networkLayer interface {
+	gopacket.NetworkLayer
+	gopacket.SerializableLayer
+}
+
+// frameLayers returns the Ethernet and IP headers of a packet of proto from
+// src to dst, IPv6 headers if the addresses are IPv6 addresses.
+func frameLayers(srcMAC, dstMAC net.HardwareAddr, src, dst net.IP, proto layers.IPProtocol) (layers.Ethernet, networkLayer) {
+	eth := ethernetLayer(srcMAC, dstMAC)
+	if src.To4() == nil {
+		eth.EthernetType = layers.EthernetTypeIPv6
+		ip := ipv6Layer(src, dst, proto)
+		return eth, &ip
+	}
+	ip := ipv4Layer(src, dst, proto)
+	return eth, &ip
+}
+
+func ipv4Layer(src, dst net.IP, proto layers.IPProtocol) layers.IPv4 {
+	return layers.IPv4{
+		SrcIP:    src,
+		DstIP:    dst,
+		Version:  4,
+		TTL:      64,
+		Protocol: proto,
+	}
+}
@@ -0,0 +1,60 @@
+package build
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+var errDiskFull = errors.New("disk full")
+
+// failingWriter keeps the first n packets written to it and fails after.
+type failingWriter struct {
+	memoryWriter
+	n int
+}
+
+func (w *failingWriter) WritePacketData(data []byte) error {
+	if len(w.packets) == w.n {
+		return errDiskFull
+	}
+	return w.memoryWriter.WritePacketData(data)
+}
+
+// TestExpandTCPWriteError fails every packet of a conversation in turn,
+// which used to exit the whole process.
+func TestExpandTCPWriteError(t *testing.T) {
+	data := readGolden(t, "tcp.pkt")
+	total := len(handshake) + 2 + len(teardown)
+	for n := 0; n < total; n++ {
+		w := &failingWriter{n: n}
+		_, err := ExpandTCP(bytes.NewReader(data), w, 8080)
+		if !errors.Is(err, errDiskFull) {
+			t.Errorf("failing packet %d: got %v, expected %v", n, err, errDiskFull)
+		}
+		if len(w.packets) != n {
+			t.Errorf("failing packet %d: %d packets written before the error", n, len(w.packets))
+		}
+	}
+	w := &failingWriter{n: total}
+	if _, err := ExpandTCP(bytes.NewReader(data), w, 8080); err != nil {
+		t.Errorf("got %v with room for the whole conversation", err)
+	}
+}
+
+// failingCloser fails to close, like a file whose last write doesn't fit.
+type failingCloser struct {
+	bytes.Buffer
+}
+
+func (*failingCloser) Close() error { return errDiskFull }
+
+func TestPcapPacketWriterClose(t *testing.T) {
+	handle, err := NewPcapPacketWriter(&failingCloser{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := handle.Close(); err != errDiskFull {
+		t.Errorf("Close returned %v, expected %v", err, errDiskFull)
+	}
+}
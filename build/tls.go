@@ -0,0 +1,266 @@
+package build
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/JustinAzoff/pcap_simplify/pkt"
+)
+
+// TLSOptions makes ExpandTCPWithOptions run the records through a TLS
+// session between an in-process client and server, sending what they
+// encrypt instead of the records themselves.
+type TLSOptions struct {
+	// KeyLog receives the secrets of the session in the NSS key log
+	// format, for Wireshark to decrypt the capture with
+	KeyLog io.Writer
+	// ServerName is sent in the SNI extension and names the certificate
+	// of the server. If empty, the tls_sni metadata of the .pkt file is
+	// used, if there is any.
+	ServerName string
+	// Version is tls.VersionTLS12 or tls.VersionTLS13. If 0, the
+	// tls_version metadata says which, and TLS 1.3 is the default.
+	Version uint16
+}
+
+// version returns the TLS version to use for a .pkt file with metadata m.
+func (o *TLSOptions) version(m pkt.Metadata) (uint16, error) {
+	if o.Version != 0 {
+		return o.Version, nil
+	}
+	switch m["tls_version"] {
+	case "", "1.3":
+		return tls.VersionTLS13, nil
+	case "1.2":
+		return tls.VersionTLS12, nil
+	}
+	return 0, fmt.Errorf("Unsupported tls_version %q", m["tls_version"])
+}
+
+// tlsCertificate returns a self-signed certificate for name.
+func tlsCertificate(name string) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+	}
+	if name != "" {
+		template.DNSNames = []string{name}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// tlsWrite is what a side of a tlsPipe wrote.
+type tlsWrite struct {
+	isOrig bool
+	data   []byte
+}
+
+// tlsPipe connects a TLS client and server in memory. Unlike net.Pipe,
+// writes never wait for the other side to read, so a single goroutine can
+// drive both sides once the handshake is done. Everything written is kept
+// in order until the generator sends it.
+type tlsPipe struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	client bytes.Buffer
+	server bytes.Buffer
+	closed bool
+	wire   []tlsWrite
+}
+
+func newTLSPipe() *tlsPipe {
+	p := &tlsPipe{}
+	p.cond = sync.NewCond(&p.mu)
+	return p
+}
+
+// input is what the client reads if isOrig is set, or the server otherwise.
+func (p *tlsPipe) input(isOrig bool) *bytes.Buffer {
+	if isOrig {
+		return &p.client
+	}
+	return &p.server
+}
+
+// close makes reads return io.EOF once nothing is left.
+func (p *tlsPipe) close() {
+	p.mu.Lock()
+	p.closed = true
+	p.cond.Broadcast()
+	p.mu.Unlock()
+}
+
+// drain returns what was written since the last call.
+func (p *tlsPipe) drain() []tlsWrite {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	wire := p.wire
+	p.wire = nil
+	return wire
+}
+
+// tlsPipeEnd is the client side of a tlsPipe if isOrig is set, or the
+// server side otherwise.
+type tlsPipeEnd struct {
+	p      *tlsPipe
+	isOrig bool
+}
+
+func (e tlsPipeEnd) Read(b []byte) (int, error) {
+	e.p.mu.Lock()
+	defer e.p.mu.Unlock()
+	in := e.p.input(e.isOrig)
+	for in.Len() == 0 && !e.p.closed {
+		e.p.cond.Wait()
+	}
+	if in.Len() == 0 {
+		return 0, io.EOF
+	}
+	return in.Read(b)
+}
+
+func (e tlsPipeEnd) Write(b []byte) (int, error) {
+	e.p.mu.Lock()
+	defer e.p.mu.Unlock()
+	if e.p.closed {
+		return 0, io.ErrClosedPipe
+	}
+	e.p.input(!e.isOrig).Write(b)
+	e.p.wire = append(e.p.wire, tlsWrite{e.isOrig, append([]byte{}, b...)})
+	e.p.cond.Broadcast()
+	return len(b), nil
+}
+
+func (e tlsPipeEnd) Close() error                       { return nil }
+func (e tlsPipeEnd) LocalAddr() net.Addr                { return tlsPipeAddr{} }
+func (e tlsPipeEnd) RemoteAddr() net.Addr               { return tlsPipeAddr{} }
+func (e tlsPipeEnd) SetDeadline(t time.Time) error      { return nil }
+func (e tlsPipeEnd) SetReadDeadline(t time.Time) error  { return nil }
+func (e tlsPipeEnd) SetWriteDeadline(t time.Time) error { return nil }
+
+type tlsPipeAddr struct{}
+
+func (tlsPipeAddr) Network() string { return "pipe" }
+func (tlsPipeAddr) String() string  { return "pipe" }
+
+// tlsSession is a TLS client and server, the conversation between them
+// going through a TCPPacketGenerator.
+type tlsSession struct {
+	pipe   *tlsPipe
+	client *tls.Conn
+	server *tls.Conn
+	t      *TCPPacketGenerator
+}
+
+// startTLS runs the handshake of a session for the .pkt file with
+// metadata m, and sends it through t.
+func startTLS(o *TLSOptions, m pkt.Metadata, t *TCPPacketGenerator) (*tlsSession, error) {
+	version, err := o.version(m)
+	if err != nil {
+		return nil, err
+	}
+	name := o.ServerName
+	if name == "" {
+		name = m["tls_sni"]
+	}
+	cert, err := tlsCertificate(name)
+	if err != nil {
+		return nil, err
+	}
+	var protos []string
+	if alpn := m["tls_alpn"]; alpn != "" {
+		protos = []string{alpn}
+	}
+	s := &tlsSession{pipe: newTLSPipe(), t: t}
+	s.client = tls.Client(tlsPipeEnd{s.pipe, true}, &tls.Config{
+		ServerName:         name,
+		InsecureSkipVerify: true,
+		NextProtos:         protos,
+		MinVersion:         version,
+		MaxVersion:         version,
+		KeyLogWriter:       o.KeyLog,
+	})
+	s.server = tls.Server(tlsPipeEnd{s.pipe, false}, &tls.Config{
+		Certificates:           []tls.Certificate{cert},
+		NextProtos:             protos,
+		SessionTicketsDisabled: true,
+	})
+	done := make(chan error, 1)
+	go func() {
+		done <- s.server.Handshake()
+	}()
+	err = s.client.Handshake()
+	if err != nil {
+		// Don't leave the server waiting for a client that gave up
+		s.pipe.close()
+	}
+	if serr := <-done; err == nil {
+		err = serr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("TLS handshake failed: %w", err)
+	}
+	state := s.client.ConnectionState()
+	log.Printf("TLS handshake done with %s", tls.CipherSuiteName(state.CipherSuite))
+	return s, s.flush()
+}
+
+// flush sends what the client and server wrote since the last call.
+func (s *tlsSession) flush() error {
+	for _, w := range s.pipe.drain() {
+		if err := writeSegments(s.t, w.data, w.isOrig); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Write encrypts data on the client side if isOrig is set, or the server
+// side otherwise, has the other side read it, and sends the records.
+func (s *tlsSession) Write(data []byte, isOrig bool) error {
+	if len(data) == 0 {
+		return nil
+	}
+	from, to := s.client, s.server
+	if !isOrig {
+		from, to = s.server, s.client
+	}
+	if _, err := from.Write(data); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(to, make([]byte, len(data))); err != nil {
+		return fmt.Errorf("TLS peer could not read %d bytes: %w", len(data), err)
+	}
+	return s.flush()
+}
+
+// Close sends the close_notify alert of the client.
+func (s *tlsSession) Close() error {
+	if err := s.client.Close(); err != nil {
+		return err
+	}
+	s.pipe.close()
+	return s.flush()
+}
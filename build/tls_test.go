@@ -0,0 +1,74 @@
+package build
+
+import (
+	"bytes"
+	"crypto/tls"
+	"reflect"
+	"testing"
+
+	"github.com/JustinAzoff/pcap_simplify/extract"
+	"github.com/JustinAzoff/pcap_simplify/pkt"
+)
+
+// TestExpandTLS wraps conversations in TLS and decrypts them again with the
+// key log written along.
+func TestExpandTLS(t *testing.T) {
+	large := string(bytes.Repeat([]byte("0123456789"), 3000))
+	for _, tt := range []struct {
+		name    string
+		opts    TLSOptions
+		meta    pkt.Metadata
+		version string
+	}{
+		{"tls 1.3", TLSOptions{ServerName: "example.com"}, pkt.Metadata{"protocol": "tcp"}, "1.3"},
+		{"tls 1.2", TLSOptions{ServerName: "example.com", Version: tls.VersionTLS12}, pkt.Metadata{"protocol": "tcp"}, "1.2"},
+		{"from metadata", TLSOptions{}, pkt.Metadata{"protocol": "tcp", "tls_version": "1.2", "tls_sni": "example.com", "tls_alpn": "http/1.1"}, "1.2"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			in := []protocolRecord{
+				{true, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n", tt.meta},
+				{false, "", nil},
+				{false, large, nil},
+			}
+			var rebuilt, keylog bytes.Buffer
+			handle, err := NewPcapPacketWriter(nopCloser{&rebuilt})
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.opts.KeyLog = &keylog
+			opts := ExpandOptions{Port: 443, TLS: &tt.opts}
+			if _, err := ExpandTCPWithOptions(bytes.NewReader(writeProtocolRecords(t, in)), handle, opts); err != nil {
+				t.Fatal(err)
+			}
+
+			keys, err := extract.ReadKeyLog(&keylog)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r, err := extract.NewReader(&rebuilt)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var extracted bytes.Buffer
+			if _, _, err := extract.Simplify(r, &extracted, extract.Options{KeyLog: keys}); err != nil {
+				t.Fatal(err)
+			}
+			// TLS records hold at most 16kB
+			got := readProtocolRecords(t, extracted.Bytes(), "tls_version", "tls_sni")
+			var client, server string
+			for _, rec := range got {
+				if rec.meta["tls_version"] != tt.version || rec.meta["tls_sni"] != "example.com" {
+					t.Errorf("record metadata %v, expected TLS %s to example.com", rec.meta, tt.version)
+				}
+				if rec.isOrig {
+					client += rec.payload
+				} else {
+					server += rec.payload
+				}
+			}
+			if !reflect.DeepEqual([]string{client, server}, []string{in[0].payload, large}) {
+				t.Errorf("decrypted %d client and %d server bytes, expected %d and %d", len(client), len(server), len(in[0].payload), len(large))
+			}
+		})
+	}
+}
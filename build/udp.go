@@ -0,0 +1,200 @@
+package build
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+
+	"github.com/JustinAzoff/pcap_simplify/pkt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// replayUDP sends the records of b between a client and a server socket on
+// the loopback interface, the server listening on port, waiting delay after
+// each one. It returns the number of records sent.
+func replayUDP(b *pkt.Reader, port int, delay time.Duration) (int, error) {
+	server, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port})
+	if err != nil {
+		return 0, err
+	}
+	defer server.Close()
+	log.Printf("Listening on port %d", port)
+	client, err := net.DialUDP("udp4", nil, server.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		return 0, err
+	}
+	defer client.Close()
+	log.Printf("Connected!")
+	// The server socket isn't connected, so every reply has to say where
+	// the client is
+	clientAddr := client.LocalAddr().(*net.UDPAddr)
+	go io.Copy(ioutil.Discard, server)
+	go io.Copy(ioutil.Discard, client)
+
+	totalPackets := 0
+	for {
+		is_orig, payload, err := b.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return totalPackets, err
+		}
+		if is_orig {
+			log.Printf("Client writing %d bytes", len(payload))
+			_, err = client.Write(payload)
+		} else {
+			log.Printf("Server writing %d bytes", len(payload))
+			_, err = server.WriteToUDP(payload, clientAddr)
+		}
+		if err != nil {
+			return totalPackets, err
+		}
+		totalPackets++
+		time.Sleep(delay)
+	}
+	return totalPackets, nil
+}
+
+// ExpandUDP replays the records read from r over a real UDP socket pair on
+// the loopback interface to port, capturing them with tcpdump into
+// outputFilename. It returns the number of records sent.
+func ExpandUDP(r io.Reader, outputFilename string, port int) (int, error) {
+	//just slurp it up
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return 0, err
+	}
+	b, err := pkt.NewReader(data)
+	if err != nil {
+		return 0, err
+	}
+	cmd := exec.Command("tcpdump", "-i", "lo", "-w", outputFilename, fmt.Sprintf("port %d", port))
+	if outputFilename == "-" {
+		// tcpdump -w - writes the pcap to its own stdout
+		cmd.Stdout = os.Stdout
+	}
+	err = cmd.Start()
+	if err != nil {
+		return 0, err
+	}
+	// Give tcpdump time to start capturing
+	time.Sleep(1 * time.Second)
+
+	totalPackets, err := replayUDP(b, port, 100*time.Millisecond)
+
+	time.Sleep(1 * time.Second)
+	cmd.Process.Signal(syscall.SIGINT)
+	cmd.Wait()
+
+	return totalPackets, err
+}
+
+// UDPPacketGenerator builds the packets of a UDP conversation the same way
+// TCPPacketGenerator does, without needing real sockets or tcpdump.
+type UDPPacketGenerator struct {
+	handle     PacketWriter
+	SourceMAC  net.HardwareAddr
+	DestMAC    net.HardwareAddr
+	SourceIP   net.IP
+	DestIP     net.IP
+	SourcePort layers.UDPPort
+	DestPort   layers.UDPPort
+
+	buf  gopacket.SerializeBuffer
+	opts gopacket.SerializeOptions
+}
+
+// NewUDPPacketGenerator returns a generator using the same addresses as
+// NewTCPPacketGenerator. They may be changed before the first Write. A
+// sourcePort of 0 picks a random port.
+func NewUDPPacketGenerator(handle PacketWriter, sourcePort, destPort int) (*UDPPacketGenerator, error) {
+	if sourcePort == 0 {
+		sourcePort = randomPort()
+	}
+	t, err := NewTCPPacketGenerator(handle)
+	if err != nil {
+		return nil, err
+	}
+	return &UDPPacketGenerator{
+		handle:     handle,
+		SourceMAC:  t.SourceMAC,
+		DestMAC:    t.DestMAC,
+		SourceIP:   t.SourceIP,
+		DestIP:     t.DestIP,
+		SourcePort: layers.UDPPort(sourcePort),
+		DestPort:   layers.UDPPort(destPort),
+		buf:        t.buf,
+		opts:       t.opts,
+	}, nil
+}
+
+// Write sends data as a single datagram from the client if isOrig is set,
+// or from the server otherwise.
+func (u *UDPPacketGenerator) Write(data []byte, isOrig bool) error {
+	eth, ip := frameLayers(u.SourceMAC, u.DestMAC, u.SourceIP, u.DestIP, layers.IPProtocolUDP)
+	udp := layers.UDP{SrcPort: u.SourcePort, DstPort: u.DestPort}
+	if !isOrig {
+		eth, ip = frameLayers(u.DestMAC, u.SourceMAC, u.DestIP, u.SourceIP, layers.IPProtocolUDP)
+		udp = layers.UDP{SrcPort: u.DestPort, DstPort: u.SourcePort}
+	}
+	udp.SetNetworkLayerForChecksum(ip)
+	payload := gopacket.Payload(data)
+	if err := gopacket.SerializeLayers(u.buf, u.opts, &eth, ip, &udp, &payload); err != nil {
+		return err
+	}
+	return u.handle.WritePacketData(u.buf.Bytes())
+}
+
+// ExpandUDPPackets is like ExpandUDP, but builds the datagrams with a
+// UDPPacketGenerator and sends them through handle instead. It needs
+// neither tcpdump nor the loopback interface, so it can use the original
+// addresses. The client port is the one recorded in the .pkt file if there
+// is one.
+func ExpandUDPPackets(r io.Reader, handle PacketWriter, opts ExpandOptions) (int, error) {
+	//just slurp it up
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return 0, err
+	}
+	b, err := pkt.NewReader(data)
+	if err != nil {
+		return 0, err
+	}
+	u, err := NewUDPPacketGenerator(handle, metadataPort(b.Metadata, "orig_port"), opts.Port)
+	if err != nil {
+		return 0, err
+	}
+	client, server, err := opts.addresses(b.Metadata)
+	if err != nil {
+		return 0, err
+	}
+	if client != nil {
+		u.SourceIP, u.DestIP = client, server
+	}
+	totalPackets := 0
+	for {
+		is_orig, payload, err := b.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return totalPackets, err
+		}
+		annotate(handle, "pkt record #%d, %s", totalPackets, direction(is_orig))
+		totalPackets++
+		log.Printf("is_orig %v sending %d bytes\n", is_orig, len(payload))
+		if err := u.Write(payload, is_orig); err != nil {
+			return totalPackets, err
+		}
+		time.Sleep(recordDelay)
+	}
+	return totalPackets, nil
+}
@@ -0,0 +1,275 @@
+// Package checksum verifies and recomputes the IPv4, TCP, UDP, ICMP and
+// ICMPv6 checksums of a raw packet that starts at the IP header.
+//
+// Captures taken on a host with checksum offload enabled contain packets
+// whose checksums were never filled in. Copying those headers verbatim into
+// a fixture means a sensor that validates checksums will silently drop them.
+package checksum
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// Mode selects what a command does with the checksums of the packets it copies.
+type Mode int
+
+const (
+	// None copies packets verbatim.
+	None Mode = iota
+	// Check reports bad checksums but leaves them alone.
+	Check
+	// Fix reports bad checksums and rewrites them with the correct value.
+	Fix
+)
+
+// ParseMode parses the value of a -checksum command line flag.
+func ParseMode(s string) (Mode, error) {
+	switch s {
+	case "", "none":
+		return None, nil
+	case "check":
+		return Check, nil
+	case "fix":
+		return Fix, nil
+	}
+	return None, fmt.Errorf("Invalid checksum mode %q, expected none, check or fix", s)
+}
+
+// Apply verifies or repairs the checksums in data according to m and
+// returns the bad checksums that were found.
+func (m Mode) Apply(data []byte) []Error {
+	switch m {
+	case Check:
+		return Verify(data)
+	case Fix:
+		return Repair(data)
+	}
+	return nil
+}
+
+// Error describes a single checksum that did not match the packet contents.
+type Error struct {
+	Layer gopacket.LayerType
+	Got   uint16
+	Want  uint16
+}
+
+func (e Error) Error() string {
+	return fmt.Sprintf("bad %v checksum 0x%04x, expected 0x%04x", e.Layer, e.Got, e.Want)
+}
+
+// field is the location of one checksum inside a packet along with the
+// value it should have.
+type field struct {
+	layer  gopacket.LayerType
+	offset int
+	want   uint16
+}
+
+// Verify returns an Error for every checksum in data that is wrong.
+// Checksums that can not be verified, such as the transport checksum of a
+// fragment or of a packet truncated by the capture snaplen, are skipped.
+func Verify(data []byte) []Error {
+	var errs []Error
+	for _, f := range fields(data) {
+		got := binary.BigEndian.Uint16(data[f.offset:])
+		if got != f.want {
+			errs = append(errs, Error{Layer: f.layer, Got: got, Want: f.want})
+		}
+	}
+	return errs
+}
+
+// Repair rewrites every wrong checksum in data in place and returns the
+// errors that were corrected.
+func Repair(data []byte) []Error {
+	errs := Verify(data)
+	if len(errs) == 0 {
+		return nil
+	}
+	// The IP header checksum does not cover the transport layer, and the
+	// transport pseudo header does not cover the IP checksum, so the
+	// fields can be written in any order.
+	for _, f := range fields(data) {
+		binary.BigEndian.PutUint16(data[f.offset:], f.want)
+	}
+	return errs
+}
+
+// fields finds every checksum in data that can be verified and computes
+// its expected value.
+func fields(data []byte) []field {
+	if len(data) == 0 {
+		return nil
+	}
+	switch data[0] >> 4 {
+	case 4:
+		return ipv4Fields(data)
+	case 6:
+		return ipv6Fields(data)
+	}
+	return nil
+}
+
+func ipv4Fields(data []byte) []field {
+	if len(data) < 20 {
+		return nil
+	}
+	ihl := int(data[0]&0x0f) * 4
+	if ihl < 20 || len(data) < ihl {
+		return nil
+	}
+	result := []field{{
+		layer:  layers.LayerTypeIPv4,
+		offset: 10,
+		want:   sum(data[:ihl], 10, 0),
+	}}
+
+	totalLength := int(binary.BigEndian.Uint16(data[2:4]))
+	if totalLength < ihl || len(data) < totalLength {
+		// Truncated by the snaplen, the transport checksum covers bytes we don't have
+		return result
+	}
+	flagsAndOffset := binary.BigEndian.Uint16(data[6:8])
+	if flagsAndOffset&0x3fff != 0 {
+		// More fragments set or non zero offset, the transport checksum
+		// covers the reassembled datagram
+		return result
+	}
+
+	proto := layers.IPProtocol(data[9])
+	l4 := data[ihl:totalLength]
+	var pseudo uint32
+	if proto != layers.IPProtocolICMPv4 {
+		pseudo = pseudoHeader(data[12:16], data[16:20], proto, len(l4))
+	}
+	if f, ok := transportField(proto, l4, pseudo, true); ok {
+		f.offset += ihl
+		result = append(result, f)
+	}
+	return result
+}
+
+func ipv6Fields(data []byte) []field {
+	if len(data) < 40 {
+		return nil
+	}
+	payloadLength := int(binary.BigEndian.Uint16(data[4:6]))
+	if len(data) < 40+payloadLength {
+		return nil
+	}
+	proto := layers.IPProtocol(data[6])
+	offset := 40
+	end := 40 + payloadLength
+walk:
+	for {
+		switch proto {
+		case layers.IPProtocolIPv6HopByHop, layers.IPProtocolIPv6Routing, layers.IPProtocolIPv6Destination:
+			if end-offset < 8 {
+				return nil
+			}
+			next := layers.IPProtocol(data[offset])
+			offset += (int(data[offset+1]) + 1) * 8
+			proto = next
+			continue
+		case layers.IPProtocolAH:
+			if end-offset < 8 {
+				return nil
+			}
+			next := layers.IPProtocol(data[offset])
+			offset += (int(data[offset+1]) + 2) * 4
+			proto = next
+			continue
+		case layers.IPProtocolIPv6Fragment:
+			// The transport checksum covers the reassembled datagram
+			return nil
+		}
+		break walk
+	}
+	if offset > end {
+		return nil
+	}
+	l4 := data[offset:end]
+	pseudo := pseudoHeader(data[8:24], data[24:40], proto, len(l4))
+	if f, ok := transportField(proto, l4, pseudo, false); ok {
+		f.offset += offset
+		return []field{f}
+	}
+	return nil
+}
+
+// transportField computes the checksum of the transport layer in l4.
+// The returned offset is relative to the start of l4.
+func transportField(proto layers.IPProtocol, l4 []byte, pseudo uint32, ipv4 bool) (field, bool) {
+	var f field
+	switch proto {
+	case layers.IPProtocolTCP:
+		f = field{layer: layers.LayerTypeTCP, offset: 16}
+		if len(l4) < 20 {
+			return f, false
+		}
+	case layers.IPProtocolUDP:
+		f = field{layer: layers.LayerTypeUDP, offset: 6}
+		if len(l4) < 8 {
+			return f, false
+		}
+		if ipv4 && binary.BigEndian.Uint16(l4[6:8]) == 0 {
+			// A zero UDP checksum over IPv4 means the sender did not compute one
+			return f, false
+		}
+	case layers.IPProtocolICMPv4:
+		f = field{layer: layers.LayerTypeICMPv4, offset: 2}
+		if len(l4) < 4 {
+			return f, false
+		}
+	case layers.IPProtocolICMPv6:
+		f = field{layer: layers.LayerTypeICMPv6, offset: 2}
+		if len(l4) < 4 {
+			return f, false
+		}
+	default:
+		return f, false
+	}
+	f.want = sum(l4, f.offset, pseudo)
+	if f.want == 0 && proto == layers.IPProtocolUDP {
+		// RFC 768: a computed checksum of zero is transmitted as all ones
+		f.want = 0xffff
+	}
+	return f, true
+}
+
+// pseudoHeader returns the partial sum of the TCP/UDP pseudo header.
+func pseudoHeader(src, dst []byte, proto layers.IPProtocol, length int) uint32 {
+	var csum uint32
+	for i := 0; i+1 < len(src); i += 2 {
+		csum += uint32(src[i])<<8 | uint32(src[i+1])
+		csum += uint32(dst[i])<<8 | uint32(dst[i+1])
+	}
+	csum += uint32(proto)
+	csum += uint32(length) >> 16
+	csum += uint32(length) & 0xffff
+	return csum
+}
+
+// sum computes the RFC 1071 checksum of data treating the two bytes at
+// skip as zero. csum is any partial sum that has already been computed.
+func sum(data []byte, skip int, csum uint32) uint16 {
+	for i := 0; i < len(data); i += 2 {
+		if i == skip {
+			continue
+		}
+		if i+1 < len(data) {
+			csum += uint32(data[i])<<8 | uint32(data[i+1])
+		} else {
+			csum += uint32(data[i]) << 8
+		}
+	}
+	for csum > 0xffff {
+		csum = (csum >> 16) + (csum & 0xffff)
+	}
+	return ^uint16(csum)
+}
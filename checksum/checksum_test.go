@@ -0,0 +1,178 @@
+package checksum
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func serialize(t *testing.T, ls ...gopacket.SerializableLayer) []byte {
+	t.Helper()
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, ls...); err != nil {
+		t.Fatal(err)
+	}
+	return append([]byte{}, buf.Bytes()...)
+}
+
+func ipv4(proto layers.IPProtocol) *layers.IPv4 {
+	return &layers.IPv4{Version: 4, IHL: 5, TTL: 64, Protocol: proto, SrcIP: net.IPv4(10, 0, 0, 1), DstIP: net.IPv4(10, 0, 0, 2)}
+}
+
+func ipv6(proto layers.IPProtocol) *layers.IPv6 {
+	return &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: proto, SrcIP: net.ParseIP("2001:db8::1"), DstIP: net.ParseIP("2001:db8::2")}
+}
+
+func tcp(nl gopacket.NetworkLayer) *layers.TCP {
+	l := &layers.TCP{SrcPort: 40000, DstPort: 80, Seq: 1, ACK: true, PSH: true, Window: 65535}
+	l.SetNetworkLayerForChecksum(nl)
+	return l
+}
+
+func udp(nl gopacket.NetworkLayer) *layers.UDP {
+	l := &layers.UDP{SrcPort: 40000, DstPort: 53}
+	l.SetNetworkLayerForChecksum(nl)
+	return l
+}
+
+// payload has an odd length, for the last byte to be padded in the sum.
+var payload = gopacket.Payload("hello")
+
+func packets(t *testing.T) map[string][]byte {
+	ip4tcp, ip4udp, ip4icmp := ipv4(layers.IPProtocolTCP), ipv4(layers.IPProtocolUDP), ipv4(layers.IPProtocolICMPv4)
+	ip6tcp, ip6udp, ip6icmp := ipv6(layers.IPProtocolTCP), ipv6(layers.IPProtocolUDP), ipv6(layers.IPProtocolICMPv6)
+	icmp6 := &layers.ICMPv6{TypeCode: layers.CreateICMPv6TypeCode(layers.ICMPv6TypeEchoRequest, 0)}
+	icmp6.SetNetworkLayerForChecksum(ip6icmp)
+	return map[string][]byte{
+		"ipv4 tcp":    serialize(t, ip4tcp, tcp(ip4tcp), payload),
+		"ipv4 udp":    serialize(t, ip4udp, udp(ip4udp), payload),
+		"ipv4 icmp":   serialize(t, ip4icmp, &layers.ICMPv4{TypeCode: layers.CreateICMPv4TypeCode(layers.ICMPv4TypeEchoRequest, 0), Id: 1, Seq: 1}, payload),
+		"ipv6 tcp":    serialize(t, ip6tcp, tcp(ip6tcp), payload),
+		"ipv6 udp":    serialize(t, ip6udp, udp(ip6udp), payload),
+		"ipv6 icmpv6": serialize(t, ip6icmp, icmp6, &layers.ICMPv6Echo{Identifier: 1, SeqNumber: 1}, payload),
+	}
+}
+
+func TestVerifyAndRepair(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		// offsets of the checksums that are corrupted, and their layers
+		offsets []int
+		layers  []gopacket.LayerType
+	}{
+		{"ipv4 tcp", []int{10, 20 + 16}, []gopacket.LayerType{layers.LayerTypeIPv4, layers.LayerTypeTCP}},
+		{"ipv4 udp", []int{20 + 6}, []gopacket.LayerType{layers.LayerTypeUDP}},
+		{"ipv4 icmp", []int{20 + 2}, []gopacket.LayerType{layers.LayerTypeICMPv4}},
+		{"ipv6 tcp", []int{40 + 16}, []gopacket.LayerType{layers.LayerTypeTCP}},
+		{"ipv6 udp", []int{40 + 6}, []gopacket.LayerType{layers.LayerTypeUDP}},
+		{"ipv6 icmpv6", []int{40 + 2}, []gopacket.LayerType{layers.LayerTypeICMPv6}},
+	} {
+		good := packets(t)[tt.name]
+		if errs := Verify(good); len(errs) != 0 {
+			t.Errorf("%s: errors %v for good checksums", tt.name, errs)
+		}
+		bad := append([]byte{}, good...)
+		for _, off := range tt.offsets {
+			binary.BigEndian.PutUint16(bad[off:], binary.BigEndian.Uint16(bad[off:])^0x5555)
+		}
+		errs := Verify(bad)
+		if len(errs) != len(tt.layers) {
+			t.Errorf("%s: errors %v, expected %d", tt.name, errs, len(tt.layers))
+			continue
+		}
+		for i, err := range errs {
+			want := binary.BigEndian.Uint16(good[tt.offsets[i]:])
+			if err.Layer != tt.layers[i] || err.Want != want || err.Got != want^0x5555 {
+				t.Errorf("%s: error %v, expected a %v checksum of 0x%04x", tt.name, err, tt.layers[i], want)
+			}
+		}
+		if errs := Repair(bad); len(errs) != len(tt.layers) {
+			t.Errorf("%s: repaired %v, expected %d", tt.name, errs, len(tt.layers))
+		}
+		if !bytes.Equal(bad, good) {
+			t.Errorf("%s: repaired packet differs from the original", tt.name)
+		}
+	}
+}
+
+func TestVerifySkipped(t *testing.T) {
+	// A zero UDP checksum over IPv4 means there is none
+	zeroUDP := packets(t)["ipv4 udp"]
+	binary.BigEndian.PutUint16(zeroUDP[20+6:], 0)
+
+	// The transport checksum of a fragment covers the whole datagram
+	frag := ipv4(layers.IPProtocolUDP)
+	frag.Flags = layers.IPv4MoreFragments
+	fragment := serialize(t, frag, udp(frag), payload)
+	fragment[20+6] ^= 0xff
+
+	frag6 := ipv6(layers.IPProtocolIPv6Fragment)
+	fragment6 := serialize(t, frag6, gopacket.Payload([]byte{byte(layers.IPProtocolUDP), 0, 0, 1, 0, 0, 0, 1}), payload)
+
+	// Cut by the snaplen, only the IPv4 header can be checked
+	truncated := packets(t)["ipv4 tcp"]
+	truncated[20+16] ^= 0xff
+	truncated = truncated[:30]
+
+	for _, tt := range []struct {
+		name   string
+		data   []byte
+		fields int
+	}{
+		{"ipv4 zero udp", zeroUDP, 1},
+		{"ipv4 fragment", fragment, 1},
+		{"ipv6 fragment", fragment6, 0},
+		{"ipv4 truncated", truncated, 1},
+		{"ipv6 truncated", packets(t)["ipv6 tcp"][:50], 0},
+		{"ipv4 header cut", packets(t)["ipv4 tcp"][:12], 0},
+		{"empty", nil, 0},
+		{"not ip", []byte{0x50, 1, 2, 3}, 0},
+	} {
+		if errs := Verify(tt.data); len(errs) != 0 {
+			t.Errorf("%s: errors %v", tt.name, errs)
+		}
+		if n := len(fields(tt.data)); n != tt.fields {
+			t.Errorf("%s: %d checksums checked, expected %d", tt.name, n, tt.fields)
+		}
+		before := append([]byte{}, tt.data...)
+		if errs := Repair(tt.data); len(errs) != 0 || !bytes.Equal(before, tt.data) {
+			t.Errorf("%s: repaired %v", tt.name, errs)
+		}
+	}
+}
+
+func TestUDPZeroSum(t *testing.T) {
+	// A sum that comes out as zero is sent as all ones
+	if got := sum([]byte{0xff, 0xff, 0, 0}, 2, 0); got != 0 {
+		t.Fatalf("sum is 0x%04x, expected 0", got)
+	}
+	f, ok := transportField(layers.IPProtocolUDP, []byte{0xff, 0xff, 0, 0, 0, 0, 0, 0}, 0, false)
+	if !ok || f.want != 0xffff {
+		t.Errorf("got 0x%04x, expected 0xffff", f.want)
+	}
+}
+
+func TestParseMode(t *testing.T) {
+	for _, tt := range []struct {
+		s    string
+		mode Mode
+		bad  bool
+	}{
+		{"", None, false},
+		{"none", None, false},
+		{"check", Check, false},
+		{"fix", Fix, false},
+		{"Fix", None, true},
+		{"repair", None, true},
+	} {
+		mode, err := ParseMode(tt.s)
+		if (err != nil) != tt.bad || mode != tt.mode {
+			t.Errorf("%q: got %v and %v, expected %v", tt.s, mode, err, tt.mode)
+		}
+	}
+}
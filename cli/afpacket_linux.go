@@ -0,0 +1,39 @@
+package cli
+
+import (
+	"github.com/JustinAzoff/pcap_simplify/extract"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"golang.org/x/net/bpf"
+)
+
+// ethernetHandle is a pcapgo.EthernetHandle, which always captures
+// Ethernet frames.
+type ethernetHandle struct {
+	*pcapgo.EthernetHandle
+}
+
+func (ethernetHandle) LinkType() layers.LinkType {
+	return layers.LinkTypeEthernet
+}
+
+// openAFPacket opens the network interface name for capturing with an
+// AF_PACKET socket, keeping only the packets matching filter if it is not
+// empty.
+func openAFPacket(name string, filter []bpf.RawInstruction) (extract.LiveSource, func(), error) {
+	handle, err := pcapgo.NewEthernetHandle(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := handle.SetPromiscuous(true); err != nil {
+		handle.Close()
+		return nil, nil, err
+	}
+	if len(filter) > 0 {
+		if err := handle.SetBPF(filter); err != nil {
+			handle.Close()
+			return nil, nil, err
+		}
+	}
+	return ethernetHandle{handle}, handle.Close, nil
+}
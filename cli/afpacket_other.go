@@ -0,0 +1,14 @@
+//go:build !linux
+
+package cli
+
+import (
+	"errors"
+
+	"github.com/JustinAzoff/pcap_simplify/extract"
+	"golang.org/x/net/bpf"
+)
+
+func openAFPacket(name string, filter []bpf.RawInstruction) (extract.LiveSource, func(), error) {
+	return nil, nil, errors.New("AF_PACKET sockets only exist on Linux")
+}
@@ -0,0 +1,192 @@
+package cli
+
+import (
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+)
+
+func addJobsFlag(fs *flag.FlagSet) *int {
+	return fs.Int("jobs", runtime.NumCPU(), "How many files to process at once when the input is a directory or a glob.")
+}
+
+// isBatch reports whether input names a set of files, a directory or a
+// glob, instead of a single file.
+func isBatch(input string) bool {
+	if input == Stdio {
+		return false
+	}
+	if strings.ContainsAny(input, "*?[") {
+		return true
+	}
+	fi, err := os.Stat(input)
+	return err == nil && fi.IsDir()
+}
+
+// batchFile is one file of a batch, with its name relative to the
+// directory the batch was given, or to the part of a glob before its
+// first wildcard, and where its output goes.
+type batchFile struct {
+	input  string
+	rel    string
+	output string
+}
+
+// batchInputs lists the files of input. Directories are walked
+// recursively, keeping the files with one of the extensions in exts and
+// skipping hidden ones. Globs take every file they match.
+func batchInputs(input string, exts []string) ([]batchFile, error) {
+	var files []batchFile
+	fi, err := os.Stat(input)
+	if err == nil && fi.IsDir() {
+		err = filepath.WalkDir(input, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if path != input && strings.HasPrefix(d.Name(), ".") {
+				if d.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if d.IsDir() || !hasExtension(path, exts) {
+				return nil
+			}
+			rel, err := filepath.Rel(input, path)
+			if err != nil {
+				return err
+			}
+			files = append(files, batchFile{input: path, rel: rel})
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		matches, err := filepath.Glob(input)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid glob %q: %v", input, err)
+		}
+		sort.Strings(matches)
+		prefix := globPrefix(input)
+		for _, path := range matches {
+			if fi, err := os.Stat(path); err != nil || fi.IsDir() {
+				continue
+			}
+			rel, err := filepath.Rel(prefix, path)
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, batchFile{input: path, rel: rel})
+		}
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("No input files found in %s", input)
+	}
+	return files, nil
+}
+
+// globPrefix returns the directories at the start of pattern that have no
+// wildcards, the ones every match shares.
+func globPrefix(pattern string) string {
+	dir := filepath.Dir(pattern)
+	for strings.ContainsAny(dir, "*?[") {
+		dir = filepath.Dir(dir)
+	}
+	return dir
+}
+
+func hasExtension(path string, exts []string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	for _, e := range exts {
+		if ext == e {
+			return true
+		}
+	}
+	return false
+}
+
+// batch describes how a command processes a set of files.
+type batch struct {
+	// exts are the extensions of the files picked up from directories
+	exts []string
+	// ext replaces the extension of every input in the output name
+	ext  string
+	jobs int
+	// run processes a single file
+	run func(input, output string) error
+}
+
+// Run processes every file of input with up to b.jobs at once, writing
+// the outputs under outdir with the same relative names as the inputs. Two
+// inputs that would be written to the same output, like foo.pcap and
+// foo.pcapng, fail the batch before anything is processed. A file that
+// fails doesn't stop the others, the failures are listed once everything
+// is done.
+func (b batch) Run(input, outdir string) error {
+	if outdir == Stdio {
+		return fmt.Errorf("The output has to be a directory when the input is a directory or a glob")
+	}
+	files, err := batchInputs(input, b.exts)
+	if err != nil {
+		return err
+	}
+	inputs := make(map[string]string)
+	for n := range files {
+		f := &files[n]
+		f.output = filepath.Join(outdir, strings.TrimSuffix(f.rel, filepath.Ext(f.rel))+b.ext)
+		if other, ok := inputs[f.output]; ok {
+			return fmt.Errorf("%s and %s would both be written to %s", other, f.input, f.output)
+		}
+		inputs[f.output] = f.input
+	}
+	jobs := b.jobs
+	if jobs < 1 {
+		jobs = 1
+	}
+
+	errs := make([]error, len(files))
+	work := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < jobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := range work {
+				errs[n] = b.runFile(files[n])
+			}
+		}()
+	}
+	for n := range files {
+		work <- n
+	}
+	close(work)
+	wg.Wait()
+
+	failed := 0
+	for n, err := range errs {
+		if err != nil {
+			log.Printf("%s: %v", files[n].input, err)
+			failed++
+		}
+	}
+	log.Printf("%d files processed, %d failed", len(files), failed)
+	if failed > 0 {
+		return fmt.Errorf("%d of %d files failed", failed, len(files))
+	}
+	return nil
+}
+
+func (b batch) runFile(f batchFile) error {
+	if err := os.MkdirAll(filepath.Dir(f.output), 0755); err != nil {
+		return err
+	}
+	return b.run(f.input, f.output)
+}
@@ -0,0 +1,382 @@
+package cli
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/JustinAzoff/pcap_simplify/build"
+	"github.com/JustinAzoff/pcap_simplify/checksum"
+	"github.com/JustinAzoff/pcap_simplify/extract"
+)
+
+var buildCommand = &Command{
+	Name:    "build",
+	Args:    "infile [outfile], or indir|glob outdir",
+	Summary: "Build a pcap from a .pkt file, or from a YAML or JSON scenario. The protocol recorded in the .pkt file picks how the packets are built, unless -mode says otherwise. With -interface the packets are sent to a network interface instead. Every file of a directory or a glob can be built at once.",
+	Run:     runBuild,
+}
+
+// OpenInterface opens a network interface for sending packets. It is nil
+// unless the binary was built with live interface support, since that
+// needs libpcap.
+var OpenInterface func(name string) (build.PacketWriter, error)
+
+// buildFlags are the flags of the commands that write pcaps.
+type buildFlags struct {
+	mode    *string
+	port    *int
+	version *int
+	iface   *string
+	format  *string
+	// original builds the conversation between the recorded addresses
+	original *bool
+	// keylog wraps TCP conversations in TLS, its secrets going to the file
+	keylog *string
+
+	// batch is set for the files of a directory or a glob, which build
+	// UDP without tcpdump since they would share its loopback port
+	batch bool
+
+	// section is recorded in pcapng output
+	section build.SectionInfo
+	// stats counts the packets written
+	stats build.Stats
+}
+
+func addBuildFlags(fs *flag.FlagSet) *buildFlags {
+	return &buildFlags{
+		mode:     fs.String("mode", "auto", "How to rebuild the packets: auto for the protocol recorded in the .pkt file, tcp, udp, icmp for pings, sctp, ip for other IP protocols such as GRE, raw for raw IP packets, or headers for .pkt files extracted with -headers."),
+		port:     fs.Int("port", 0, "Server port for the tcp, udp and sctp modes. Defaults to the port recorded in the .pkt file, or else 88 for udp and 80 otherwise."),
+		version:  fs.Int("version", 0, "The IP version to use in headers mode. Use 0 for payload detected."),
+		iface:    fs.String("interface", "", "Send the packets to this network interface instead of writing a pcap, in the tcp, icmp, sctp and ip modes, udp with -original-addresses, or auto when it picks one of them."),
+		original: fs.Bool("original-addresses", false, "Build the conversation between the client and server addresses recorded in the .pkt file instead of 10.0.0.1 and 10.0.0.2. In udp mode the datagrams are then generated instead of sent over the loopback interface, as they always are when building a directory or a glob."),
+		keylog:   fs.String("tls-keylog", "", "Wrap the tcp conversation in TLS between an in-process client and server, and append the secrets of the session to this file in the SSLKEYLOGFILE format so Wireshark can decrypt it. The TLS version, server name and ALPN recorded by extract -keylog are used if there are any, TLS 1.3 otherwise."),
+		format:   fs.String("format", "pcap", "Output format: pcap, or pcapng to record the options used and the origin of every packet in comments."),
+	}
+}
+
+// setSection records the command line of fs, once it is parsed, for the
+// pcapng section header.
+func (f *buildFlags) setSection(fs *flag.FlagSet) {
+	args := []string{fs.Name()}
+	fs.VisitAll(func(fl *flag.Flag) {
+		args = append(args, fmt.Sprintf("-%s=%s", fl.Name, fl.Value))
+	})
+	args = append(args, fs.Args()...)
+	f.section = build.SectionInfo{
+		Application: "pcapsimplify",
+		Comment:     strings.Join(args, " "),
+	}
+}
+
+func (f *buildFlags) fileOptions() build.FileOptions {
+	// check already made sure the format is valid
+	format, _ := build.ParseFormat(*f.format)
+	return build.FileOptions{Format: format, Section: f.section, Stats: &f.stats}
+}
+
+// extension is the file name extension of the output format.
+func (f *buildFlags) extension() string {
+	if *f.format == "pcapng" {
+		return ".pcapng"
+	}
+	return ".pcap"
+}
+
+func (f *buildFlags) check() error {
+	switch *f.mode {
+	case "auto", "tcp", "udp", "icmp", "sctp", "ip", "raw", "headers":
+	default:
+		return fmt.Errorf("Invalid mode %q, expected auto, tcp, udp, icmp, sctp, ip, raw or headers", *f.mode)
+	}
+	if err := f.checkInterface(*f.mode); err != nil {
+		return err
+	}
+	if *f.original && (*f.mode == "raw" || *f.mode == "headers") {
+		return fmt.Errorf("-original-addresses does not work in the raw and headers modes, their records keep their own addresses")
+	}
+	if *f.keylog != "" && *f.mode != "auto" && *f.mode != "tcp" {
+		return fmt.Errorf("-tls-keylog only works in the tcp mode")
+	}
+	_, err := build.ParseFormat(*f.format)
+	return err
+}
+
+// checkInterface makes sure mode can send to the interface in f.
+func (f *buildFlags) checkInterface(mode string) error {
+	switch {
+	case mode == "udp" && *f.original:
+	case mode == "udp", mode == "raw", mode == "headers":
+		if *f.iface != "" {
+			return fmt.Errorf("-interface only works in the tcp, icmp, sctp and ip modes, and udp with -original-addresses")
+		}
+	}
+	return nil
+}
+
+// autoModes are the modes that build each protocol recorded in a .pkt file.
+var autoModes = map[string]string{
+	extract.ProtoTCP:    "tcp",
+	extract.ProtoUDP:    "udp",
+	extract.ProtoSCTP:   "sctp",
+	extract.ProtoICMP:   "icmp",
+	extract.ProtoICMPv6: "icmp",
+	extract.ProtoIP:     "ip",
+}
+
+// autoMode picks the mode for the protocol of flow. Files extracted before
+// the protocol was recorded are built as TCP, like they always were.
+func autoMode(flow build.Flow) (string, error) {
+	if flow.Protocol == "" {
+		log.Printf("No protocol recorded, building tcp")
+		return "tcp", nil
+	}
+	mode, ok := autoModes[flow.Protocol]
+	if !ok {
+		return "", fmt.Errorf("Can't build the %q protocol, pick a -mode", flow.Protocol)
+	}
+	log.Printf("Building %s for the %s protocol", mode, flow.Protocol)
+	return mode, nil
+}
+
+// serverPort is the -port flag, or else the server port recorded in the
+// .pkt file, or else the default port of mode.
+func (f *buildFlags) serverPort(mode string, flow build.Flow) int {
+	if *f.port != 0 {
+		return *f.port
+	}
+	if flow.ServerPort != 0 {
+		return flow.ServerPort
+	}
+	if mode == "udp" {
+		return 88
+	}
+	return 80
+}
+
+// openHandle opens the interface in f, or the pcap output if there is none.
+func (f *buildFlags) openHandle(output string) (build.PacketWriter, error) {
+	if *f.iface != "" {
+		if OpenInterface == nil {
+			return nil, errors.New("This binary was built without support for sending to network interfaces")
+		}
+		log.Printf("Sending packets to %s", *f.iface)
+		handle, err := OpenInterface(*f.iface)
+		if err != nil {
+			return nil, err
+		}
+		return build.CountPackets(handle, &f.stats), nil
+	}
+	log.Printf("Writing pcap to %s", output)
+	outf, err := CreateOutput(output)
+	if err != nil {
+		return nil, err
+	}
+	return build.NewFilePacketWriter(outf, f.fileOptions())
+}
+
+// runBuilder reads the .pkt data, or a scenario in the auto, tcp and udp
+// modes, from r and writes the pcap to output, or to the interface in f.
+// The auto mode builds the protocol recorded in the .pkt file. It returns
+// the number of records built.
+func runBuilder(f *buildFlags, checksums checksum.Mode, r io.Reader, output string) (int, error) {
+	//just slurp it up
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return 0, err
+	}
+	mode := *f.mode
+	var flow build.Flow
+	var scenario *build.Scenario
+	switch {
+	case build.IsScenario(data) && (mode == "auto" || mode == "tcp" || mode == "udp"):
+		// The scenario says what protocol it is, tcp is the default
+		if *f.original {
+			return 0, fmt.Errorf("-original-addresses needs a .pkt file, scenarios have no recorded addresses")
+		}
+		if *f.keylog != "" {
+			return 0, fmt.Errorf("-tls-keylog needs a .pkt file, scenarios can't be wrapped in TLS")
+		}
+		if mode == "auto" {
+			mode = "tcp"
+		}
+		if scenario, err = build.ParseScenario(data, mode, f.serverPort(mode, flow)); err != nil {
+			return 0, err
+		}
+	case mode == "auto":
+		if flow, err = build.ReadFlow(data); err != nil {
+			return 0, err
+		}
+		if mode, err = autoMode(flow); err != nil {
+			return 0, err
+		}
+		if err := f.checkInterface(mode); err != nil {
+			return 0, err
+		}
+	case mode != "raw" && mode != "headers":
+		// The mode was picked by hand, so only the ports matter and the
+		// generator reports whatever is wrong with the file
+		flow, _ = build.ReadFlow(data)
+	}
+	opts := build.ExpandOptions{Port: f.serverPort(mode, flow), OriginalAddresses: *f.original}
+	if *f.keylog != "" {
+		if mode != "tcp" {
+			return 0, fmt.Errorf("-tls-keylog only works in the tcp mode, not for the %s protocol", flow.Protocol)
+		}
+		kf, err := os.OpenFile(*f.keylog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return 0, fmt.Errorf("Can't open key log: %v", err)
+		}
+		defer kf.Close()
+		opts.TLS = &build.TLSOptions{KeyLog: kf}
+	}
+
+	var packets int
+	switch {
+	case mode == "udp" && scenario == nil && !*f.original && !f.batch:
+		if f.fileOptions().Format != build.FormatPcap {
+			return 0, fmt.Errorf("tcpdump can only write pcap files in udp mode")
+		}
+		packets, err = build.ExpandUDP(bytes.NewReader(data), output, opts.Port)
+		if err == nil && output != Stdio {
+			// tcpdump wrote the file, so count its packets afterwards
+			if err := countPcap(output, &f.stats); err != nil {
+				log.Printf("Can't count the packets written to %s: %v", output, err)
+			}
+		}
+	case mode == "raw" || mode == "headers":
+		var outf io.WriteCloser
+		outf, err = CreateOutput(output)
+		if err != nil {
+			return 0, fmt.Errorf("Can't open output: %v", err)
+		}
+		if mode == "raw" {
+			packets, err = build.ExpandRaw(bytes.NewReader(data), outf, f.fileOptions())
+		} else {
+			packets, err = build.ExpandWithHeaders(bytes.NewReader(data), outf, *f.version, checksums, f.fileOptions())
+		}
+		if cerr := outf.Close(); err == nil && cerr != nil {
+			err = fmt.Errorf("Can't close output: %v", cerr)
+		}
+	default:
+		var handle build.PacketWriter
+		if handle, err = f.openHandle(output); err != nil {
+			return 0, fmt.Errorf("Can't open output: %v", err)
+		}
+		switch {
+		case scenario != nil:
+			packets, err = scenario.Run(handle)
+		case mode == "tcp":
+			packets, err = build.ExpandTCPWithOptions(bytes.NewReader(data), handle, opts)
+		case mode == "udp":
+			packets, err = build.ExpandUDPPackets(bytes.NewReader(data), handle, opts)
+		case mode == "icmp":
+			packets, err = build.ExpandICMP(bytes.NewReader(data), handle, opts)
+		case mode == "sctp":
+			packets, err = build.ExpandSCTP(bytes.NewReader(data), handle, opts)
+		case mode == "ip":
+			packets, err = build.ExpandIP(bytes.NewReader(data), handle, opts)
+		}
+		if cerr := handle.Close(); err == nil && cerr != nil {
+			err = fmt.Errorf("Can't close output: %v", cerr)
+		}
+	}
+	if err != nil {
+		return 0, err
+	}
+	log.Printf("%d packets rewritten", packets)
+	return packets, nil
+}
+
+func runBuild(fs *flag.FlagSet, args []string) error {
+	bf := addBuildFlags(fs)
+	checksumFlag := addChecksumFlag(fs)
+	statsFlag := addStatsFlag(fs)
+	jobs := addJobsFlag(fs)
+	streams := fs.Bool("streams", false, "Read the .pkt data from the stream files written by extract -streams. The input is the .offsets file, the .client.bin and .server.bin files are found next to it.")
+	if err := parseArgs(fs, args, 1, 2); err != nil {
+		return err
+	}
+	if err := bf.check(); err != nil {
+		return err
+	}
+	if err := checkStats(*statsFlag); err != nil {
+		return err
+	}
+	bf.setSection(fs)
+	checksums, err := checksum.ParseMode(*checksumFlag)
+	if err != nil {
+		return err
+	}
+	input := fs.Arg(0)
+	output := fs.Arg(1)
+	if isBatch(input) && *bf.iface != "" {
+		return fmt.Errorf("-interface can not be used with a directory or a glob as input")
+	}
+	if (*bf.iface == "") != (fs.NArg() == 2) {
+		return errUsage
+	}
+	if isBatch(input) {
+		exts := []string{".pkt"}
+		if *bf.mode == "auto" || *bf.mode == "tcp" || *bf.mode == "udp" {
+			exts = append(exts, ".yaml", ".yml", ".json")
+		}
+		if *streams {
+			exts = []string{".offsets"}
+		}
+		bf.batch = true
+		b := batch{exts: exts, ext: bf.extension(), jobs: *jobs, run: func(input, output string) error {
+			return buildFile(bf, checksums, input, output, *statsFlag, *streams)
+		}}
+		return b.Run(input, output)
+	}
+	return buildFile(bf, checksums, input, output, *statsFlag, *streams)
+}
+
+// buildFile builds the .pkt file or scenario input, or the stream files
+// named after it if streams is set, into output, and reports on it in the
+// stats format.
+func buildFile(bf *buildFlags, checksums checksum.Mode, input, output, stats string, streams bool) error {
+	if SameFile(input, output) {
+		return fmt.Errorf("Input and output can not be the same file")
+	}
+	// Every file of a batch counts its own packets
+	f := *bf
+	f.stats = build.Stats{}
+
+	var data []byte
+	var err error
+	if streams {
+		if data, err = readStreams(input); err != nil {
+			return err
+		}
+	} else {
+		inf, err := OpenInput(input)
+		if err != nil {
+			return fmt.Errorf("Can't open input: %v", err)
+		}
+		defer inf.Close()
+		//just slurp it up
+		if data, err = ioutil.ReadAll(inf); err != nil {
+			return err
+		}
+	}
+	rep := newReport("build", input, output)
+	if output == "" {
+		rep.Output = *f.iface
+	}
+	rep.records(data)
+	records, err := runBuilder(&f, checksums, bytes.NewReader(data), output)
+	if err != nil {
+		return err
+	}
+	rep.built(records, &f.stats)
+	return rep.write(stats)
+}
@@ -0,0 +1,179 @@
+package cli
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/JustinAzoff/pcap_simplify/extract"
+	"golang.org/x/net/bpf"
+)
+
+// OpenCapture opens a network interface for capturing with libpcap,
+// keeping only the packets matching a filter if it is not empty, and
+// returns what closes it. It is nil in binaries built without libpcap,
+// which can only capture with -afpacket.
+var OpenCapture func(name, filter string) (extract.LiveSource, func(), error)
+
+// CompileFilter compiles a filter for a capture of Ethernet frames. It is
+// nil in binaries built without libpcap.
+var CompileFilter func(filter string) ([]bpf.RawInstruction, error)
+
+// captureFlags are the flags of the commands that can capture from a
+// network interface instead of reading pcaps.
+type captureFlags struct {
+	iface       *string
+	afpacket    *bool
+	filter      *string
+	count       *int
+	duration    *time.Duration
+	untilClosed *bool
+}
+
+func addCaptureFlags(fs *flag.FlagSet) *captureFlags {
+	return &captureFlags{
+		iface:       fs.String("interface", "", "Capture from this network interface instead of reading a pcap, the only argument left is then the output."),
+		afpacket:    fs.Bool("afpacket", false, "Capture with an AF_PACKET socket instead of libpcap, Linux only. Unlike libpcap, it sees the packets of the loopback interface twice."),
+		filter:      fs.String("filter", "", "BPF filter of the packets to capture, in the tcpdump syntax. With -afpacket it can also be given compiled, as written by tcpdump -ddd, for binaries built without libpcap."),
+		count:       fs.Int("count", 0, "Stop capturing after this many packets, 0 for no limit."),
+		duration:    fs.Duration("duration", 0, "Stop capturing after this long, 0 for no limit."),
+		untilClosed: fs.Bool("until-closed", false, "Stop capturing once the first TCP connection seen is closed."),
+	}
+}
+
+func (f *captureFlags) live() bool {
+	return *f.iface != ""
+}
+
+// check rejects the capture flags without -interface.
+func (f *captureFlags) check() error {
+	if !f.live() && (*f.afpacket || *f.filter != "" || *f.count != 0 || *f.duration != 0 || *f.untilClosed) {
+		return fmt.Errorf("-afpacket, -filter, -count, -duration and -until-closed need -interface")
+	}
+	if *f.count < 0 || *f.duration < 0 {
+		return fmt.Errorf("-count and -duration can not be negative")
+	}
+	return nil
+}
+
+// stop is when the capture ends. An interrupt ends it too, for what was
+// captured so far to be written out in full, until the returned func is
+// called.
+func (f *captureFlags) stop() (extract.Stop, func()) {
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		select {
+		case <-interrupt:
+			log.Printf("Interrupted, finishing the capture")
+			close(done)
+		case <-finished:
+		}
+	}()
+	stop := extract.Stop{
+		Packets:    *f.count,
+		Duration:   *f.duration,
+		FlowClosed: *f.untilClosed,
+		Done:       done,
+	}
+	return stop, func() {
+		signal.Stop(interrupt)
+		close(finished)
+	}
+}
+
+// open starts capturing from the interface.
+func (f *captureFlags) open() (*extract.Reader, io.Closer, error) {
+	var src extract.LiveSource
+	var closeSource func()
+	var err error
+	if *f.afpacket {
+		filter, compiled, err := parseCompiledFilter(*f.filter)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Invalid filter: %v", err)
+		}
+		if *f.filter != "" && !compiled {
+			if CompileFilter == nil {
+				return nil, nil, errors.New("This binary was built without libpcap, which -filter needs to compile the filter, give it compiled by tcpdump -ddd instead")
+			}
+			if filter, err = CompileFilter(*f.filter); err != nil {
+				return nil, nil, fmt.Errorf("Can't compile filter: %v", err)
+			}
+		}
+		src, closeSource, err = openAFPacket(*f.iface, filter)
+	} else {
+		if OpenCapture == nil {
+			return nil, nil, errors.New("This binary was built without support for capturing from network interfaces, use -afpacket")
+		}
+		if _, compiled, _ := parseCompiledFilter(*f.filter); compiled {
+			return nil, nil, errors.New("A filter compiled by tcpdump -ddd needs -afpacket")
+		}
+		src, closeSource, err = OpenCapture(*f.iface, *f.filter)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("Can't capture from %s: %v", *f.iface, err)
+	}
+	stop, stopped := f.stop()
+	closer := closerFunc(func() {
+		stopped()
+		closeSource()
+	})
+	r, err := extract.NewLiveReader(src, stop)
+	if err != nil {
+		closer.Close()
+		return nil, nil, err
+	}
+	log.Printf("Capturing from %s", *f.iface)
+	return r, closer, nil
+}
+
+// parseCompiledFilter parses a filter compiled to BPF in the form written
+// by tcpdump -ddd: the number of instructions, then the code, jt, jf and k
+// of each as decimal numbers, one instruction per line or separated by
+// commas. It returns false for a filter that doesn't start with a number,
+// like one in the tcpdump syntax.
+func parseCompiledFilter(filter string) ([]bpf.RawInstruction, bool, error) {
+	lines := strings.FieldsFunc(filter, func(r rune) bool { return r == '\n' || r == ',' })
+	if len(lines) == 0 {
+		return nil, false, nil
+	}
+	count, err := strconv.Atoi(strings.TrimSpace(lines[0]))
+	if err != nil {
+		return nil, false, nil
+	}
+	if count != len(lines)-1 {
+		return nil, true, fmt.Errorf("%d instructions, but the count says %d", len(lines)-1, count)
+	}
+	insns := make([]bpf.RawInstruction, count)
+	for i, line := range lines[1:] {
+		fields := strings.Fields(line)
+		if len(fields) != 4 {
+			return nil, true, fmt.Errorf("Instruction %d: expected the code, jt, jf and k, got %q", i+1, line)
+		}
+		var values [4]uint64
+		for j, bits := range []int{16, 8, 8, 32} {
+			if values[j], err = strconv.ParseUint(fields[j], 10, bits); err != nil {
+				return nil, true, fmt.Errorf("Instruction %d: %v", i+1, err)
+			}
+		}
+		insns[i] = bpf.RawInstruction{Op: uint16(values[0]), Jt: uint8(values[1]), Jf: uint8(values[2]), K: uint32(values[3])}
+	}
+	return insns, true, nil
+}
+
+// closerFunc is a func() that is an io.Closer.
+type closerFunc func()
+
+func (f closerFunc) Close() error {
+	f()
+	return nil
+}
@@ -0,0 +1,146 @@
+// Package cli implements the pcapsimplify command and its subcommands.
+//
+// The original single purpose commands are kept as thin wrappers that call
+// Main with the matching subcommand.
+package cli
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+)
+
+// Stdio is the file name that stands for stdin or stdout.
+const Stdio = "-"
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// OpenInput opens name for reading, or returns stdin if name is "-".
+func OpenInput(name string) (io.ReadCloser, error) {
+	if name == Stdio {
+		return ioutil.NopCloser(os.Stdin), nil
+	}
+	return os.Open(name)
+}
+
+// CreateOutput creates name for writing, or returns stdout if name is "-".
+// Anything written to stdout is data, so log messages have to go to stderr.
+func CreateOutput(name string) (io.WriteCloser, error) {
+	if name == Stdio {
+		return nopWriteCloser{os.Stdout}, nil
+	}
+	return os.Create(name)
+}
+
+// SameFile reports whether input and output name the same file, which would
+// truncate the input before it is read.
+func SameFile(input, output string) bool {
+	return input == output && input != Stdio
+}
+
+// Command is a single pcapsimplify subcommand.
+type Command struct {
+	Name string
+	// Args is the synopsis of the positional arguments
+	Args    string
+	Summary string
+	// Run parses args with fs and runs the command
+	Run func(fs *flag.FlagSet, args []string) error
+}
+
+// Commands lists every subcommand in the order they are shown in the help.
+var Commands = []*Command{
+	extractCommand,
+	buildCommand,
+	convertCommand,
+	verifyCommand,
+	inspectCommand,
+	dumpCommand,
+	compileCommand,
+}
+
+var (
+	// errUsage is returned by Run when the positional arguments are wrong
+	errUsage = errors.New("usage")
+	// errFlags is returned by Run when the flag package already printed
+	// the error and the usage
+	errFlags = errors.New("bad flags")
+)
+
+// parseArgs parses the flags in args and checks that between min and max
+// positional arguments are left.
+func parseArgs(fs *flag.FlagSet, args []string, min, max int) error {
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return err
+		}
+		return errFlags
+	}
+	if fs.NArg() < min || fs.NArg() > max {
+		return errUsage
+	}
+	return nil
+}
+
+func (c *Command) flagSet() *flag.FlagSet {
+	fs := flag.NewFlagSet("pcapsimplify "+c.Name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: pcapsimplify %s [flags] %s\n\n%s\n", c.Name, c.Args, c.Summary)
+		hasFlags := false
+		fs.VisitAll(func(*flag.Flag) { hasFlags = true })
+		if hasFlags {
+			fmt.Fprintf(fs.Output(), "\nFlags:\n")
+			fs.PrintDefaults()
+		}
+	}
+	return fs
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: pcapsimplify command [flags] args...\n\nCommands:\n")
+	for _, c := range Commands {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", c.Name, c.Summary)
+	}
+	fmt.Fprintf(os.Stderr, "\nRun pcapsimplify command -h for the flags of each command.\n")
+}
+
+// Main runs the subcommand named by args[0] with the rest of args and
+// returns the exit status.
+func Main(args []string) int {
+	if len(args) == 0 || args[0] == "-h" || args[0] == "-help" || args[0] == "help" {
+		usage()
+		if len(args) == 0 {
+			return 2
+		}
+		return 0
+	}
+	for _, c := range Commands {
+		if c.Name != args[0] {
+			continue
+		}
+		fs := c.flagSet()
+		err := c.Run(fs, args[1:])
+		switch err {
+		case nil, flag.ErrHelp:
+			return 0
+		case errUsage:
+			fs.Usage()
+			return 2
+		case errFlags:
+			return 2
+		}
+		log.Print(err)
+		return 1
+	}
+	fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", args[0])
+	usage()
+	return 2
+}
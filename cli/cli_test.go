@@ -0,0 +1,438 @@
+package cli
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/JustinAzoff/pcap_simplify/build"
+	"github.com/JustinAzoff/pcap_simplify/pkt"
+	"golang.org/x/net/bpf"
+)
+
+func testdata(name string) string {
+	return filepath.Join("..", "testdata", name)
+}
+
+func run(t *testing.T, want int, args ...string) {
+	t.Helper()
+	if got := Main(args); got != want {
+		t.Fatalf("pcapsimplify %v exited with %d, expected %d", args, got, want)
+	}
+}
+
+func readFile(t *testing.T, name string) []byte {
+	t.Helper()
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestExtractGolden(t *testing.T) {
+	dir := t.TempDir()
+	for _, tt := range []struct {
+		args   []string
+		golden string
+	}{
+		{[]string{"extract", testdata("tcp.pcap")}, "tcp.pkt"},
+		{[]string{"extract", "-headers", testdata("udp.pcap")}, "udp.headers.pkt"},
+		{[]string{"extract", "-decap", "vlan", testdata("vlan.pcap")}, "vlan.pkt"},
+		{[]string{"extract", "-link", testdata("ethernet.pcapng")}, "pcapng.link.pkt"},
+	} {
+		out := filepath.Join(dir, tt.golden)
+		run(t, 0, append(tt.args, out)...)
+		if !bytes.Equal(readFile(t, out), readFile(t, testdata(filepath.Join("golden", tt.golden)))) {
+			t.Errorf("pcapsimplify %v differs from the golden file %s", tt.args, tt.golden)
+		}
+	}
+}
+
+func TestExtractKeyLog(t *testing.T) {
+	dir := t.TempDir()
+	keylog := filepath.Join(dir, "keys.log")
+	if err := ioutil.WriteFile(keylog, []byte("# no sessions\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	out := filepath.Join(dir, "tcp.pkt")
+	run(t, 1, "extract", "-keylog", filepath.Join(dir, "missing.log"), testdata("tcp.pcap"), out)
+	run(t, 1, "extract", "-headers", "-keylog", keylog, testdata("tcp.pcap"), out)
+	// Conversations that are not TLS keep their payloads
+	run(t, 0, "extract", "-keylog", keylog, testdata("tcp.pcap"), out)
+	c, err := pkt.Compare(readFile(t, testdata("golden/tcp.pkt")), readFile(t, out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Divergences) != 0 {
+		t.Errorf("payloads differ: %v", c.Divergences)
+	}
+}
+
+func TestExtractHTTP(t *testing.T) {
+	dir := t.TempDir()
+	out := filepath.Join(dir, "tcp.pkt")
+	run(t, 1, "extract", "-dechunk", testdata("tcp.pcap"), out)
+	run(t, 1, "extract", "-http", "-headers", testdata("tcp.pcap"), out)
+	run(t, 0, "extract", "-http", testdata("tcp.pcap"), out)
+	manifest := string(readFile(t, out+".http.csv"))
+	for _, want := range []string{
+		"file,record,type,method,uri,status,content_type,bytes\n",
+		",1,request,GET,/,,",
+		",2,response,GET,/,200,",
+	} {
+		if !strings.Contains(manifest, want) {
+			t.Errorf("manifest %q lacks %q", manifest, want)
+		}
+	}
+	split := filepath.Join(dir, "split")
+	run(t, 0, "extract", "-http", "-split", testdata("tcp.pcap"), split)
+	if m := string(readFile(t, filepath.Join(split, "http.csv"))); !strings.Contains(m, ".pkt,2,response,GET,/,200,") {
+		t.Errorf("split manifest %q lacks the response", m)
+	}
+}
+
+func TestExtractDNS(t *testing.T) {
+	dir := t.TempDir()
+	out := filepath.Join(dir, "udp.pkt")
+	run(t, 1, "extract", "-dns", "-link", testdata("udp.pcap"), out)
+	// The datagrams on port 53 of the fixture are not DNS messages
+	run(t, 0, "extract", "-dns", testdata("udp.pcap"), out)
+	if s := string(readFile(t, out+".dns.csv")); s != "file,record,proto,id,name,type,rcode,answers,query,response\n" {
+		t.Errorf("summary %q, expected only its header", s)
+	}
+	split := filepath.Join(dir, "split")
+	run(t, 0, "extract", "-dns", "-split", testdata("udp.pcap"), split)
+	readFile(t, filepath.Join(split, "dns.csv"))
+}
+
+func TestExtractCapture(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "live.pkt")
+	run(t, 2, "extract", "-interface", "lo", testdata("tcp.pcap"), out)
+	run(t, 1, "extract", "-count", "10", testdata("tcp.pcap"), out)
+	run(t, 1, "extract", "-interface", "lo", "-count", "-1", out)
+	// The test binary has no libpcap
+	run(t, 1, "extract", "-interface", "lo", out)
+	run(t, 1, "extract", "-interface", "lo", "-afpacket", "-filter", "tcp", out)
+	run(t, 1, "extract", "-interface", "lo", "-afpacket", "-filter", "2\n6 0 0", out)
+	run(t, 1, "extract", "-interface", "lo", "-filter", "1\n6 0 0 0", out)
+}
+
+func TestParseCompiledFilter(t *testing.T) {
+	// tcpdump -ddd ip
+	ip := []bpf.RawInstruction{{Op: 40, K: 12}, {Op: 21, Jf: 1, K: 2048}, {Op: 6, K: 262144}, {Op: 6}}
+	for _, tt := range []struct {
+		filter   string
+		insns    []bpf.RawInstruction
+		compiled bool
+		bad      bool
+	}{
+		{"", nil, false, false},
+		{"tcp port 80", nil, false, false},
+		{"4\n40 0 0 12\n21 0 1 2048\n6 0 0 262144\n6 0 0 0\n", ip, true, false},
+		{"4,40 0 0 12,21 0 1 2048,6 0 0 262144,6 0 0 0", ip, true, false},
+		{"3\n40 0 0 12\n6 0 0 0", nil, true, true},
+		{"1\n6 0 0", nil, true, true},
+		{"1\n6 0 256 0", nil, true, true},
+	} {
+		insns, compiled, err := parseCompiledFilter(tt.filter)
+		if compiled != tt.compiled || (err != nil) != tt.bad || !reflect.DeepEqual(insns, tt.insns) {
+			t.Errorf("%q: got %v, %v and %v", tt.filter, insns, compiled, err)
+		}
+	}
+}
+
+func TestBuildTLS(t *testing.T) {
+	dir := t.TempDir()
+	keylog := filepath.Join(dir, "keys.log")
+	pcap := filepath.Join(dir, "tls.pcap")
+	out := filepath.Join(dir, "tls.pkt")
+	run(t, 1, "build", "-mode", "udp", "-tls-keylog", keylog, testdata("golden/tcp.pkt"), pcap)
+	run(t, 0, "build", "-tls-keylog", keylog, testdata("golden/tcp.pkt"), pcap)
+	run(t, 0, "extract", "-keylog", keylog, pcap, out)
+	c, err := pkt.Compare(readFile(t, testdata("golden/tcp.pkt")), readFile(t, out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Divergences) != 0 {
+		t.Errorf("decrypted payloads differ: %v", c.Divergences)
+	}
+}
+
+func TestDumpCompile(t *testing.T) {
+	dir := t.TempDir()
+	text := filepath.Join(dir, "tcp.txt")
+	out := filepath.Join(dir, "tcp.pkt")
+	golden := testdata("golden/tcp.headers.pkt")
+	run(t, 0, "dump", golden, text)
+	run(t, 0, "compile", text, out)
+	if !bytes.Equal(readFile(t, out), readFile(t, golden)) {
+		t.Errorf("dump and compile changed %s", golden)
+	}
+}
+
+func TestBuildAndVerify(t *testing.T) {
+	dir := t.TempDir()
+	for _, mode := range []string{"raw", "headers"} {
+		out := filepath.Join(dir, mode+".pcap")
+		run(t, 0, "build", "-mode", mode, testdata("golden/tcp.headers.pkt"), out)
+		run(t, 0, "verify", testdata("tcp.pcap"), out)
+		run(t, 0, "verify", "-mode", mode, testdata("tcp.pcap"))
+	}
+	// The UDP fixture carries different data
+	run(t, 1, "verify", testdata("tcp.pcap"), testdata("udp.pcap"))
+}
+
+func TestUsage(t *testing.T) {
+	run(t, 2)
+	run(t, 2, "no-such-command")
+	run(t, 2, "extract")
+	run(t, 2, "extract", "-no-such-flag", "in", "out")
+	run(t, 0, "extract", "-h")
+	run(t, 1, "extract", testdata("tcp.pcap"), testdata("tcp.pcap"))
+	run(t, 1, "build", "-mode", "nope", "in", "out")
+}
+
+// runStats runs a command with -stats json and decodes the report it
+// writes to stdout.
+func runStats(t *testing.T, args ...string) report {
+	t.Helper()
+	f, err := os.Create(filepath.Join(t.TempDir(), "stdout"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	stdout := os.Stdout
+	os.Stdout = f
+	defer func() { os.Stdout = stdout }()
+	run(t, 0, append([]string{args[0], "-stats", "json"}, args[1:]...)...)
+	var rep report
+	if err := json.Unmarshal(readFile(t, f.Name()), &rep); err != nil {
+		t.Fatal(err)
+	}
+	return rep
+}
+
+func TestStats(t *testing.T) {
+	dir := t.TempDir()
+	rep := runStats(t, "extract", testdata("fragments.pcap"), filepath.Join(dir, "fragments.pkt"))
+	if rep.PacketsRead != 4 || rep.PacketsWritten != 2 || rep.Skipped["fragment"] != 2 || rep.Flows != 1 {
+		t.Errorf("extract reported %+v", rep)
+	}
+	if rep.ClientToServer != 2000 || rep.ServerToClient != 2 || rep.InputDuration == nil || rep.OutputDuration != nil {
+		t.Errorf("extract reported %+v", rep)
+	}
+
+	rep = runStats(t, "build", "-mode", "headers", testdata("golden/tcp.headers.pkt"), filepath.Join(dir, "tcp.pcap"))
+	if rep.Records == 0 || rep.SegmentsGenerated != rep.Records || rep.OutputDuration == nil || rep.TimingDistortion != nil {
+		t.Errorf("build reported %+v", rep)
+	}
+
+	rep = runStats(t, "convert", "-headers", "-mode", "headers", testdata("tcp.pcap"), filepath.Join(dir, "tcp.pcap"))
+	if rep.PacketsRead == 0 || rep.SegmentsGenerated != rep.PacketsRead || rep.TimingDistortion == nil {
+		t.Errorf("convert reported %+v", rep)
+	}
+	if got := *rep.OutputDuration - *rep.InputDuration; math.Abs(*rep.TimingDistortion-got) > 1e-6 {
+		t.Errorf("timing distortion %v, expected %v", *rep.TimingDistortion, got)
+	}
+	run(t, 1, "extract", "-stats", "xml", testdata("tcp.pcap"), filepath.Join(dir, "tcp.pkt"))
+}
+
+func copyFile(t *testing.T, from, to string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(to), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(to, readFile(t, from), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBatch(t *testing.T) {
+	dir := t.TempDir()
+	in := filepath.Join(dir, "in")
+	copyFile(t, testdata("tcp.pcap"), filepath.Join(in, "tcp.pcap"))
+	copyFile(t, testdata("udp.pcap"), filepath.Join(in, "sub", "udp.pcap"))
+	copyFile(t, testdata("tcp.pcap"), filepath.Join(in, "notes.txt"))
+	if err := ioutil.WriteFile(filepath.Join(in, "broken.pcap"), []byte("not a pcap"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The broken file fails without stopping the others
+	out := filepath.Join(dir, "pkt")
+	run(t, 1, "extract", "-headers", "-jobs", "2", in, out)
+	for _, name := range []string{"tcp", "sub/udp"} {
+		got := readFile(t, filepath.Join(out, name+".pkt"))
+		if !bytes.Equal(got, readFile(t, testdata("golden/"+filepath.Base(name)+".headers.pkt"))) {
+			t.Errorf("%s.pkt differs from the golden file", name)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(out, "notes.pkt")); err == nil {
+		t.Errorf("notes.txt was extracted")
+	}
+
+	pcaps := filepath.Join(dir, "pcap")
+	run(t, 0, "build", "-mode", "headers", "-format", "pcapng", out, pcaps)
+	run(t, 0, "verify", testdata("udp.pcap"), filepath.Join(pcaps, "sub", "udp.pcapng"))
+
+	converted := filepath.Join(dir, "converted")
+	// The glob picks up the broken file as well
+	run(t, 1, "convert", "-headers", "-mode", "headers", filepath.Join(in, "*.pcap"), converted)
+	run(t, 0, "verify", testdata("tcp.pcap"), filepath.Join(converted, "tcp.pcap"))
+	if _, err := os.Stat(filepath.Join(converted, "udp.pcap")); err == nil {
+		t.Errorf("the glob matched a file in a subdirectory")
+	}
+
+	// Matches in different directories keep them in their output names
+	nested := filepath.Join(dir, "nested")
+	copyFile(t, testdata("tcp.pcap"), filepath.Join(nested, "a", "x.pcap"))
+	copyFile(t, testdata("udp.pcap"), filepath.Join(nested, "b", "x.pcap"))
+	run(t, 0, "convert", "-headers", "-mode", "headers", filepath.Join(nested, "*", "x.pcap"), converted)
+	run(t, 0, "verify", testdata("tcp.pcap"), filepath.Join(converted, "a", "x.pcap"))
+	run(t, 0, "verify", testdata("udp.pcap"), filepath.Join(converted, "b", "x.pcap"))
+
+	// Inputs that would overwrite each other fail before anything is written
+	clash := filepath.Join(dir, "clash")
+	copyFile(t, testdata("tcp.pcap"), filepath.Join(clash, "foo.pcap"))
+	copyFile(t, testdata("ethernet.pcapng"), filepath.Join(clash, "foo.pcapng"))
+	run(t, 1, "extract", clash, filepath.Join(dir, "clashed"))
+	if _, err := os.Stat(filepath.Join(dir, "clashed")); err == nil {
+		t.Errorf("a batch with clashing outputs wrote some")
+	}
+
+	run(t, 1, "extract", filepath.Join(dir, "nothing", "*.pcap"), out)
+	run(t, 1, "extract", in, "-")
+}
+
+func TestBatchUDP(t *testing.T) {
+	// Files on the same port would clash on the loopback interface if
+	// tcpdump built them all at once
+	dir := t.TempDir()
+	in := filepath.Join(dir, "in")
+	names := []string{"a", "b", "c", "d"}
+	for _, name := range names {
+		copyFile(t, testdata("golden/udp.pkt"), filepath.Join(in, name+".pkt"))
+	}
+	out := filepath.Join(dir, "out")
+	run(t, 0, "build", "-jobs", "4", in, out)
+	for _, name := range names {
+		extracted := filepath.Join(dir, name+".pkt")
+		run(t, 0, "extract", filepath.Join(out, name+".pcap"), extracted)
+		c, err := pkt.Compare(readFile(t, testdata("golden/udp.pkt")), readFile(t, extracted))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(c.Divergences) > 0 {
+			t.Errorf("%s: %v", name, c.Divergences)
+		}
+	}
+}
+
+func TestSplit(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "flows")
+	run(t, 0, "extract", "-split", "-idle", "1m", testdata("tcp.pcap"), out)
+	index, err := csv.NewReader(bytes.NewReader(readFile(t, filepath.Join(out, "index.csv")))).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(index) != 2 || index[1][1] != testdata("tcp.pcap") {
+		t.Fatalf("index is %v, expected the header and one conversation", index)
+	}
+	// A capture of a single conversation splits into the same .pkt
+	if !bytes.Equal(readFile(t, filepath.Join(out, index[1][0])), readFile(t, testdata("golden/tcp.pkt"))) {
+		t.Errorf("%s differs from the golden file", index[1][0])
+	}
+	run(t, 1, "extract", "-split", testdata("tcp.pcap"), "-")
+	run(t, 1, "extract", "-split", "-headers", testdata("tcp.pcap"), out)
+}
+
+func TestStreams(t *testing.T) {
+	dir := t.TempDir()
+	out := filepath.Join(dir, "tcp.pkt")
+	run(t, 0, "extract", "-streams", testdata("tcp.pcap"), out)
+	client := readFile(t, filepath.Join(dir, "tcp.client.bin"))
+	server := readFile(t, filepath.Join(dir, "tcp.server.bin"))
+	c, err := pkt.Compare(readFile(t, out), readFile(t, testdata("golden/tcp.pkt")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(client) != c.OrigBytes || len(server) != c.RespBytes {
+		t.Errorf("streams of %d and %d bytes, expected %d and %d", len(client), len(server), c.OrigBytes, c.RespBytes)
+	}
+
+	// Packets make streams too, and the headers rebuild needs the
+	// records back exactly
+	out = filepath.Join(dir, "headers.pkt")
+	run(t, 0, "extract", "-headers", "-streams", testdata("tcp.pcap"), out)
+	pcap := filepath.Join(dir, "headers.pcap")
+	run(t, 0, "build", "-streams", "-mode", "headers", filepath.Join(dir, "headers.offsets"), pcap)
+	run(t, 0, "verify", testdata("tcp.pcap"), pcap)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "headers.client.bin"), append(client, 'x'), 0644); err != nil {
+		t.Fatal(err)
+	}
+	run(t, 1, "build", "-streams", "-mode", "headers", filepath.Join(dir, "headers.offsets"), pcap)
+	run(t, 1, "extract", "-streams", testdata("tcp.pcap"), "-")
+}
+
+// TestBuildAuto makes sure build picks the generator and the ports from
+// the .pkt file, so extracting what it built gives the same flow back.
+func TestBuildAuto(t *testing.T) {
+	dir := t.TempDir()
+	pcap := filepath.Join(dir, "tcp.pcap")
+	out := filepath.Join(dir, "tcp.pkt")
+	run(t, 0, "build", testdata("golden/tcp.pkt"), pcap)
+	run(t, 0, "extract", pcap, out)
+	c, err := pkt.Compare(readFile(t, testdata("golden/tcp.pkt")), readFile(t, out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Divergences) > 0 {
+		t.Errorf("rebuilding %s changed the data: %v", testdata("golden/tcp.pkt"), c.Divergences)
+	}
+	want, err := build.ReadFlow(readFile(t, testdata("golden/tcp.pkt")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := build.ReadFlow(readFile(t, out)); err != nil || got != want {
+		t.Errorf("rebuilt flow is %+v (%v), expected %+v", got, err, want)
+	}
+
+	var mixed bytes.Buffer
+	w := pkt.NewWriter(&mixed)
+	for _, proto := range []string{"tcp", "sctp"} {
+		if err := w.WriteMetadata(pkt.Metadata{"protocol": proto}); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Write(true, []byte(proto)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	in := filepath.Join(dir, "mixed.pkt")
+	if err := ioutil.WriteFile(in, mixed.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	run(t, 1, "build", in, pcap)
+	run(t, 0, "build", "-mode", "tcp", in, pcap)
+}
+
+func TestBuildOriginalAddresses(t *testing.T) {
+	dir := t.TempDir()
+	pcap := filepath.Join(dir, "udp.pcap")
+	out := filepath.Join(dir, "udp.pkt")
+	// UDP has no handshake, so the rebuilt conversation extracts to the
+	// very same file
+	run(t, 0, "build", "-original-addresses", testdata("golden/udp.pkt"), pcap)
+	run(t, 0, "extract", pcap, out)
+	if !bytes.Equal(readFile(t, out), readFile(t, testdata("golden/udp.pkt"))) {
+		t.Errorf("rebuilding %s with its original addresses changed it", testdata("golden/udp.pkt"))
+	}
+	run(t, 1, "build", "-original-addresses", "-mode", "headers", testdata("golden/udp.headers.pkt"), pcap)
+}
@@ -0,0 +1,102 @@
+package cli
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"log"
+
+	"github.com/JustinAzoff/pcap_simplify/build"
+	"github.com/JustinAzoff/pcap_simplify/checksum"
+	"github.com/JustinAzoff/pcap_simplify/extract"
+)
+
+var convertCommand = &Command{
+	Name:    "convert",
+	Args:    "infile outfile, or indir|glob outdir",
+	Summary: "Extract a pcap and build a new one from it in one go, the same as extract followed by build. Every pcap of a directory or a glob can be converted at once.",
+	Run:     runConvert,
+}
+
+func runConvert(fs *flag.FlagSet, args []string) error {
+	ef := addExtractFlags(fs)
+	bf := addBuildFlags(fs)
+	checksumFlag := addChecksumFlag(fs)
+	statsFlag := addStatsFlag(fs)
+	jobs := addJobsFlag(fs)
+	if err := parseArgs(fs, args, 2, 2); err != nil {
+		return err
+	}
+	if err := bf.check(); err != nil {
+		return err
+	}
+	if err := checkStats(*statsFlag); err != nil {
+		return err
+	}
+	bf.setSection(fs)
+	if *bf.iface != "" {
+		return fmt.Errorf("-interface can not be used with convert")
+	}
+	opts, err := ef.options(*checksumFlag)
+	if err != nil {
+		return err
+	}
+	if ef.withHeaders() != (*bf.mode == "headers") {
+		return fmt.Errorf("-headers and -link go together with -mode headers")
+	}
+
+	if isBatch(fs.Arg(0)) {
+		bf.batch = true
+		b := batch{exts: pcapExtensions, ext: bf.extension(), jobs: *jobs, run: func(input, output string) error {
+			return convertFile(ef, bf, opts, input, output, *statsFlag)
+		}}
+		return b.Run(fs.Arg(0), fs.Arg(1))
+	}
+	return convertFile(ef, bf, opts, fs.Arg(0), fs.Arg(1), *statsFlag)
+}
+
+// convertFile converts the pcap input into output, and reports on it in
+// the stats format.
+func convertFile(ef *extractFlags, bf *buildFlags, opts extract.Options, input, output, statsFormat string) error {
+	if SameFile(input, output) {
+		return fmt.Errorf("Input and output can not be the same file")
+	}
+	// Every file of a batch counts its own packets
+	f := *bf
+	f.stats = build.Stats{}
+	inf, err := OpenInput(input)
+	if err != nil {
+		return fmt.Errorf("Can't open input: %v", err)
+	}
+	defer inf.Close()
+	r, err := extract.NewReader(inf)
+	if err != nil {
+		return fmt.Errorf("Can't parse input as pcap file: %v", err)
+	}
+
+	rep := newReport("convert", input, output)
+	var stats extract.Stats
+	opts.Stats = &stats
+	newResults(&opts)
+	var buf bytes.Buffer
+	if ef.withHeaders() {
+		_, err = extract.SimplifyWithHeaders(r, &buf, opts)
+	} else {
+		_, _, err = extract.Simplify(r, &buf, opts)
+	}
+	if err != nil {
+		return err
+	}
+	rep.extracted(&stats)
+	if buf.Len() == 0 {
+		log.Printf("Nothing was extracted from %s", input)
+		return rep.write(statsFormat)
+	}
+	// Checksums were already handled while extracting
+	records, err := runBuilder(&f, checksum.None, &buf, output)
+	if err != nil {
+		return err
+	}
+	rep.built(records, &f.stats)
+	return rep.write(statsFormat)
+}
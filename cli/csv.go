@@ -0,0 +1,37 @@
+package cli
+
+import (
+	"encoding/csv"
+	"os"
+
+	"github.com/JustinAzoff/pcap_simplify/extract"
+)
+
+// newResults gives the HTTP and DNS options in opts, if any, lists of
+// their own, for the files of a batch not to share the HTTP manifest and
+// the DNS summary written from them.
+func newResults(opts *extract.Options) {
+	if opts.HTTP != nil {
+		opts.HTTP = &extract.HTTPOptions{Dechunk: opts.HTTP.Dechunk}
+	}
+	if opts.DNS != nil {
+		opts.DNS = &extract.DNSOptions{}
+	}
+}
+
+// writeCSV writes the header and the rows to the file name, as is done for
+// the split index, the HTTP manifest and the DNS summary.
+func writeCSV(name string, header []string, rows [][]string) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	w := csv.NewWriter(f)
+	w.Write(header)
+	// WriteAll flushes, returning the error of any of the writes
+	if err := w.WriteAll(rows); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
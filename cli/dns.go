@@ -0,0 +1,25 @@
+package cli
+
+import (
+	"strconv"
+
+	"github.com/JustinAzoff/pcap_simplify/extract"
+)
+
+// dnsSummaryExt is added to the name of the output of extract -dns to
+// name its summary.
+const dnsSummaryExt = ".dns.csv"
+
+// writeDNSSummary lists the DNS transactions written, with the record
+// holding the first message of each.
+func writeDNSSummary(name string, transactions []extract.DNSTransaction) error {
+	var rows [][]string
+	for _, x := range transactions {
+		rows = append(rows, []string{
+			x.File, strconv.Itoa(x.Record), x.Proto, strconv.Itoa(int(x.ID)),
+			x.Name, x.Type, x.Rcode, strconv.Itoa(x.Answers),
+			strconv.FormatBool(x.Query), strconv.FormatBool(x.Response),
+		})
+	}
+	return writeCSV(name, []string{"file", "record", "proto", "id", "name", "type", "rcode", "answers", "query", "response"}, rows)
+}
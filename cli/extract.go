@@ -0,0 +1,243 @@
+package cli
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/JustinAzoff/pcap_simplify/checksum"
+	"github.com/JustinAzoff/pcap_simplify/extract"
+)
+
+var extractCommand = &Command{
+	Name:    "extract",
+	Args:    "infile outfile, or indir|glob outdir, or -interface name outfile",
+	Summary: "Extract the payloads of a pcap, or its packets with -headers, into a .pkt file. With -split every conversation goes to a .pkt file of its own in the output directory. Every pcap of a directory or a glob can be extracted at once, or packets captured from a network interface.",
+	Run:     runExtract,
+}
+
+// pcapExtensions are the files picked up from directories given as input
+// to the commands that read pcaps.
+var pcapExtensions = []string{".pcap", ".pcapng", ".cap"}
+
+func addChecksumFlag(fs *flag.FlagSet) *string {
+	return fs.String("checksum", "none", "Checksum handling: none, check to report bad checksums, or fix to recompute them.")
+}
+
+// extractFlags are the flags of the commands that read pcaps.
+type extractFlags struct {
+	headers   *bool
+	link      *bool
+	decap     *string
+	protocols *string
+	keylog    *string
+	http      *bool
+	dechunk   *bool
+	dns       *bool
+}
+
+func addExtractFlags(fs *flag.FlagSet) *extractFlags {
+	return &extractFlags{
+		headers:   fs.Bool("headers", false, "Keep every packet starting at the network layer instead of only the payloads."),
+		link:      fs.Bool("link", false, "Keep the full link layer frame, implies -headers."),
+		decap:     fs.String("decap", "none", "Comma separated tunnels to decapsulate: vlan, qinq, mpls, gre, vxlan, geneve, all or none."),
+		protocols: fs.String("protocols", "tcp,udp,sctp", "Comma separated protocols to extract payloads from: tcp, udp, sctp, icmp for ping data, icmpv6, ip for any other IP protocol, or all."),
+		keylog:    fs.String("keylog", "", "NSS key log file, as written to SSLKEYLOGFILE, to decrypt the TLS sessions with. Their plaintext application data is extracted instead of the encrypted records."),
+		http:      fs.Bool("http", false, "Write a record per HTTP/1.x request or response of TCP conversations, with its method, URI, status and content type in the metadata, and list them in a manifest, name.http.csv next to the output or http.csv with -split."),
+		dechunk:   fs.Bool("dechunk", false, "With -http, decode chunked bodies and give them a Content-Length."),
+		dns:       fs.Bool("dns", false, "Pair the DNS queries and responses on port 53 by transaction ID, and write every transaction as a flow of its own, with its name, type and rcode in the metadata. They are summed up in name.dns.csv next to the output, or dns.csv with -split."),
+	}
+}
+
+func (f *extractFlags) options(checksumFlag string) (extract.Options, error) {
+	var opts extract.Options
+	var err error
+	if opts.Checksums, err = checksum.ParseMode(checksumFlag); err != nil {
+		return opts, err
+	}
+	if opts.Decap, err = extract.ParseDecap(*f.decap); err != nil {
+		return opts, err
+	}
+	if opts.Protocols, err = extract.ParseProtocols(*f.protocols); err != nil {
+		return opts, err
+	}
+	opts.LinkLayer = *f.link
+	if *f.keylog != "" {
+		if f.withHeaders() {
+			return opts, fmt.Errorf("-keylog can not be combined with -headers or -link, which keep the packets as they are")
+		}
+		kf, err := os.Open(*f.keylog)
+		if err != nil {
+			return opts, fmt.Errorf("Can't open key log: %v", err)
+		}
+		defer kf.Close()
+		if opts.KeyLog, err = extract.ReadKeyLog(kf); err != nil {
+			return opts, err
+		}
+		log.Printf("Read keys of %d TLS sessions", opts.KeyLog.Len())
+	}
+	if *f.dechunk && !*f.http {
+		return opts, fmt.Errorf("-dechunk needs -http")
+	}
+	if *f.http {
+		if f.withHeaders() {
+			return opts, fmt.Errorf("-http can not be combined with -headers or -link, which keep the packets as they are")
+		}
+		opts.HTTP = &extract.HTTPOptions{Dechunk: *f.dechunk}
+	}
+	if *f.dns {
+		if f.withHeaders() {
+			return opts, fmt.Errorf("-dns can not be combined with -headers or -link, which keep the packets as they are")
+		}
+		opts.DNS = &extract.DNSOptions{}
+	}
+	return opts, nil
+}
+
+func (f *extractFlags) withHeaders() bool {
+	return *f.headers || *f.link
+}
+
+// opener opens the input of an extraction, a pcap or a network interface.
+type opener func(input string) (*extract.Reader, io.Closer, error)
+
+// openPcap opens the pcap file input.
+func openPcap(input string) (*extract.Reader, io.Closer, error) {
+	inf, err := OpenInput(input)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Can't open input: %v", err)
+	}
+	r, err := extract.NewReader(inf)
+	if err != nil {
+		inf.Close()
+		return nil, nil, fmt.Errorf("Can't parse input as pcap file: %v", err)
+	}
+	return r, inf, nil
+}
+
+// runExtraction reads the input opened by open and writes the .pkt output
+// the way f asks for, along with its stream files if streams is set, and
+// reports on it in the stats format.
+func runExtraction(f *extractFlags, open opener, opts extract.Options, input, output, stats string, streams bool) error {
+	if SameFile(input, output) {
+		return fmt.Errorf("Input and output can not be the same file")
+	}
+	if streams && output == Stdio {
+		return fmt.Errorf("-streams needs an output file to name the stream files after")
+	}
+
+	r, inf, err := open(input)
+	if err != nil {
+		return err
+	}
+	defer inf.Close()
+
+	outf, err := CreateOutput(output)
+	if err != nil {
+		return fmt.Errorf("Can't open output: %v", err)
+	}
+	defer outf.Close()
+	var out io.Writer = outf
+	var buf bytes.Buffer
+	if streams {
+		out = io.MultiWriter(outf, &buf)
+	}
+
+	rep := newReport("extract", input, output)
+	opts.Stats = &extract.Stats{}
+	newResults(&opts)
+	if f.withHeaders() {
+		packets, err := extract.SimplifyWithHeaders(r, out, opts)
+		if err != nil {
+			return err
+		}
+		log.Printf("%d packets rewritten", packets)
+	} else {
+		totalPackets, packetsWritten, err := extract.Simplify(r, out, opts)
+		if err != nil {
+			return err
+		}
+		log.Printf("%d packets rewritten out of %d total packets", packetsWritten, totalPackets)
+	}
+	if streams && buf.Len() > 0 {
+		if err := writeStreams(buf.Bytes(), output); err != nil {
+			return err
+		}
+	}
+	if opts.HTTP != nil {
+		if output == Stdio {
+			log.Printf("%d HTTP messages written, the manifest needs an output file to be named after", len(opts.HTTP.Messages))
+		} else if err := writeHTTPManifest(output+httpManifestExt, opts.HTTP.Messages); err != nil {
+			return err
+		}
+	}
+	if opts.DNS != nil {
+		if output == Stdio {
+			log.Printf("%d DNS transactions written, the summary needs an output file to be named after", len(opts.DNS.Transactions))
+		} else if err := writeDNSSummary(output+dnsSummaryExt, opts.DNS.Transactions); err != nil {
+			return err
+		}
+	}
+	rep.extracted(opts.Stats)
+	return rep.write(stats)
+}
+
+func runExtract(fs *flag.FlagSet, args []string) error {
+	ef := addExtractFlags(fs)
+	checksumFlag := addChecksumFlag(fs)
+	statsFlag := addStatsFlag(fs)
+	jobs := addJobsFlag(fs)
+	split := fs.Bool("split", false, "Write every conversation to a .pkt file of its own, named by its start time and five-tuple, in the output directory, along with an index.csv.")
+	idle := fs.Duration("idle", 0, "With -split, a conversation idle for longer than this ends, and a reused port pair after it starts a new file. Use 0 to never time out.")
+	streams := fs.Bool("streams", false, "Also write what each side sent as plain byte streams, name.client.bin and name.server.bin, with the record boundaries in name.offsets. build -streams turns them back into a pcap.")
+	cf := addCaptureFlags(fs)
+	if err := parseArgs(fs, args, 1, 2); err != nil {
+		return err
+	}
+	if cf.live() != (fs.NArg() == 1) {
+		return errUsage
+	}
+	if err := cf.check(); err != nil {
+		return err
+	}
+	if *split && ef.withHeaders() {
+		return fmt.Errorf("-split can not be combined with -headers or -link")
+	}
+	if *split && *streams {
+		return fmt.Errorf("-split can not be combined with -streams")
+	}
+	if err := checkStats(*statsFlag); err != nil {
+		return err
+	}
+	opts, err := ef.options(*checksumFlag)
+	if err != nil {
+		return err
+	}
+	open := openPcap
+	if cf.live() {
+		open = func(string) (*extract.Reader, io.Closer, error) {
+			return cf.open()
+		}
+	}
+	run := func(input, output string) error {
+		if *split {
+			return runSplit(open, opts, input, output, *idle, *statsFlag)
+		}
+		return runExtraction(ef, open, opts, input, output, *statsFlag, *streams)
+	}
+	if cf.live() {
+		return run(*cf.iface, fs.Arg(0))
+	}
+	if isBatch(fs.Arg(0)) {
+		// Split captures get a directory each
+		b := batch{exts: pcapExtensions, ext: ".pkt", jobs: *jobs, run: run}
+		if *split {
+			b.ext = ""
+		}
+		return b.Run(fs.Arg(0), fs.Arg(1))
+	}
+	return run(fs.Arg(0), fs.Arg(1))
+}
@@ -0,0 +1,28 @@
+package cli
+
+import (
+	"strconv"
+
+	"github.com/JustinAzoff/pcap_simplify/extract"
+)
+
+// httpManifestExt is added to the name of the output of extract -http to
+// name its manifest.
+const httpManifestExt = ".http.csv"
+
+// writeHTTPManifest lists the HTTP messages written, with the record
+// holding each.
+func writeHTTPManifest(name string, messages []extract.HTTPMessage) error {
+	var rows [][]string
+	for _, m := range messages {
+		kind, status := "response", strconv.Itoa(m.Status)
+		if m.Request {
+			kind, status = "request", ""
+		}
+		rows = append(rows, []string{
+			m.File, strconv.Itoa(m.Record), kind, m.Method, m.URI, status,
+			m.ContentType, strconv.Itoa(m.Bytes),
+		})
+	}
+	return writeCSV(name, []string{"file", "record", "type", "method", "uri", "status", "content_type", "bytes"}, rows)
+}
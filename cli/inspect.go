@@ -0,0 +1,71 @@
+package cli
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/JustinAzoff/pcap_simplify/pkt"
+)
+
+var inspectCommand = &Command{
+	Name:    "inspect",
+	Args:    "infile",
+	Summary: "Print the metadata and a summary of every record of a .pkt file.",
+	Run:     runInspect,
+}
+
+func inspect(r io.Reader, w io.Writer) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	b, err := pkt.NewReader(data)
+	if err != nil {
+		return err
+	}
+	records := 0
+	origBytes := 0
+	respBytes := 0
+	for {
+		rec, err := b.NextRecord()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if rec.IsMeta() {
+			for _, line := range strings.Split(strings.TrimSuffix(string(rec.Data), "\n"), "\n") {
+				fmt.Fprintf(w, "meta %s\n", line)
+			}
+			continue
+		}
+		direction := "resp"
+		if rec.IsOrig() {
+			direction = "orig"
+			origBytes += len(rec.Data)
+		} else {
+			respBytes += len(rec.Data)
+		}
+		fmt.Fprintf(w, "#%d %s %d bytes\n", records, direction, len(rec.Data))
+		records++
+	}
+	fmt.Fprintf(w, "%d records, %d bytes from the originator, %d bytes from the responder\n", records, origBytes, respBytes)
+	return nil
+}
+
+func runInspect(fs *flag.FlagSet, args []string) error {
+	if err := parseArgs(fs, args, 1, 1); err != nil {
+		return err
+	}
+	inf, err := OpenInput(fs.Arg(0))
+	if err != nil {
+		return fmt.Errorf("Can't open input: %v", err)
+	}
+	defer inf.Close()
+	return inspect(inf, os.Stdout)
+}
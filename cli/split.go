@@ -0,0 +1,92 @@
+package cli
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/JustinAzoff/pcap_simplify/extract"
+)
+
+// indexName is the file in a split output directory that lists the
+// conversations.
+const indexName = "index.csv"
+
+// httpManifestName is the file in a split output directory that lists the
+// HTTP messages with -http.
+const httpManifestName = "http.csv"
+
+// dnsSummaryName is the file in a split output directory that lists the
+// DNS transactions with -dns.
+const dnsSummaryName = "dns.csv"
+
+// runSplit writes every conversation of the input opened by open to a
+// .pkt file in the outdir directory, along with the index, and reports on
+// it in the stats format.
+func runSplit(open opener, opts extract.Options, input, outdir string, idle time.Duration, stats string) error {
+	if outdir == Stdio {
+		return fmt.Errorf("-split needs an output directory")
+	}
+	r, inf, err := open(input)
+	if err != nil {
+		return err
+	}
+	defer inf.Close()
+	if err := os.MkdirAll(outdir, 0755); err != nil {
+		return fmt.Errorf("Can't create output directory: %v", err)
+	}
+
+	rep := newReport("extract", input, outdir)
+	opts.Stats = &extract.Stats{}
+	newResults(&opts)
+	create := func(name string, reopen bool) (io.WriteCloser, error) {
+		if reopen {
+			return os.OpenFile(filepath.Join(outdir, name), os.O_WRONLY|os.O_APPEND, 0)
+		}
+		return os.Create(filepath.Join(outdir, name))
+	}
+	conversations, err := extract.Split(r, create, idle, opts)
+	if err != nil {
+		return err
+	}
+	if err := writeIndex(filepath.Join(outdir, indexName), input, conversations); err != nil {
+		return err
+	}
+	if opts.HTTP != nil {
+		if err := writeHTTPManifest(filepath.Join(outdir, httpManifestName), opts.HTTP.Messages); err != nil {
+			return err
+		}
+	}
+	if opts.DNS != nil {
+		if err := writeDNSSummary(filepath.Join(outdir, dnsSummaryName), opts.DNS.Transactions); err != nil {
+			return err
+		}
+	}
+	log.Printf("%d conversations written to %s", len(conversations), outdir)
+	rep.extracted(opts.Stats)
+	rep.Flows = len(conversations)
+	return rep.write(stats)
+}
+
+// writeIndex lists the conversations written from capture, with where
+// they are found in it.
+func writeIndex(name, capture string, conversations []*extract.Conversation) error {
+	var rows [][]string
+	for _, c := range conversations {
+		rows = append(rows, []string{
+			c.Name, capture, strconv.Itoa(c.FirstPacket), strconv.Itoa(c.LastPacket),
+			c.Start.UTC().Format(time.RFC3339Nano), c.End.UTC().Format(time.RFC3339Nano),
+			c.Proto, c.Client, c.ClientPort, c.Server, c.ServerPort,
+			strconv.Itoa(c.Packets), strconv.Itoa(c.ClientBytes), strconv.Itoa(c.ServerBytes),
+		})
+	}
+	return writeCSV(name, []string{
+		"file", "capture", "first_packet", "last_packet", "start", "end",
+		"proto", "client", "client_port", "server", "server_port",
+		"packets", "client_bytes", "server_bytes",
+	}, rows)
+}
@@ -0,0 +1,167 @@
+package cli
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/JustinAzoff/pcap_simplify/build"
+	"github.com/JustinAzoff/pcap_simplify/extract"
+	"github.com/JustinAzoff/pcap_simplify/pkt"
+)
+
+func addStatsFlag(fs *flag.FlagSet) *string {
+	return fs.String("stats", "text", "How to report what was done: text for a log line, or json for a summary on stdout, or on stderr when the output goes to stdout.")
+}
+
+func checkStats(format string) error {
+	switch format {
+	case "text", "json":
+		return nil
+	}
+	return fmt.Errorf("Invalid stats format %q, expected text or json", format)
+}
+
+// report is the summary written by -stats json. Every key is always
+// present so batch jobs don't have to guess, the counts that don't apply
+// to the command are 0 and the durations null.
+type report struct {
+	Command string `json:"command"`
+	Input   string `json:"input"`
+	Output  string `json:"output"`
+
+	// PacketsRead to Flows describe the pcap that was extracted
+	PacketsRead    int            `json:"packets_read"`
+	PacketsWritten int            `json:"packets_written"`
+	Skipped        map[string]int `json:"skipped"`
+	Flows          int            `json:"flows"`
+
+	// Records and the bytes describe the .pkt data
+	Records        int `json:"records"`
+	ClientToServer int `json:"client_to_server_bytes"`
+	ServerToClient int `json:"server_to_client_bytes"`
+
+	// SegmentsGenerated is the number of packets a build wrote
+	SegmentsGenerated int `json:"segments_generated"`
+
+	InputDuration  *float64 `json:"input_duration_seconds"`
+	OutputDuration *float64 `json:"output_duration_seconds"`
+	// TimingDistortion is how much longer the output lasts than the
+	// input, when both are known
+	TimingDistortion *float64 `json:"timing_distortion_seconds"`
+
+	input time.Duration
+}
+
+func newReport(command, input, output string) *report {
+	return &report{Command: command, Input: input, Output: output, Skipped: map[string]int{}}
+}
+
+func seconds(d time.Duration) *float64 {
+	s := d.Seconds()
+	return &s
+}
+
+// extracted adds the counts of an extraction.
+func (r *report) extracted(s *extract.Stats) {
+	r.PacketsRead = s.PacketsRead
+	r.PacketsWritten = s.PacketsWritten
+	for reason, n := range s.Skipped {
+		r.Skipped[reason] = n
+	}
+	r.Flows = s.Flows
+	r.Records = s.PacketsWritten
+	r.ClientToServer = s.OrigBytes
+	r.ServerToClient = s.RespBytes
+	if s.PacketsRead > 0 {
+		r.input = s.Duration()
+		r.InputDuration = seconds(r.input)
+	}
+}
+
+// records adds the counts of .pkt data about to be built. Scenarios and
+// data that doesn't parse are left to the builder.
+func (r *report) records(data []byte) {
+	if build.IsScenario(data) {
+		return
+	}
+	pr, err := pkt.NewReader(data)
+	if err != nil {
+		return
+	}
+	for {
+		isOrig, payload, err := pr.Next()
+		if err != nil {
+			return
+		}
+		r.Records++
+		if isOrig {
+			r.ClientToServer += len(payload)
+		} else {
+			r.ServerToClient += len(payload)
+		}
+	}
+}
+
+// built adds the counts of a build.
+func (r *report) built(records int, s *build.Stats) {
+	r.Records = records
+	r.SegmentsGenerated = s.Packets
+	if s.Packets > 0 {
+		r.OutputDuration = seconds(s.Duration())
+	}
+	if r.InputDuration != nil && r.OutputDuration != nil {
+		r.TimingDistortion = seconds(s.Duration() - r.input)
+	}
+}
+
+// reportMu keeps the reports of a batch from mixing.
+var reportMu sync.Mutex
+
+// write writes the report in json format. The output of the command may
+// be going to stdout, in which case the report goes to stderr.
+func (r *report) write(format string) error {
+	if format != "json" {
+		return nil
+	}
+	var w io.Writer = os.Stdout
+	if r.Output == Stdio {
+		w = os.Stderr
+	}
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	reportMu.Lock()
+	defer reportMu.Unlock()
+	_, err = fmt.Fprintf(w, "%s\n", data)
+	return err
+}
+
+// countPcap counts the packets of a pcap file written by someone else,
+// tcpdump in udp mode.
+func countPcap(name string, stats *build.Stats) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r, err := extract.NewReader(f)
+	if err != nil {
+		return err
+	}
+	for {
+		_, ci, err := r.ReadPacketData()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		stats.Add(ci)
+	}
+}
@@ -0,0 +1,64 @@
+package cli
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/JustinAzoff/pcap_simplify/pkt"
+)
+
+// streamFiles names the client and server streams and the offsets file
+// that go with the .pkt file name, or with the offsets file name itself.
+func streamFiles(name string) (client, server, offsets string) {
+	base := strings.TrimSuffix(name, filepath.Ext(name))
+	return base + ".client.bin", base + ".server.bin", base + ".offsets"
+}
+
+// writeStreams writes the .pkt data as the stream files of output.
+func writeStreams(data []byte, output string) error {
+	if output == Stdio {
+		return fmt.Errorf("-streams needs an output file to name the stream files after")
+	}
+	var client, server, offsets bytes.Buffer
+	if err := pkt.SplitStreams(data, &client, &server, &offsets); err != nil {
+		return err
+	}
+	clientName, serverName, offsetsName := streamFiles(output)
+	for name, buf := range map[string]*bytes.Buffer{clientName: &client, serverName: &server, offsetsName: &offsets} {
+		if err := ioutil.WriteFile(name, buf.Bytes(), 0644); err != nil {
+			return fmt.Errorf("Can't write stream file: %v", err)
+		}
+	}
+	return nil
+}
+
+// readStreams joins the stream files named after the offsets file input
+// back into .pkt data.
+func readStreams(input string) ([]byte, error) {
+	if input == Stdio {
+		return nil, fmt.Errorf("-streams needs the offsets file as input, to find the stream files next to it")
+	}
+	clientName, serverName, offsetsName := streamFiles(input)
+	client, err := ioutil.ReadFile(clientName)
+	if err != nil {
+		return nil, fmt.Errorf("Can't open input: %v", err)
+	}
+	server, err := ioutil.ReadFile(serverName)
+	if err != nil {
+		return nil, fmt.Errorf("Can't open input: %v", err)
+	}
+	offsets, err := os.Open(offsetsName)
+	if err != nil {
+		return nil, fmt.Errorf("Can't open input: %v", err)
+	}
+	defer offsets.Close()
+	var buf bytes.Buffer
+	if err := pkt.JoinStreams(client, server, offsets, &buf); err != nil {
+		return nil, fmt.Errorf("%s: %v", offsetsName, err)
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,88 @@
+package cli
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/JustinAzoff/pcap_simplify/pkt"
+)
+
+var dumpCommand = &Command{
+	Name:    "dump",
+	Args:    "infile [outfile]",
+	Summary: "Write a .pkt file as text that can be edited and turned back into a .pkt file with compile.",
+	Run:     runDump,
+}
+
+var compileCommand = &Command{
+	Name:    "compile",
+	Args:    "infile outfile",
+	Summary: "Turn the text written by dump back into a .pkt file.",
+	Run:     runCompile,
+}
+
+func runDump(fs *flag.FlagSet, args []string) error {
+	forceHex := fs.Bool("hex", false, "Write every record as a hexdump, even if it is printable.")
+	if err := parseArgs(fs, args, 1, 2); err != nil {
+		return err
+	}
+	input := fs.Arg(0)
+	output := Stdio
+	if fs.NArg() == 2 {
+		output = fs.Arg(1)
+	}
+	if SameFile(input, output) {
+		return fmt.Errorf("Input and output can not be the same file")
+	}
+
+	inf, err := OpenInput(input)
+	if err != nil {
+		return fmt.Errorf("Can't open input: %v", err)
+	}
+	defer inf.Close()
+	//just slurp it up
+	data, err := ioutil.ReadAll(inf)
+	if err != nil {
+		return fmt.Errorf("Can't read input: %v", err)
+	}
+
+	outf, err := CreateOutput(output)
+	if err != nil {
+		return fmt.Errorf("Can't open output: %v", err)
+	}
+	defer outf.Close()
+	return pkt.Dump(outf, data, *forceHex)
+}
+
+func runCompile(fs *flag.FlagSet, args []string) error {
+	if err := parseArgs(fs, args, 2, 2); err != nil {
+		return err
+	}
+	input, output := fs.Arg(0), fs.Arg(1)
+	if SameFile(input, output) {
+		return fmt.Errorf("Input and output can not be the same file")
+	}
+
+	inf, err := OpenInput(input)
+	if err != nil {
+		return fmt.Errorf("Can't open input: %v", err)
+	}
+	defer inf.Close()
+
+	// Compile everything before creating the output, so a typo doesn't
+	// leave a half written .pkt file behind
+	var buf bytes.Buffer
+	if err := pkt.Compile(inf, &buf); err != nil {
+		return err
+	}
+
+	outf, err := CreateOutput(output)
+	if err != nil {
+		return fmt.Errorf("Can't open output: %v", err)
+	}
+	defer outf.Close()
+	_, err = buf.WriteTo(outf)
+	return err
+}
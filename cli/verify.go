@@ -0,0 +1,143 @@
+package cli
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/JustinAzoff/pcap_simplify/build"
+	"github.com/JustinAzoff/pcap_simplify/checksum"
+	"github.com/JustinAzoff/pcap_simplify/extract"
+	"github.com/JustinAzoff/pcap_simplify/pkt"
+)
+
+var verifyCommand = &Command{
+	Name:    "verify",
+	Args:    "original.pcap [rebuilt.pcap]",
+	Summary: "Check that rebuilding a pcap keeps the data each side sent. Without rebuilt.pcap the pcap is rebuilt in memory first. Exits with status 1 if anything differs.",
+	Run:     runVerify,
+}
+
+// errMismatch is returned by verify when the streams differ, after the
+// differences were printed.
+var errMismatch = errors.New("Rebuilt pcap does not match the original")
+
+func readPcap(name string) ([]byte, error) {
+	inf, err := OpenInput(name)
+	if err != nil {
+		return nil, fmt.Errorf("Can't open input: %v", err)
+	}
+	defer inf.Close()
+	//just slurp it up
+	return ioutil.ReadAll(inf)
+}
+
+// payloads extracts the payload streams of the pcap in data to a .pkt file.
+func payloads(data []byte, decap extract.Decap) ([]byte, error) {
+	r, err := extract.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("Can't parse input as pcap file: %v", err)
+	}
+	var buf bytes.Buffer
+	if _, _, err := extract.Simplify(r, &buf, extract.Options{Decap: decap}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// rebuild extracts the pcap in data and builds it again in mode.
+func rebuild(data []byte, mode string, decap extract.Decap) ([]byte, error) {
+	r, err := extract.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("Can't parse input as pcap file: %v", err)
+	}
+	var extracted, rebuilt bytes.Buffer
+	opts := extract.Options{Decap: decap}
+	switch mode {
+	case "tcp":
+		if _, _, err := extract.Simplify(r, &extracted, opts); err != nil {
+			return nil, err
+		}
+		handle, err := build.NewPcapPacketWriter(nopWriteCloser{&rebuilt})
+		if err != nil {
+			return nil, err
+		}
+		_, err = build.ExpandTCP(&extracted, handle, 80)
+		if cerr := handle.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return nil, err
+		}
+	case "raw", "headers":
+		if _, err := extract.SimplifyWithHeaders(r, &extracted, opts); err != nil {
+			return nil, err
+		}
+		if mode == "raw" {
+			_, err = build.ExpandRaw(&extracted, &rebuilt, build.FileOptions{})
+		} else {
+			_, err = build.ExpandWithHeaders(&extracted, &rebuilt, 0, checksum.None, build.FileOptions{})
+		}
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("Invalid mode %q, expected tcp, raw or headers. Rebuild udp with build and pass the result as rebuilt.pcap", mode)
+	}
+	return rebuilt.Bytes(), nil
+}
+
+func runVerify(fs *flag.FlagSet, args []string) error {
+	mode := fs.String("mode", "tcp", "How to rebuild the pcap when rebuilt.pcap is not given: tcp, raw or headers.")
+	decapFlag := fs.String("decap", "none", "Comma separated tunnels to decapsulate in the original pcap: vlan, qinq, mpls, gre, vxlan, geneve, all or none.")
+	if err := parseArgs(fs, args, 1, 2); err != nil {
+		return err
+	}
+	decap, err := extract.ParseDecap(*decapFlag)
+	if err != nil {
+		return err
+	}
+
+	original, err := readPcap(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	var rebuilt []byte
+	if fs.NArg() == 2 {
+		rebuilt, err = readPcap(fs.Arg(1))
+	} else {
+		rebuilt, err = rebuild(original, *mode, decap)
+	}
+	if err != nil {
+		return err
+	}
+
+	want, err := payloads(original, decap)
+	if err != nil {
+		return err
+	}
+	// Tunnels are not rebuilt, so there is nothing to peel from the rebuilt pcap
+	got, err := payloads(rebuilt, extract.Decap{})
+	if err != nil {
+		return fmt.Errorf("Rebuilt pcap: %v", err)
+	}
+	if len(want) == 0 {
+		return fmt.Errorf("Nothing was extracted from %s", fs.Arg(0))
+	}
+
+	c, err := pkt.Compare(want, got)
+	if err != nil {
+		return err
+	}
+	for _, d := range c.Divergences {
+		fmt.Fprintln(os.Stdout, d)
+	}
+	if len(c.Divergences) > 0 {
+		return errMismatch
+	}
+	fmt.Fprintf(os.Stdout, "OK: %d bytes from the client and %d bytes from the server match\n", c.OrigBytes, c.RespBytes)
+	return nil
+}
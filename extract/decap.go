@@ -0,0 +1,232 @@
+package extract
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// LayerTypeQinQ stands for the outer, service, tags of QinQ frames in a
+// Decap. gopacket decodes them as layers.Dot1Q just like the customer tags
+// they carry, only the EtherType 0x88a8 before them tells them apart.
+var LayerTypeQinQ = gopacket.RegisterLayerType(1277, gopacket.LayerTypeMetadata{Name: "QinQ"})
+
+// tunnelNames maps the names accepted by ParseDecap to the layers they peel.
+var tunnelNames = map[string]gopacket.LayerType{
+	"vlan":   layers.LayerTypeDot1Q,
+	"qinq":   LayerTypeQinQ,
+	"mpls":   layers.LayerTypeMPLS,
+	"gre":    layers.LayerTypeGRE,
+	"vxlan":  layers.LayerTypeVXLAN,
+	"geneve": layers.LayerTypeGeneve,
+}
+
+// Tunnel is one layer of encapsulation found in a packet.
+type Tunnel struct {
+	Type string
+	// ID is the VLAN id, MPLS label, GRE key or VNI, if the tunnel has one
+	ID    uint32
+	HasID bool
+}
+
+func (t Tunnel) String() string {
+	if t.HasID {
+		return fmt.Sprintf("%s:%d", t.Type, t.ID)
+	}
+	return t.Type
+}
+
+// Tunnels formats a tunnel stack, outermost first, for the .pkt metadata.
+func Tunnels(tunnels []Tunnel) string {
+	s := make([]string, len(tunnels))
+	for i, t := range tunnels {
+		s[i] = t.String()
+	}
+	return strings.Join(s, ",")
+}
+
+// Decap is the set of encapsulations that should be peeled off packets to
+// get at the innermost flow.
+type Decap map[gopacket.LayerType]bool
+
+// ParseDecap parses a comma separated list of tunnel types, as given to the
+// -decap flag. "all" enables every type and "none" or "" disables
+// decapsulation.
+func ParseDecap(s string) (Decap, error) {
+	d := Decap{}
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(strings.ToLower(name))
+		switch name {
+		case "", "none":
+			continue
+		case "all":
+			for _, lt := range tunnelNames {
+				d[lt] = true
+			}
+			continue
+		}
+		lt, ok := tunnelNames[name]
+		if !ok {
+			return nil, fmt.Errorf("Unknown tunnel type %q, expected one of vlan, qinq, mpls, gre, vxlan, geneve, all or none", name)
+		}
+		d[lt] = true
+	}
+	return d, nil
+}
+
+// serviceTag reports whether prev says the layer after it is the service
+// tag of a QinQ frame.
+func serviceTag(prev gopacket.Layer) bool {
+	switch prev := prev.(type) {
+	case *layers.Ethernet:
+		return prev.EthernetType == layers.EthernetTypeQinQ
+	case *layers.LinuxSLL:
+		return prev.EthernetType == layers.EthernetTypeQinQ
+	case *layers.Dot1Q:
+		return prev.Type == layers.EthernetTypeQinQ
+	}
+	return false
+}
+
+// tunnel returns the tunnel l is, and the layer type that enables it in a
+// Decap, prev being the layer before it.
+func tunnel(l, prev gopacket.Layer) (Tunnel, gopacket.LayerType, bool) {
+	t, ok := tunnelOf(l)
+	if !ok {
+		return t, 0, false
+	}
+	if t.Type == "vlan" && serviceTag(prev) {
+		t.Type = "qinq"
+		return t, LayerTypeQinQ, true
+	}
+	return t, l.LayerType(), true
+}
+
+func tunnelOf(l gopacket.Layer) (Tunnel, bool) {
+	switch l := l.(type) {
+	case *layers.Dot1Q:
+		return Tunnel{Type: "vlan", ID: uint32(l.VLANIdentifier), HasID: true}, true
+	case *layers.MPLS:
+		return Tunnel{Type: "mpls", ID: l.Label, HasID: true}, true
+	case *layers.GRE:
+		return Tunnel{Type: "gre", ID: l.Key, HasID: l.KeyPresent}, true
+	case *layers.VXLAN:
+		return Tunnel{Type: "vxlan", ID: l.VNI, HasID: l.ValidIDFlag}, true
+	case *layers.Geneve:
+		return Tunnel{Type: "geneve", ID: l.VNI, HasID: true}, true
+	}
+	return Tunnel{}, false
+}
+
+// Layers returns the network and transport layers of the innermost flow
+// in packet along with the tunnels that were peeled to reach it.
+//
+// VLAN and QinQ tags and MPLS labels sit below the outermost network layer, so they
+// never hide the flow, enabling them only records them. GRE, VXLAN and
+// GENEVE carry a whole second packet, and without decapsulation the outer
+// flow is returned. Either layer may be nil.
+func (d Decap) Layers(packet gopacket.Packet) (gopacket.NetworkLayer, gopacket.TransportLayer, []Tunnel) {
+	var nl gopacket.NetworkLayer
+	var tl gopacket.TransportLayer
+	var tunnels []Tunnel
+	failed := packet.ErrorLayer() != nil
+	all := packet.Layers()
+	for i, l := range all {
+		var prev gopacket.Layer
+		if i > 0 {
+			prev = all[i-1]
+		}
+		if t, kind, ok := tunnel(l, prev); ok {
+			if !d[kind] {
+				if nl != nil {
+					// Don't look inside a tunnel we weren't asked to peel
+					break
+				}
+				continue
+			}
+			tunnels = append(tunnels, t)
+			if nl != nil {
+				// Everything up to here belonged to the outer packet
+				nl = nil
+				tl = nil
+			}
+			continue
+		}
+		if !decoded(l, failed) {
+			continue
+		}
+		switch l := l.(type) {
+		case gopacket.NetworkLayer:
+			if nl != nil {
+				// IP in IP or an ICMP error quoting the original packet
+				return nl, tl, tunnels
+			}
+			nl = l
+		case gopacket.TransportLayer:
+			if tl == nil {
+				tl = l
+			}
+		}
+	}
+	return nl, tl, tunnels
+}
+
+// decoded reports whether l decoded properly. gopacket adds IP, TCP and
+// UDP layers to the packet even when decoding them failed, and only the
+// DecodeFailure layer after them tells, which is also what a failure in
+// the next layer looks like. So when the packet failed to decode the
+// layer is decoded again on its own. Nothing checks the IP version when
+// the link layer says which one to expect.
+func decoded(l gopacket.Layer, failed bool) bool {
+	var d gopacket.DecodingLayer
+	switch l := l.(type) {
+	case *layers.IPv4:
+		if l.Version != 4 {
+			return false
+		}
+		d = &layers.IPv4{}
+	case *layers.IPv6:
+		if l.Version != 6 {
+			return false
+		}
+		d = &layers.IPv6{}
+	case *layers.TCP:
+		d = &layers.TCP{}
+	case *layers.UDP:
+		d = &layers.UDP{}
+	default:
+		return !failed || len(l.LayerContents()) > 0
+	}
+	if !failed {
+		return true
+	}
+	return d.DecodeFromBytes(layerData(l), gopacket.NilDecodeFeedback) == nil
+}
+
+// layerData returns the header of l followed by everything it carries.
+// gopacket leaves the hop-by-hop options of IPv6 out of both the contents
+// and the payload of the IPv6 layer.
+func layerData(l gopacket.Layer) []byte {
+	var hopByHop []byte
+	if ip6, ok := l.(*layers.IPv6); ok && ip6.HopByHop != nil {
+		hopByHop = ip6.HopByHop.Contents
+	}
+	data := make([]byte, 0, len(l.LayerContents())+len(hopByHop)+len(l.LayerPayload()))
+	data = append(data, l.LayerContents()...)
+	data = append(data, hopByHop...)
+	return append(data, l.LayerPayload()...)
+}
+
+// NetworkOffset returns where nl starts inside the data of packet.
+func NetworkOffset(packet gopacket.Packet, nl gopacket.NetworkLayer) int {
+	offset := 0
+	for _, l := range packet.Layers() {
+		if l == nl {
+			break
+		}
+		offset += len(l.LayerContents())
+	}
+	return offset
+}
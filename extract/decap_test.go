@@ -0,0 +1,134 @@
+package extract
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+func serializeLayers(t *testing.T, ls ...gopacket.SerializableLayer) []byte {
+	t.Helper()
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, ls...); err != nil {
+		t.Fatal(err)
+	}
+	return append([]byte{}, buf.Bytes()...)
+}
+
+var (
+	innerMAC = net.HardwareAddr{0, 0, 0, 0, 0, 1}
+	outerMAC = net.HardwareAddr{0, 0, 0, 0, 0, 2}
+)
+
+// tunnelFrame returns an Ethernet frame of the given type carrying the
+// tunnel layers, which end with the inner packet: UDP from 10.0.0.1 port
+// 1000 to 10.0.0.2 port 2000 carrying "inner".
+func tunnelFrame(t *testing.T, etherType layers.EthernetType, tunnel ...gopacket.SerializableLayer) []byte {
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: net.IPv4(10, 0, 0, 1), DstIP: net.IPv4(10, 0, 0, 2)}
+	udp := &layers.UDP{SrcPort: 1000, DstPort: 2000}
+	udp.SetNetworkLayerForChecksum(ip)
+	eth := &layers.Ethernet{SrcMAC: outerMAC, DstMAC: innerMAC, EthernetType: etherType}
+	ls := append([]gopacket.SerializableLayer{eth}, tunnel...)
+	return serializeLayers(t, append(ls, ip, udp, gopacket.Payload("inner"))...)
+}
+
+// outerUDP returns the layers of a UDP packet between 192.0.2.1 and
+// 192.0.2.2 to port, for VXLAN and GENEVE.
+func outerUDP(port layers.UDPPort) []gopacket.SerializableLayer {
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: net.IPv4(192, 0, 2, 1), DstIP: net.IPv4(192, 0, 2, 2)}
+	udp := &layers.UDP{SrcPort: 50000, DstPort: port}
+	udp.SetNetworkLayerForChecksum(ip)
+	return []gopacket.SerializableLayer{ip, udp}
+}
+
+// innerEthernet is the Ethernet header of the frame carried by VXLAN and
+// GENEVE.
+func innerEthernet() *layers.Ethernet {
+	return &layers.Ethernet{SrcMAC: innerMAC, DstMAC: outerMAC, EthernetType: layers.EthernetTypeIPv4}
+}
+
+func TestDecapTunnels(t *testing.T) {
+	greIP := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolGRE, SrcIP: net.IPv4(192, 0, 2, 1), DstIP: net.IPv4(192, 0, 2, 2)}
+	// GENEVE without options carrying Ethernet, VNI 43
+	geneve := gopacket.Payload{0, 0, 0x65, 0x58, 0, 0, 43, 0}
+
+	frames := map[string][]byte{
+		"vlan": tunnelFrame(t, layers.EthernetTypeDot1Q,
+			&layers.Dot1Q{VLANIdentifier: 10, Type: layers.EthernetTypeIPv4}),
+		"qinq": tunnelFrame(t, layers.EthernetTypeQinQ,
+			&layers.Dot1Q{VLANIdentifier: 100, Type: layers.EthernetTypeDot1Q},
+			&layers.Dot1Q{VLANIdentifier: 10, Type: layers.EthernetTypeIPv4}),
+		"mpls": tunnelFrame(t, layers.EthernetTypeMPLSUnicast,
+			&layers.MPLS{Label: 16, StackBottom: true, TTL: 64}),
+		"gre": tunnelFrame(t, layers.EthernetTypeIPv4,
+			greIP, &layers.GRE{KeyPresent: true, Key: 7, Protocol: layers.EthernetTypeIPv4}),
+		"vxlan": tunnelFrame(t, layers.EthernetTypeIPv4,
+			append(outerUDP(4789), &layers.VXLAN{ValidIDFlag: true, VNI: 42}, innerEthernet())...),
+		"geneve": tunnelFrame(t, layers.EthernetTypeIPv4,
+			append(outerUDP(6081), geneve, innerEthernet())...),
+	}
+
+	for _, tt := range []struct {
+		frame   string
+		decap   string
+		inner   bool
+		tunnels string
+	}{
+		{"vlan", "vlan", true, "vlan:10"},
+		{"vlan", "none", true, ""},
+		{"qinq", "qinq,vlan", true, "qinq:100,vlan:10"},
+		{"qinq", "vlan", true, "vlan:10"},
+		{"qinq", "qinq", true, "qinq:100"},
+		{"mpls", "mpls", true, "mpls:16"},
+		{"gre", "gre", true, "gre:7"},
+		{"gre", "none", false, ""},
+		{"vxlan", "vxlan", true, "vxlan:42"},
+		{"vxlan", "gre", false, ""},
+		{"geneve", "geneve", true, "geneve:43"},
+		{"geneve", "all", true, "geneve:43"},
+	} {
+		var file bytes.Buffer
+		pw := pcapgo.NewWriter(&file)
+		if err := pw.WriteFileHeader(65536, layers.LinkTypeEthernet); err != nil {
+			t.Fatal(err)
+		}
+		data := frames[tt.frame]
+		ci := gopacket.CaptureInfo{Timestamp: time.Unix(1600000000, 0), CaptureLength: len(data), Length: len(data)}
+		if err := pw.WritePacket(ci, data); err != nil {
+			t.Fatal(err)
+		}
+		r, err := NewReader(bytes.NewReader(file.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		decap, err := ParseDecap(tt.decap)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out bytes.Buffer
+		// Without decapsulation GRE is written as a raw IP protocol
+		if _, _, err := Simplify(r, &out, Options{Decap: decap, Protocols: Protocols{ProtoUDP: true, ProtoIP: true}}); err != nil {
+			t.Fatal(err)
+		}
+		b, records := readRecords(t, out.Bytes())
+		if len(records) != 1 {
+			t.Errorf("%s with -decap %s: %d records, expected 1", tt.frame, tt.decap, len(records))
+			continue
+		}
+		if inner := string(records[0]) == "inner"; inner != tt.inner {
+			t.Errorf("%s with -decap %s: record %q", tt.frame, tt.decap, records[0])
+		}
+		if b.Metadata["tunnels"] != tt.tunnels {
+			t.Errorf("%s with -decap %s: tunnels %q, expected %q", tt.frame, tt.decap, b.Metadata["tunnels"], tt.tunnels)
+		}
+		if tt.inner && (b.Metadata["orig_addr"] != "10.0.0.1" || b.Metadata["resp_port"] != "2000") {
+			t.Errorf("%s with -decap %s: flow %v", tt.frame, tt.decap, b.Metadata)
+		}
+	}
+}
@@ -0,0 +1,258 @@
+package extract
+
+import (
+	"container/list"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"strconv"
+
+	"github.com/JustinAzoff/pcap_simplify/pkt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// DNSOptions makes Simplify and Split pair the DNS queries and responses
+// on port 53 of UDP and TCP by their transaction ID and five-tuple, and
+// write every transaction as a flow of its own: the query from the
+// originator followed by its response. Every message comes with dns_id,
+// dns_name, dns_type and dns_rcode metadata. Messages over TCP keep their
+// length prefix. Queries that are never answered are written at the end,
+// and responses to a query that was not seen on their own.
+type DNSOptions struct {
+	// Transactions is filled with every transaction written, in order
+	Transactions []DNSTransaction
+}
+
+// DNSTransaction is an entry of the summary of the DNS transactions
+// written.
+type DNSTransaction struct {
+	// File is the .pkt file of the transaction with Split, and empty with
+	// Simplify
+	File string
+	// Record is the number of the record holding the first message of
+	// the transaction in its file, counting from 1
+	Record int
+	Proto  string
+	ID     uint16
+	// Name and Type are those of the first question
+	Name string
+	Type string
+	// Rcode is the response code, empty if no response was seen
+	Rcode   string
+	Answers int
+	// Query and Response tell which messages of the transaction were seen
+	Query    bool
+	Response bool
+}
+
+// dnsMetadata are the keys of the metadata of DNS messages.
+var dnsMetadata = []string{"dns_id", "dns_name", "dns_type", "dns_rcode"}
+
+// dnsPort is the port DNS messages are recognized by.
+const dnsPort = "53"
+
+// dnsRcodes are the mnemonics of the response codes that fit in the
+// header, see RFC 6895.
+var dnsRcodes = []string{"NOERROR", "FORMERR", "SERVFAIL", "NXDOMAIN", "NOTIMP", "REFUSED", "YXDOMAIN", "YXRRSET", "NXRRSET", "NOTAUTH", "NOTZONE"}
+
+func dnsRcode(rcode layers.DNSResponseCode) string {
+	if int(rcode) < len(dnsRcodes) {
+		return dnsRcodes[rcode]
+	}
+	return fmt.Sprintf("RCODE%d", rcode)
+}
+
+func dnsType(t layers.DNSType) string {
+	if s := t.String(); s != "Unknown" {
+		return s
+	}
+	return fmt.Sprintf("TYPE%d", t)
+}
+
+// isDNS is whether p goes to or comes from the DNS port.
+func isDNS(p transportPacket) bool {
+	return (p.proto == ProtoUDP || p.proto == ProtoTCP) && (p.src == dnsPort || p.dst == dnsPort)
+}
+
+// dnsMessage is a DNS message and the packet that completed it.
+type dnsMessage struct {
+	p transportPacket
+	// wire is the message as sent, with its length prefix over TCP
+	wire []byte
+	dns  *layers.DNS
+}
+
+// meta adds the DNS metadata of m to base.
+func (m *dnsMessage) meta(base pkt.Metadata) pkt.Metadata {
+	base["dns_id"] = strconv.Itoa(int(m.dns.ID))
+	base["dns_name"], base["dns_type"], base["dns_rcode"] = "", "", ""
+	if len(m.dns.Questions) > 0 {
+		base["dns_name"] = string(m.dns.Questions[0].Name)
+		base["dns_type"] = dnsType(m.dns.Questions[0].Type)
+	}
+	if m.dns.QR {
+		base["dns_rcode"] = dnsRcode(m.dns.ResponseCode)
+	}
+	return base
+}
+
+// dnsExchange is a DNS transaction, a query and its response, either of
+// which may be missing.
+type dnsExchange struct {
+	key      string
+	query    *dnsMessage
+	response *dnsMessage
+}
+
+// messages returns the messages of x that were seen, the query first.
+func (x *dnsExchange) messages() []*dnsMessage {
+	var msgs []*dnsMessage
+	for _, m := range []*dnsMessage{x.query, x.response} {
+		if m != nil {
+			msgs = append(msgs, m)
+		}
+	}
+	return msgs
+}
+
+// client returns the address and port the query came from.
+func (x *dnsExchange) client() (string, string) {
+	if x.query != nil {
+		return x.query.p.nl.NetworkFlow().Src().String(), x.query.p.src
+	}
+	return x.response.p.nl.NetworkFlow().Dst().String(), x.response.p.dst
+}
+
+// server returns the address and port the query went to.
+func (x *dnsExchange) server() (string, string) {
+	if x.query != nil {
+		return x.query.p.nl.NetworkFlow().Dst().String(), x.query.p.dst
+	}
+	return x.response.p.nl.NetworkFlow().Src().String(), x.response.p.src
+}
+
+// add lists x in the summary, record being the number of the record of
+// its first message.
+func (o *DNSOptions) add(file string, record int, x *dnsExchange) {
+	first := x.messages()[0]
+	t := DNSTransaction{
+		File:     file,
+		Record:   record,
+		Proto:    first.p.proto,
+		ID:       first.dns.ID,
+		Query:    x.query != nil,
+		Response: x.response != nil,
+	}
+	if len(first.dns.Questions) > 0 {
+		t.Name = string(first.dns.Questions[0].Name)
+		t.Type = dnsType(first.dns.Questions[0].Type)
+	}
+	if x.response != nil {
+		t.Rcode = dnsRcode(x.response.dns.ResponseCode)
+		t.Answers = len(x.response.dns.Answers)
+	}
+	o.Transactions = append(o.Transactions, t)
+}
+
+// dnsExtractor pairs the DNS messages of a capture.
+type dnsExtractor struct {
+	// streams and buffers hold what each direction of a TCP connection
+	// sent that is not a whole message yet, by flow, until it is closed
+	streams map[string]*tcpStream
+	buffers map[string][]byte
+	// pending are the queries waiting for their response, by transaction,
+	// and order holds them in the order they came
+	pending map[string]*list.Element
+	order   *list.List
+}
+
+func newDNSExtractor() *dnsExtractor {
+	return &dnsExtractor{
+		streams: map[string]*tcpStream{},
+		buffers: map[string][]byte{},
+		pending: map[string]*list.Element{},
+		order:   list.New(),
+	}
+}
+
+// packet returns the transactions that the messages of p complete.
+func (d *dnsExtractor) packet(p transportPacket) []*dnsExchange {
+	if p.proto != ProtoTCP {
+		return d.message(p, p.payload, p.payload)
+	}
+	flow := p.flow()
+	s := d.streams[flow]
+	if s == nil {
+		s = &tcpStream{}
+		d.streams[flow] = s
+	}
+	buf := append(d.buffers[flow], s.add(p.seq, p.payload)...)
+	var done []*dnsExchange
+	for len(buf) >= 2 {
+		end := 2 + int(binary.BigEndian.Uint16(buf))
+		if len(buf) < end {
+			break
+		}
+		wire := append([]byte{}, buf[:end]...)
+		done = append(done, d.message(p, wire, wire[2:])...)
+		buf = buf[end:]
+	}
+	d.buffers[flow] = append([]byte{}, buf...)
+	// Nothing comes after a FIN in its direction, nor after a RST in
+	// either
+	if p.fin || p.rst {
+		delete(d.streams, flow)
+		delete(d.buffers, flow)
+	}
+	if p.rst {
+		delete(d.streams, p.reverseFlow())
+		delete(d.buffers, p.reverseFlow())
+	}
+	return done
+}
+
+// message pairs a DNS message, returning the transactions it completes: its
+// own if it is a response, or the unanswered one it replaces if it is a
+// query reusing the ID of another.
+func (d *dnsExtractor) message(p transportPacket, wire, data []byte) []*dnsExchange {
+	dns := &layers.DNS{}
+	if err := dns.DecodeFromBytes(data, gopacket.NilDecodeFeedback); err != nil {
+		log.Printf("Packet %d: skipping what is not a DNS message: %v", p.n, err)
+		return nil
+	}
+	m := &dnsMessage{p: p, wire: wire, dns: dns}
+	key := p.conversation() + " " + strconv.Itoa(int(dns.ID))
+	var old *dnsExchange
+	if e := d.pending[key]; e != nil {
+		old = d.order.Remove(e).(*dnsExchange)
+		delete(d.pending, key)
+	}
+	if !dns.QR {
+		x := &dnsExchange{key: key, query: m}
+		d.pending[key] = d.order.PushBack(x)
+		if old != nil {
+			return []*dnsExchange{old}
+		}
+		return nil
+	}
+	if old == nil {
+		return []*dnsExchange{{key: key, response: m}}
+	}
+	old.response = m
+	return []*dnsExchange{old}
+}
+
+// close returns the queries that were never answered, in order, and
+// forgets everything.
+func (d *dnsExtractor) close() []*dnsExchange {
+	var left []*dnsExchange
+	for e := d.order.Front(); e != nil; e = e.Next() {
+		left = append(left, e.Value.(*dnsExchange))
+	}
+	if len(left) > 0 {
+		log.Printf("%d DNS queries without a response", len(left))
+	}
+	*d = *newDNSExtractor()
+	return left
+}
@@ -0,0 +1,238 @@
+package extract
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/JustinAzoff/pcap_simplify/pkt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// dnsPayload returns a DNS message asking for the A record of name, or
+// answering it with rcode and as many addresses as answers.
+func dnsPayload(t *testing.T, id uint16, name string, response bool, rcode layers.DNSResponseCode, answers int) []byte {
+	dns := &layers.DNS{
+		ID:           id,
+		QR:           response,
+		RD:           true,
+		ResponseCode: rcode,
+		Questions:    []layers.DNSQuestion{{Name: []byte(name), Type: layers.DNSTypeA, Class: layers.DNSClassIN}},
+	}
+	for i := 0; i < answers; i++ {
+		dns.Answers = append(dns.Answers, layers.DNSResourceRecord{
+			Name: []byte(name), Type: layers.DNSTypeA, Class: layers.DNSClassIN, TTL: 60, IP: net.IPv4(192, 0, 2, byte(i+1)),
+		})
+	}
+	buf := gopacket.NewSerializeBuffer()
+	if err := dns.SerializeTo(buf, gopacket.SerializeOptions{FixLengths: true}); err != nil {
+		t.Fatal(err)
+	}
+	return append([]byte{}, buf.Bytes()...)
+}
+
+// withLength prefixes a DNS message with its length, as sent over TCP.
+func withLength(msg []byte) []byte {
+	return append([]byte{byte(len(msg) >> 8), byte(len(msg))}, msg...)
+}
+
+// writeUDPPacket writes a datagram between 10.0.0.1, the client, and
+// 10.0.0.2 to pw, from the client if client is set.
+func writeUDPPacket(t *testing.T, pw *pcapgo.Writer, client bool, sport, dport int, data []byte) {
+	src, dst := net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2")
+	if !client {
+		src, dst, sport, dport = dst, src, dport, sport
+	}
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: src, DstIP: dst}
+	udp := &layers.UDP{SrcPort: layers.UDPPort(sport), DstPort: layers.UDPPort(dport)}
+	udp.SetNetworkLayerForChecksum(ip)
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, ip, udp, gopacket.Payload(data)); err != nil {
+		t.Fatal(err)
+	}
+	ci := gopacket.CaptureInfo{Timestamp: time.Unix(1600000000, 0), CaptureLength: len(buf.Bytes()), Length: len(buf.Bytes())}
+	if err := pw.WritePacket(ci, buf.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// dnsCapture writes DNS transactions over UDP, answered out of order, one
+// that is never answered and a response to a query that is missing, then a
+// datagram that is not DNS, and two queries pipelined over TCP, the length
+// of the second cut in two.
+func dnsCapture(t *testing.T) *Reader {
+	var file bytes.Buffer
+	pw := pcapgo.NewWriter(&file)
+	if err := pw.WriteFileHeader(65536, layers.LinkTypeRaw); err != nil {
+		t.Fatal(err)
+	}
+	udp := func(client bool, data []byte) {
+		writeUDPPacket(t, pw, client, 1000, 53, data)
+	}
+	udp(true, dnsPayload(t, 1, "a.example", false, 0, 0))
+	udp(true, dnsPayload(t, 2, "b.example", false, 0, 0))
+	udp(false, dnsPayload(t, 2, "b.example", true, layers.DNSResponseCodeNXDomain, 0))
+	udp(false, dnsPayload(t, 1, "a.example", true, layers.DNSResponseCodeNoErr, 2))
+	udp(true, dnsPayload(t, 3, "c.example", false, 0, 0))
+	udp(false, dnsPayload(t, 9, "d.example", true, layers.DNSResponseCodeServFail, 0))
+	writeUDPPacket(t, pw, true, 5000, 6000, []byte("not dns"))
+
+	queries := append(withLength(dnsPayload(t, 4, "e.example", false, 0, 0)), withLength(dnsPayload(t, 5, "f.example", false, 0, 0))...)
+	cut := len(withLength(dnsPayload(t, 4, "e.example", false, 0, 0))) + 1
+	writeTCPSegment(t, pw, true, 40000, 53, 100, queries[:cut])
+	writeTCPSegment(t, pw, true, 40000, 53, 100+uint32(cut), queries[cut:])
+	responses := append(withLength(dnsPayload(t, 5, "f.example", true, 0, 1)), withLength(dnsPayload(t, 4, "e.example", true, 0, 1))...)
+	writeTCPSegment(t, pw, false, 40000, 53, 500, responses)
+
+	r, err := NewReader(bytes.NewReader(file.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+type dnsRecord struct {
+	isOrig bool
+	proto  string
+	id     string
+	name   string
+	rcode  string
+}
+
+func TestSimplifyDNS(t *testing.T) {
+	opts := Options{DNS: &DNSOptions{}}
+	var out bytes.Buffer
+	if _, _, err := Simplify(dnsCapture(t), &out, opts); err != nil {
+		t.Fatal(err)
+	}
+	r, err := pkt.NewReader(out.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []dnsRecord
+	for {
+		isOrig, payload, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Metadata["protocol"] == ProtoTCP && int(binary.BigEndian.Uint16(payload))+2 != len(payload) {
+			t.Errorf("record of %d bytes without its length prefix", len(payload))
+		}
+		got = append(got, dnsRecord{isOrig, r.Metadata["protocol"], r.Metadata["dns_id"], r.Metadata["dns_name"], r.Metadata["dns_rcode"]})
+	}
+	want := []dnsRecord{
+		{true, "udp", "2", "b.example", ""},
+		{false, "udp", "2", "b.example", "NXDOMAIN"},
+		{true, "udp", "1", "a.example", ""},
+		{false, "udp", "1", "a.example", "NOERROR"},
+		{false, "udp", "9", "d.example", "SERVFAIL"},
+		{true, "udp", "", "", ""},
+		{true, "tcp", "5", "f.example", ""},
+		{false, "tcp", "5", "f.example", "NOERROR"},
+		{true, "tcp", "4", "e.example", ""},
+		{false, "tcp", "4", "e.example", "NOERROR"},
+		// Unanswered queries come last
+		{true, "udp", "3", "c.example", ""},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got records\n%v\nexpected\n%v", got, want)
+	}
+
+	transactions := opts.DNS.Transactions
+	if len(transactions) != 6 {
+		t.Fatalf("%d transactions in the summary, expected 6", len(transactions))
+	}
+	if x := transactions[1]; x.Record != 3 || x.ID != 1 || x.Name != "a.example" || x.Type != "A" || x.Rcode != "NOERROR" || x.Answers != 2 || !x.Query || !x.Response {
+		t.Errorf("summary entry %+v", x)
+	}
+	if x := transactions[2]; x.Query || !x.Response || x.Rcode != "SERVFAIL" {
+		t.Errorf("summary entry %+v", x)
+	}
+	if x := transactions[5]; x.Record != 11 || !x.Query || x.Response || x.Rcode != "" {
+		t.Errorf("summary entry %+v", x)
+	}
+}
+
+func TestSplitDNS(t *testing.T) {
+	files, create := bufferFiles(t)
+	opts := Options{DNS: &DNSOptions{}}
+	conversations, err := Split(dnsCapture(t), create, 0, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A flow per transaction and the datagram that is not DNS
+	if len(conversations) != 7 || len(files) != 7 {
+		t.Fatalf("got %d conversations and %d files, expected 7", len(conversations), len(files))
+	}
+	for i, first := range []int{1, 2, 5, 6, 7, 8, 9} {
+		if c := conversations[i]; c.FirstPacket != first {
+			t.Errorf("conversation %d starts at packet %d, expected %d", i, c.FirstPacket, first)
+		}
+	}
+	for _, c := range conversations {
+		if !files[c.Name].closed {
+			t.Errorf("%s was not closed", c.Name)
+		}
+	}
+	if c := conversations[0]; c.Client != "10.0.0.1" || c.ServerPort != "53" || c.Packets != 2 || c.LastPacket != 4 {
+		t.Errorf("conversation %+v", c)
+	}
+	// The response to a missing query still has the client as such
+	if c := conversations[3]; c.Client != "10.0.0.1" || c.Packets != 1 || c.ClientBytes != 0 {
+		t.Errorf("conversation %+v", c)
+	}
+	for _, x := range opts.DNS.Transactions {
+		if x.Record != 1 || files[x.File] == nil {
+			t.Errorf("summary entry %+v", x)
+		}
+	}
+}
+
+func TestDNSExtractorForgets(t *testing.T) {
+	packet := func(client bool, sport int, seq uint32, fin, rst bool, payload []byte) transportPacket {
+		src, dst := net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2)
+		p := transportPacket{message: message{proto: ProtoTCP, src: strconv.Itoa(sport), dst: "53", seq: seq, fin: fin, rst: rst, payload: payload}}
+		if !client {
+			src, dst = dst, src
+			p.src, p.dst = p.dst, p.src
+		}
+		p.nl = &layers.IPv4{SrcIP: src, DstIP: dst}
+		return p
+	}
+	d := newDNSExtractor()
+	query := withLength(dnsPayload(t, 1, "example.com", false, 0, 0))
+	response := withLength(dnsPayload(t, 1, "example.com", true, layers.DNSResponseCodeNoErr, 1))
+	for _, p := range []transportPacket{
+		packet(true, 40000, 1, false, false, query),
+		// An unanswered query on another connection, cut in the middle
+		packet(true, 40001, 1, false, false, withLength(dnsPayload(t, 2, "example.org", false, 0, 0))),
+		packet(true, 40002, 1, false, false, query[:5]),
+		packet(false, 40000, 1, false, false, response),
+		packet(true, 40000, uint32(1+len(query)), true, false, nil),
+		packet(false, 40000, uint32(1+len(response)), true, false, nil),
+		packet(true, 40002, 6, false, true, nil),
+	} {
+		d.packet(p)
+	}
+	// Only the open direction of the unanswered query is left
+	if len(d.streams) != 1 || len(d.buffers) != 1 {
+		t.Errorf("%d streams and %d buffers left, expected 1", len(d.streams), len(d.buffers))
+	}
+	if d.order.Len() != 1 || len(d.pending) != 1 {
+		t.Errorf("%d queries in order and %d pending, expected 1", d.order.Len(), len(d.pending))
+	}
+	if left := d.close(); len(left) != 1 || left[0].query.dns.ID != 2 {
+		t.Errorf("unanswered %v, expected the query with ID 2", left)
+	}
+}
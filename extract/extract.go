@@ -0,0 +1,339 @@
+// Package extract turns pcap files into .pkt files.
+//
+// Simplify keeps only the transport layer payloads of a single
+// conversation, SimplifyWithHeaders keeps every packet starting at the
+// network layer, or at the link layer with Options.LinkLayer.
+package extract
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/JustinAzoff/pcap_simplify/checksum"
+	"github.com/JustinAzoff/pcap_simplify/pkt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/ip4defrag"
+	"github.com/google/gopacket/layers"
+)
+
+// Options controls how packets are extracted.
+type Options struct {
+	// Decap is the set of tunnels to peel to get at the innermost flow
+	Decap Decap
+	// Checksums says what SimplifyWithHeaders does with bad checksums
+	Checksums checksum.Mode
+	// LinkLayer makes SimplifyWithHeaders keep the whole frame
+	LinkLayer bool
+	// Stats, if set, is filled with counts of what was read and written
+	Stats *Stats
+	// Protocols is what Simplify and Split extract, DefaultProtocols if
+	// nil
+	Protocols Protocols
+	// KeyLog, if set, makes Simplify and Split write the plaintext of the
+	// TLS sessions it has keys for instead of their records. Empty TCP
+	// payloads are left out then.
+	KeyLog *KeyLog
+	// HTTP, if set, makes Simplify and Split write a record per HTTP
+	// message, of the plaintext of TLS sessions too
+	HTTP *HTTPOptions
+	// DNS, if set, makes Simplify and Split pair DNS queries and
+	// responses, and write every transaction as a flow of its own
+	DNS *DNSOptions
+}
+
+// packetSource decodes the packets of a Reader. Unlike the channel of
+// gopacket.PacketSource.Packets, which retries a failed read forever, it
+// stops at the first error.
+type packetSource struct {
+	*gopacket.PacketSource
+	count int
+}
+
+func packets(r *Reader) (*packetSource, error) {
+	dec, err := LinkDecoder(r.LinkType())
+	if err != nil {
+		return nil, err
+	}
+	return &packetSource{PacketSource: gopacket.NewPacketSource(r, dec)}, nil
+}
+
+// Next returns the next packet, or io.EOF once the file is done. A file
+// cut off in the middle of a packet ends there with a warning, which is
+// what a capture that was still being written looks like.
+func (ps *packetSource) Next() (gopacket.Packet, error) {
+	packet, err := ps.NextPacket()
+	switch err {
+	case nil:
+		ps.count++
+		return packet, nil
+	case io.EOF:
+		return nil, io.EOF
+	case io.ErrUnexpectedEOF:
+		log.Printf("Capture file ends in the middle of packet %d", ps.count+1)
+		return nil, io.EOF
+	}
+	return nil, fmt.Errorf("Error reading packet %d: %v", ps.count+1, err)
+}
+
+// transportPacket is a message of one of the protocols to extract, once
+// decapsulated and reassembled.
+type transportPacket struct {
+	message
+	// n is the number of the packet in the capture, counting from 1. For
+	// fragments it is the one that completed the datagram.
+	n       int
+	ts      time.Time
+	nl      gopacket.NetworkLayer
+	tunnels []Tunnel
+}
+
+// flow is the network flow and the ports of p, which tells the directions
+// of a conversation apart.
+func (p transportPacket) flow() string {
+	return fmt.Sprintf("%v %s %s->%s", p.nl.NetworkFlow(), p.name(), p.src, p.dst)
+}
+
+// reverseFlow is the flow of the other direction of the conversation of p.
+func (p transportPacket) reverseFlow() string {
+	return fmt.Sprintf("%v %s %s->%s", p.nl.NetworkFlow().Reverse(), p.name(), p.dst, p.src)
+}
+
+// conversation is the same for both directions of the conversation of p.
+func (p transportPacket) conversation() string {
+	return conversation(p.name(), p.nl, p.src, p.dst)
+}
+
+// meta is the metadata that goes with the record of p, isOrig telling
+// whether the source is the originator. Protocols without ports clear the
+// ports of an earlier record.
+func (p transportPacket) meta(isOrig bool) pkt.Metadata {
+	meta := pkt.Metadata{"tunnels": Tunnels(p.tunnels), "orig_port": "", "resp_port": ""}
+	meta["orig_addr"], meta["resp_addr"] = p.nl.NetworkFlow().Src().String(), p.nl.NetworkFlow().Dst().String()
+	if !isOrig {
+		meta["orig_addr"], meta["resp_addr"] = meta["resp_addr"], meta["orig_addr"]
+	}
+	if p.hasPorts() {
+		meta["orig_port"], meta["resp_port"] = p.src, p.dst
+		if !isOrig {
+			meta["orig_port"], meta["resp_port"] = p.dst, p.src
+		}
+	}
+	for k, v := range p.message.meta {
+		meta[k] = v
+	}
+	return meta
+}
+
+// eachTransport calls fn with every message of r of the protocols in
+// opts. Fragmented IPv4 packets are passed on once all their fragments
+// were seen. It returns the number of packets read.
+func eachTransport(r *Reader, opts Options, fn func(p transportPacket) error) (int, error) {
+	protocols := opts.protocols()
+	totalPackets := 0
+	ps, err := packets(r)
+	if err != nil {
+		return 0, err
+	}
+	defrag := ip4defrag.NewIPv4Defragmenter()
+	stats := opts.stats()
+	for {
+		packet, err := ps.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return totalPackets, err
+		}
+		totalPackets++
+		stats.read(packet)
+		nl, tl, tunnels := opts.Decap.Layers(packet)
+		if ip, ok := nl.(*layers.IPv4); ok && isFragment(ip) {
+			// Only the first fragment has the transport header, so
+			// wait for the whole datagram
+			whole, err := defrag.DefragIPv4WithTimestamp(ip, packet.Metadata().Timestamp)
+			if err != nil {
+				log.Printf("Packet %d: %v", totalPackets, err)
+				stats.skip(SkipBadFragment)
+				continue
+			}
+			if whole == nil {
+				stats.skip(SkipFragment)
+				continue
+			}
+			nl = whole
+			tl = gopacket.NewPacket(whole.Payload, whole.NextLayerType(), gopacket.Default).TransportLayer()
+		}
+		if nl == nil {
+			stats.skip(SkipNoNetworkLayer)
+			continue
+		}
+		msgs, ok := messages(nl, tl)
+		switch {
+		case !ok:
+			stats.skip(SkipNoTransportLayer)
+			continue
+		case len(msgs) == 0:
+			stats.skip(SkipControl)
+			continue
+		case protocols.known(msgs[0].proto) && !protocols[msgs[0].proto]:
+			stats.skip(SkipProtocol)
+			continue
+		}
+		for _, m := range msgs {
+			p := transportPacket{message: m, n: totalPackets, ts: packet.Metadata().Timestamp, nl: nl, tunnels: tunnels}
+			if err := fn(p); err != nil {
+				return totalPackets, err
+			}
+		}
+	}
+	return totalPackets, nil
+}
+
+// Simplify writes the transport layer payload of every packet in r to out.
+// Packets from the first flow seen are marked as coming from the
+// originator, everything else as the response. The protocol and the
+// addresses and ports of the originator and the responder go in the
+// metadata. With Options.DNS, DNS queries are the originator's instead.
+// Fragmented IPv4
+// packets are written once all their fragments were seen. It returns the
+// number of packets read and written.
+func Simplify(r *Reader, out io.Writer, opts Options) (int, int, error) {
+
+	packetsWritten := 0
+	w := pkt.NewWriter(out)
+	meta := newMetaWriter(w)
+	firstSeenFlow := ""
+	stats := opts.stats()
+	streams := newPipeline(opts)
+	// record returns the writer of the records of a conversation
+	record := func(conversation string) recordWriter {
+		return func(isOrig bool, payload []byte, m pkt.Metadata) error {
+			if err := meta.update(m); err != nil {
+				return err
+			}
+			packetsWritten++
+			if err := w.Write(isOrig, payload); err != nil {
+				return err
+			}
+			stats.written(isOrig, len(payload), conversation)
+			if opts.HTTP != nil {
+				opts.HTTP.add("", packetsWritten, payload, m)
+			}
+			return nil
+		}
+	}
+	// Every DNS transaction counts as a conversation of its own
+	writeExchanges := func(exchanges []*dnsExchange) error {
+		for _, x := range exchanges {
+			opts.DNS.add("", packetsWritten+1, x)
+			if err := streams.writeExchange(x, record(x.key)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	totalPackets, err := eachTransport(r, opts, func(p transportPacket) error {
+		if exchanges, ok := streams.exchanges(p); ok {
+			return writeExchanges(exchanges)
+		}
+		flow := p.flow()
+		if firstSeenFlow == "" {
+			firstSeenFlow = flow
+		}
+		//fmt.Printf("First=%s, this=%s\n", firstSeenFlow, flow)
+		isOrig := flow == firstSeenFlow
+		return streams.packet(p, isOrig, record(p.conversation()))
+	})
+	if err == nil {
+		err = streams.closeAll()
+	}
+	if err == nil {
+		err = writeExchanges(streams.unanswered())
+	}
+	return totalPackets, packetsWritten, err
+
+}
+
+func isFragment(ip *layers.IPv4) bool {
+	return ip.Flags&layers.IPv4MoreFragments != 0 || ip.FragOffset != 0
+}
+
+// SimplifyWithHeaders writes every packet in r with a network layer to out,
+// headers included. It returns the number of packets read.
+func SimplifyWithHeaders(r *Reader, out io.Writer, opts Options) (int, error) {
+
+	totalPackets := 0
+	badChecksums := 0
+	w := pkt.NewWriter(out)
+	if opts.LinkLayer {
+		if len(opts.Decap) != 0 {
+			return 0, fmt.Errorf("Decapsulation can not be combined with keeping the link layer, which keeps the whole frame")
+		}
+		err := w.WriteMetadata(pkt.Metadata{
+			"linktype": fmt.Sprintf("%d", r.LinkType()),
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	lastTunnels := ""
+	ps, err := packets(r)
+	if err != nil {
+		return 0, err
+	}
+	stats := opts.stats()
+	for {
+		packet, err := ps.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return totalPackets, err
+		}
+		totalPackets++
+		stats.read(packet)
+		nl, tl, tunnels := opts.Decap.Layers(packet)
+		if nl == nil {
+			stats.skip(SkipNoNetworkLayer)
+		} else {
+			if t := Tunnels(tunnels); t != lastTunnels {
+				if err := w.WriteMetadata(pkt.Metadata{"tunnels": t}); err != nil {
+					return totalPackets, err
+				}
+				lastTunnels = t
+			}
+			var data, network []byte
+			if opts.LinkLayer {
+				data = packet.Data()
+				network = data[NetworkOffset(packet, nl):]
+			} else {
+				data = layerData(nl)
+				network = data
+			}
+
+			errs := opts.Checksums.Apply(network)
+			for _, err := range errs {
+				log.Printf("Packet %d: %v", totalPackets, err)
+			}
+			badChecksums += len(errs)
+
+			if err := w.Write(true, data); err != nil {
+				return totalPackets, err
+			}
+			if tl != nil {
+				stats.written(true, len(data), conversation(strings.ToLower(tl.LayerType().String()), nl, tl.TransportFlow().Src().String(), tl.TransportFlow().Dst().String()))
+			} else {
+				proto, _ := ipProtocol(nl)
+				stats.written(true, len(data), conversation(fmt.Sprintf("%s:%d", ProtoIP, proto), nl, "", ""))
+			}
+		}
+	}
+	if opts.Checksums != checksum.None {
+		log.Printf("%d bad checksums found", badChecksums)
+	}
+	return totalPackets, nil
+
+}
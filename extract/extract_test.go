@@ -0,0 +1,332 @@
+package extract
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/JustinAzoff/pcap_simplify/checksum"
+	"github.com/JustinAzoff/pcap_simplify/pkt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+var linkTypeFixtures = []string{
+	"ethernet.pcap",
+	"null.pcap",
+	"raw.pcap",
+	"ipv4.pcap",
+	"ipv6.pcap",
+	"sll.pcap",
+	"sll2.pcap",
+	"dot11.pcap",
+	"radiotap.pcap",
+}
+
+func openFixture(t *testing.T, name string) *Reader {
+	f, err := os.Open(filepath.Join("..", "testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	r, err := NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func readRecords(t *testing.T, data []byte) (*pkt.Reader, [][]byte) {
+	b, err := pkt.NewReader(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var records [][]byte
+	for {
+		_, payload, err := b.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, payload)
+	}
+	return b, records
+}
+
+func TestSimplifyWithHeadersLinkTypes(t *testing.T) {
+	want := []string{"hello", "world"}
+	for _, name := range linkTypeFixtures {
+		t.Run(name, func(t *testing.T) {
+			r := openFixture(t, name)
+			var out bytes.Buffer
+			total, err := SimplifyWithHeaders(r, &out, Options{Checksums: checksum.Check})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if total != 2 {
+				t.Errorf("SimplifyWithHeaders() = %d packets, want 2", total)
+			}
+			_, records := readRecords(t, out.Bytes())
+			if len(records) != len(want) {
+				t.Fatalf("got %d records, want %d", len(records), len(want))
+			}
+			for i, record := range records {
+				first := layers.LayerTypeIPv4
+				if record[0]>>4 == 6 {
+					first = layers.LayerTypeIPv6
+				}
+				packet := gopacket.NewPacket(record, first, gopacket.Default)
+				tl := packet.TransportLayer()
+				if tl == nil {
+					t.Fatalf("record %d has no transport layer: %v", i, packet)
+				}
+				if got := string(tl.LayerPayload()); got != want[i] {
+					t.Errorf("record %d payload = %q, want %q", i, got, want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestSimplifyWithHeadersLinkLayer(t *testing.T) {
+	for _, name := range linkTypeFixtures {
+		t.Run(name, func(t *testing.T) {
+			var frames [][]byte
+			orig := openFixture(t, name)
+			for {
+				data, _, err := orig.ReadPacketData()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				frames = append(frames, data)
+			}
+
+			r := openFixture(t, name)
+			var out bytes.Buffer
+			if _, err := SimplifyWithHeaders(r, &out, Options{LinkLayer: true}); err != nil {
+				t.Fatal(err)
+			}
+			b, records := readRecords(t, out.Bytes())
+			if got, want := b.Metadata["linktype"], strconv.Itoa(int(r.LinkType())); got != want {
+				t.Errorf("linktype = %q, want %q", got, want)
+			}
+			if len(records) != len(frames) {
+				t.Fatalf("got %d records, want %d", len(records), len(frames))
+			}
+			for i := range records {
+				if !bytes.Equal(records[i], frames[i]) {
+					t.Errorf("record %d = %x, want %x", i, records[i], frames[i])
+				}
+			}
+		})
+	}
+}
+
+func TestSimplifyWithHeadersUnsupportedLinkType(t *testing.T) {
+	r := openFixture(t, "unsupported.pcap")
+	var out bytes.Buffer
+	if _, err := SimplifyWithHeaders(r, &out, Options{}); err == nil {
+		t.Fatal("SimplifyWithHeaders() succeeded on an unsupported link type")
+	}
+}
+
+func TestSimplifyLinkTypes(t *testing.T) {
+	want := [][]byte{[]byte("hello"), []byte("world")}
+	for _, name := range linkTypeFixtures {
+		t.Run(name, func(t *testing.T) {
+			r := openFixture(t, name)
+			var out bytes.Buffer
+			total, written, err := Simplify(r, &out, Options{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if total != 2 || written != 2 {
+				t.Errorf("Simplify() = %d, %d packets, want 2, 2", total, written)
+			}
+			b, records := readRecords(t, out.Bytes())
+			if !reflect.DeepEqual(records, want) {
+				t.Errorf("Simplify() wrote records %q, want %q", records, want)
+			}
+			if b.Metadata["protocol"] != "tcp" || b.Metadata["orig_port"] != "40000" || b.Metadata["resp_port"] != "80" {
+				t.Errorf("Simplify() wrote metadata %v, want tcp from port 40000 to 80", b.Metadata)
+			}
+		})
+	}
+}
+
+func TestSimplifyUnsupportedLinkType(t *testing.T) {
+	r := openFixture(t, "unsupported.pcap")
+	var out bytes.Buffer
+	_, _, err := Simplify(r, &out, Options{})
+	if err == nil {
+		t.Fatal("Simplify() succeeded on an unsupported link type")
+	}
+	if out.Len() != 0 {
+		t.Errorf("Simplify() wrote %d bytes, want 0", out.Len())
+	}
+}
+
+// TestSimplifyWithHeadersHopByHop makes sure the IPv6 hop-by-hop options,
+// which gopacket keeps out of the IPv6 layer, stay in the record.
+func TestSimplifyWithHeadersHopByHop(t *testing.T) {
+	packet := []byte{
+		// IPv6, next header hop-by-hop
+		0x60, 0, 0, 0, 0, 18, 0, 64,
+		0xfe, 0x80, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1,
+		0xfe, 0x80, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 2,
+		// hop-by-hop, next header UDP, a router alert and padding
+		17, 0, 5, 2, 0, 0, 1, 0,
+		// UDP
+		0x30, 0x39, 0x00, 0x35, 0, 10, 0, 0, 'h', 'i',
+	}
+	var file bytes.Buffer
+	w := pcapgo.NewWriter(&file)
+	if err := w.WriteFileHeader(65536, layers.LinkTypeRaw); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WritePacket(gopacket.CaptureInfo{CaptureLength: len(packet), Length: len(packet)}, packet); err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewReader(bytes.NewReader(file.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if _, err := SimplifyWithHeaders(r, &out, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	_, records := readRecords(t, out.Bytes())
+	if len(records) != 1 || !bytes.Equal(records[0], packet) {
+		t.Errorf("got records %x, expected %x", records, packet)
+	}
+}
+
+func TestSimplifyStats(t *testing.T) {
+	var stats Stats
+	if _, _, err := Simplify(openFixture(t, "fragments.pcap"), io.Discard, Options{Stats: &stats}); err != nil {
+		t.Fatal(err)
+	}
+	if stats.PacketsRead != 4 || stats.PacketsWritten != 2 {
+		t.Errorf("%d packets read and %d written, expected 4 and 2", stats.PacketsRead, stats.PacketsWritten)
+	}
+	// The first two fragments wait for the last one
+	if len(stats.Skipped) != 1 || stats.Skipped[SkipFragment] != 2 {
+		t.Errorf("skipped %v, expected 2 fragments", stats.Skipped)
+	}
+	if stats.OrigBytes != 2000 || stats.RespBytes != 2 {
+		t.Errorf("%d bytes from the client and %d from the server, expected 2000 and 2", stats.OrigBytes, stats.RespBytes)
+	}
+	if stats.Flows != 1 {
+		t.Errorf("%d flows, expected 1", stats.Flows)
+	}
+	if stats.Duration() <= 0 {
+		t.Errorf("duration %v, expected the time between the first and last packet", stats.Duration())
+	}
+}
+
+// TestSimplifyProtocols makes sure every DATA chunk of a bundled SCTP
+// packet is a record, and that ICMP is only extracted when asked for.
+func TestSimplifyProtocols(t *testing.T) {
+	sctp := []byte{
+		// IPv4, protocol SCTP
+		0x45, 0, 0, 76, 0, 0, 0, 0, 64, 132, 0, 0,
+		10, 0, 0, 1, 10, 0, 0, 2,
+		// SCTP common header, the checksum is not checked
+		0x0b, 0x59, 0x0b, 0x59, 0, 0, 0, 1, 0, 0, 0, 0,
+		// DATA on stream 1 with PPID 46, padded
+		0, 3, 0, 19, 0, 0, 0, 1, 0, 1, 0, 0, 0, 0, 0, 46, 'o', 'n', 'e', 0,
+		// SACK
+		3, 0, 0, 4,
+		// DATA on stream 2 with PPID 0
+		0, 3, 0, 19, 0, 0, 0, 2, 0, 2, 0, 0, 0, 0, 0, 0, 't', 'w', 'o', 0,
+	}
+	echo := []byte{
+		// IPv4, protocol ICMP
+		0x45, 0, 0, 32, 0, 0, 0, 0, 64, 1, 0, 0,
+		10, 0, 0, 1, 10, 0, 0, 2,
+		// echo request, id 7
+		8, 0, 0, 0, 0, 7, 0, 1, 'p', 'i', 'n', 'g',
+	}
+	unreachable := []byte{
+		0x45, 0, 0, 28, 0, 0, 0, 0, 64, 1, 0, 0,
+		10, 0, 0, 2, 10, 0, 0, 1,
+		3, 1, 0, 0, 0, 0, 0, 0,
+	}
+	var file bytes.Buffer
+	w := pcapgo.NewWriter(&file)
+	if err := w.WriteFileHeader(65536, layers.LinkTypeRaw); err != nil {
+		t.Fatal(err)
+	}
+	for _, packet := range [][]byte{sctp, echo, unreachable} {
+		if err := w.WritePacket(gopacket.CaptureInfo{CaptureLength: len(packet), Length: len(packet)}, packet); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tt := range []struct {
+		protocols string
+		want      []string
+		metadata  pkt.Metadata
+		skipped   map[string]int
+	}{
+		{"tcp,udp,sctp", []string{"one", "two"},
+			pkt.Metadata{"protocol": "sctp", "sctp_stream": "2", "sctp_ppid": "0"},
+			map[string]int{SkipProtocol: 1, SkipControl: 1}},
+		{"all", []string{"one", "two", "ping"},
+			pkt.Metadata{"protocol": "icmp", "sctp_stream": "2", "sctp_ppid": "0"},
+			map[string]int{SkipControl: 1}},
+	} {
+		protocols, err := ParseProtocols(tt.protocols)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := NewReader(bytes.NewReader(file.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var stats Stats
+		var out bytes.Buffer
+		if _, _, err := Simplify(r, &out, Options{Protocols: protocols, Stats: &stats}); err != nil {
+			t.Fatal(err)
+		}
+		b, records := readRecords(t, out.Bytes())
+		var got []string
+		for _, rec := range records {
+			got = append(got, string(rec))
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got records %q, expected %q", tt.protocols, got, tt.want)
+		}
+		for k, v := range tt.metadata {
+			if b.Metadata[k] != v {
+				t.Errorf("%s: metadata %s is %q, expected %q", tt.protocols, k, b.Metadata[k], v)
+			}
+		}
+		if !reflect.DeepEqual(stats.Skipped, tt.skipped) {
+			t.Errorf("%s: skipped %v, expected %v", tt.protocols, stats.Skipped, tt.skipped)
+		}
+	}
+}
+
+func TestParseProtocols(t *testing.T) {
+	if _, err := ParseProtocols("tcp,quic"); err == nil {
+		t.Error("expected an error for an unknown protocol")
+	}
+	p, err := ParseProtocols("ICMP, ip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(p, Protocols{ProtoICMP: true, ProtoIP: true}) {
+		t.Errorf("got %v", p)
+	}
+}
@@ -0,0 +1,68 @@
+package extract
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/gopacket/layers"
+)
+
+var update = flag.Bool("update", false, "Rewrite the golden files in testdata/golden")
+
+var goldenTests = []struct {
+	golden  string
+	fixture string
+	headers bool
+	opts    Options
+}{
+	{"tcp.pkt", "tcp.pcap", false, Options{}},
+	{"tcp.headers.pkt", "tcp.pcap", true, Options{}},
+	{"udp.pkt", "udp.pcap", false, Options{}},
+	{"udp.headers.pkt", "udp.pcap", true, Options{}},
+	{"ipv6.pkt", "ipv6.pcap", false, Options{}},
+	{"ipv6.headers.pkt", "ipv6.pcap", true, Options{}},
+	{"fragments.pkt", "fragments.pcap", false, Options{}},
+	{"fragments.headers.pkt", "fragments.pcap", true, Options{}},
+	{"vlan.pkt", "vlan.pcap", false, Options{Decap: Decap{layers.LayerTypeDot1Q: true}}},
+	{"vlan.link.pkt", "vlan.pcap", true, Options{LinkLayer: true}},
+	{"pcapng.pkt", "ethernet.pcapng", false, Options{}},
+	{"pcapng.link.pkt", "ethernet.pcapng", true, Options{LinkLayer: true}},
+}
+
+// TestGolden checks the .pkt output for every fixture byte for byte. Run
+// go test ./extract -update to rewrite the golden files after an intended
+// change, and review the difference with pcapsimplify dump.
+func TestGolden(t *testing.T) {
+	for _, tt := range goldenTests {
+		t.Run(tt.golden, func(t *testing.T) {
+			r := openFixture(t, tt.fixture)
+			var out bytes.Buffer
+			var err error
+			if tt.headers {
+				_, err = SimplifyWithHeaders(r, &out, tt.opts)
+			} else {
+				_, _, err = Simplify(r, &out, tt.opts)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			golden := filepath.Join("..", "testdata", "golden", tt.golden)
+			if *update {
+				if err := ioutil.WriteFile(golden, out.Bytes(), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := ioutil.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(out.Bytes(), want) {
+				t.Errorf("output differs from %s\ngot  %q\nwant %q", golden, out.Bytes(), want)
+			}
+		})
+	}
+}
@@ -0,0 +1,516 @@
+package extract
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/JustinAzoff/pcap_simplify/pkt"
+)
+
+// HTTPOptions makes Simplify and Split write a record per HTTP/1.x message
+// of TCP conversations instead of a record per segment. Every message
+// comes with http_method, http_uri, http_status and http_content_type
+// metadata, responses with the method and URI of their request.
+// Conversations that are not HTTP are written as their data arrives, once
+// put back in order.
+type HTTPOptions struct {
+	// Dechunk decodes chunked bodies, replacing the Transfer-Encoding
+	// header with a Content-Length
+	Dechunk bool
+	// Messages is filled with every message written, in order
+	Messages []HTTPMessage
+}
+
+// HTTPMessage is an entry of the manifest of the HTTP messages written.
+type HTTPMessage struct {
+	// File is the .pkt file of the conversation with Split, and empty
+	// with Simplify
+	File string
+	// Record is the number of the record holding the message in its file,
+	// counting from 1
+	Record      int
+	Request     bool
+	Method      string
+	URI         string
+	Status      int
+	ContentType string
+	// Bytes is the size of the message, headers included
+	Bytes int
+}
+
+// httpMetadata are the metadata keys describing an HTTP message. They are
+// cleared for records that are not one.
+var httpMetadata = []string{"http_method", "http_uri", "http_status", "http_content_type"}
+
+// add puts the record of file written with metadata m in the manifest, if
+// it is an HTTP message.
+func (o *HTTPOptions) add(file string, record int, payload []byte, m pkt.Metadata) {
+	if m["http_method"] == "" && m["http_status"] == "" {
+		return
+	}
+	status, _ := strconv.Atoi(m["http_status"])
+	o.Messages = append(o.Messages, HTTPMessage{
+		File:        file,
+		Record:      record,
+		Request:     m["http_status"] == "",
+		Method:      m["http_method"],
+		URI:         m["http_uri"],
+		Status:      status,
+		ContentType: m["http_content_type"],
+		Bytes:       len(payload),
+	})
+}
+
+// errNotHTTP is returned for conversations that don't start like HTTP,
+// which are written as they are without a word.
+var errNotHTTP = errors.New("Not HTTP")
+
+// maxHTTPHeader is how long the headers of a message may get before the
+// conversation is not taken for HTTP.
+const maxHTTPHeader = 64 * 1024
+
+// httpMessage is a message being read.
+type httpMessage struct {
+	method, uri string
+	status      int
+	contentType string
+	// header is the start line and headers, up to the empty line
+	header []byte
+	// length is the length of the body, -1 for bodies ending with the
+	// connection
+	length  int
+	chunked bool
+	// pos is how far the chunked body was read, decoded what it held so
+	// far and trailer whether the last chunk was read
+	pos     int
+	decoded []byte
+	trailer bool
+	// upgrade is set for messages after which the connection is not HTTP
+	// anymore
+	upgrade bool
+}
+
+// meta returns base with the metadata of m.
+func (m *httpMessage) meta(base pkt.Metadata) pkt.Metadata {
+	meta := pkt.Metadata{}
+	for k, v := range base {
+		meta[k] = v
+	}
+	meta["http_method"] = m.method
+	meta["http_uri"] = m.uri
+	meta["http_status"] = ""
+	if m.status != 0 {
+		meta["http_status"] = strconv.Itoa(m.status)
+	}
+	meta["http_content_type"] = m.contentType
+	return meta
+}
+
+// httpSide is what one side of a conversation sent and was not written yet.
+type httpSide struct {
+	stream tcpStream
+	buf    []byte
+	msg    *httpMessage
+}
+
+// httpConversation is an HTTP connection.
+type httpConversation struct {
+	sides map[bool]*httpSide
+	// raw is set once the conversation turned out not to be HTTP, or
+	// switched to another protocol
+	raw bool
+	// requests are the requests not answered yet
+	requests []*httpMessage
+	// write and meta are the last ones seen, to write what is left at the
+	// end
+	write recordWriter
+	meta  pkt.Metadata
+}
+
+// httpExtractor cuts the TCP conversations of a capture into HTTP
+// messages.
+type httpExtractor struct {
+	opts          *HTTPOptions
+	conversations map[string]*httpConversation
+	// order has the conversations in the order they started, so what is
+	// left at the end is written in a stable order. Closed ones stay in
+	// it.
+	order []string
+}
+
+func newHTTPExtractor(opts *HTTPOptions) *httpExtractor {
+	return &httpExtractor{opts: opts, conversations: map[string]*httpConversation{}}
+}
+
+func (h *httpExtractor) conversation(key string) *httpConversation {
+	c := h.conversations[key]
+	if c == nil {
+		c = &httpConversation{sides: map[bool]*httpSide{true: {}, false: {}}}
+		h.conversations[key] = c
+		h.order = append(h.order, key)
+	}
+	return c
+}
+
+// packet puts the TCP payload of p back in order and passes it to data.
+func (h *httpExtractor) packet(p transportPacket, isOrig bool, meta pkt.Metadata, write recordWriter) error {
+	key := p.conversation()
+	side := h.conversation(key).sides[isOrig]
+	return h.data(key, isOrig, side.stream.add(p.seq, p.payload), meta, write)
+}
+
+// data reads what a side of the conversation key sent next, writing every
+// message it completes.
+func (h *httpExtractor) data(key string, isOrig bool, data []byte, meta pkt.Metadata, write recordWriter) error {
+	c := h.conversation(key)
+	c.write, c.meta = write, meta
+	if c.raw {
+		if len(data) == 0 {
+			return nil
+		}
+		return write(isOrig, data, plainMeta(meta))
+	}
+	side := c.sides[isOrig]
+	side.buf = append(side.buf, data...)
+	for {
+		n, record, m, err := c.next(side, h.opts.Dechunk)
+		if err != nil {
+			if err != errNotHTTP {
+				log.Printf("%v, writing the rest of the conversation as it is", err)
+			}
+			return c.giveUp()
+		}
+		if n == 0 {
+			return nil
+		}
+		if err := write(isOrig, record, m); err != nil {
+			return err
+		}
+		side.buf = side.buf[n:]
+		if c.raw {
+			return c.giveUp()
+		}
+	}
+}
+
+// plainMeta returns meta with the HTTP metadata cleared.
+func plainMeta(meta pkt.Metadata) pkt.Metadata {
+	m := pkt.Metadata{}
+	for k, v := range meta {
+		m[k] = v
+	}
+	for _, k := range httpMetadata {
+		m[k] = ""
+	}
+	return m
+}
+
+// giveUp writes what both sides sent as it is, and makes c write whatever
+// comes next that way too.
+func (c *httpConversation) giveUp() error {
+	c.raw = true
+	for _, isOrig := range []bool{true, false} {
+		side := c.sides[isOrig]
+		buf := side.buf
+		side.buf, side.msg = nil, nil
+		if len(buf) > 0 {
+			if err := c.write(isOrig, buf, plainMeta(c.meta)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// close writes what is left of c, such as bodies that end with the
+// connection.
+func (c *httpConversation) close() error {
+	if c.write == nil {
+		return nil
+	}
+	for _, isOrig := range []bool{true, false} {
+		side := c.sides[isOrig]
+		if len(side.buf) == 0 {
+			continue
+		}
+		meta := plainMeta(c.meta)
+		if side.msg != nil {
+			meta = side.msg.meta(c.meta)
+		}
+		if err := c.write(isOrig, side.buf, meta); err != nil {
+			return err
+		}
+		side.buf, side.msg = nil, nil
+	}
+	return nil
+}
+
+// close writes what is left of the conversation key and forgets it.
+func (h *httpExtractor) close(key string) error {
+	c := h.conversations[key]
+	if c == nil {
+		return nil
+	}
+	delete(h.conversations, key)
+	return c.close()
+}
+
+// closeAll writes what is left of every conversation.
+func (h *httpExtractor) closeAll() error {
+	for _, key := range h.order {
+		if err := h.close(key); err != nil {
+			return err
+		}
+	}
+	h.order = nil
+	return nil
+}
+
+// looksLikeHTTP tells whether buf starts like a request or a response,
+// and whether that can't be told yet.
+func looksLikeHTTP(buf []byte) (bool, bool) {
+	const version = "HTTP/"
+	if len(buf) < len(version) && strings.HasPrefix(version, string(buf)) {
+		return false, true
+	}
+	if bytes.HasPrefix(buf, []byte(version)) {
+		return true, false
+	}
+	// A method is an upper case token
+	for i, b := range buf {
+		switch {
+		case b == ' ':
+			return i > 0, false
+		case b < 'A' || b > 'Z' || i >= 20:
+			return false, false
+		}
+	}
+	return false, true
+}
+
+// headerEnd returns the length of the headers at the start of buf, up to
+// the empty line, or -1 if they are not all there.
+func headerEnd(buf []byte) int {
+	for i := 0; i < len(buf); {
+		j := bytes.IndexByte(buf[i:], '\n')
+		if j < 0 {
+			return -1
+		}
+		line := buf[i : i+j]
+		i += j + 1
+		if len(line) == 0 || (len(line) == 1 && line[0] == '\r') {
+			return i
+		}
+	}
+	return -1
+}
+
+// parseHTTPHeader reads the start line and headers of a message.
+func parseHTTPHeader(header []byte) (*httpMessage, map[string]string, error) {
+	lines := strings.Split(strings.TrimRight(string(header), "\r\n"), "\n")
+	start := strings.SplitN(strings.TrimRight(lines[0], "\r"), " ", 3)
+	m := &httpMessage{header: header}
+	if strings.HasPrefix(start[0], "HTTP/") {
+		if !strings.HasPrefix(start[0], "HTTP/1.") || len(start) < 2 {
+			return nil, nil, fmt.Errorf("Not an HTTP/1.x response: %q", lines[0])
+		}
+		status, err := strconv.Atoi(start[1])
+		if err != nil || status < 100 || status > 999 {
+			return nil, nil, fmt.Errorf("Invalid HTTP status in %q", lines[0])
+		}
+		m.status = status
+	} else {
+		if len(start) != 3 || !strings.HasPrefix(start[2], "HTTP/1.") {
+			return nil, nil, fmt.Errorf("Not an HTTP/1.x request: %q", lines[0])
+		}
+		m.method, m.uri = start[0], start[1]
+	}
+	headers := map[string]string{}
+	for _, line := range lines[1:] {
+		i := strings.IndexByte(line, ':')
+		if i < 0 {
+			return nil, nil, fmt.Errorf("Invalid HTTP header %q", strings.TrimSpace(line))
+		}
+		headers[strings.ToLower(strings.TrimSpace(line[:i]))] = strings.TrimSpace(line[i+1:])
+	}
+	m.contentType = headers["content-type"]
+	return m, headers, nil
+}
+
+// start reads the headers of the next message of side, setting side.msg
+// once they are all there.
+func (c *httpConversation) start(side *httpSide) error {
+	isHTTP, more := looksLikeHTTP(side.buf)
+	if more {
+		return nil
+	}
+	if !isHTTP {
+		return errNotHTTP
+	}
+	end := headerEnd(side.buf)
+	if end < 0 {
+		if len(side.buf) > maxHTTPHeader {
+			return fmt.Errorf("HTTP headers longer than %d bytes", maxHTTPHeader)
+		}
+		return nil
+	}
+	m, headers, err := parseHTTPHeader(side.buf[:end])
+	if err != nil {
+		return err
+	}
+	m.chunked = strings.HasSuffix(strings.ToLower(headers["transfer-encoding"]), "chunked")
+	length := -1
+	if v, ok := headers["content-length"]; ok {
+		if length, err = strconv.Atoi(v); err != nil || length < 0 {
+			return fmt.Errorf("Invalid Content-Length %q", v)
+		}
+	}
+
+	if m.status == 0 {
+		c.requests = append(c.requests, m)
+		switch {
+		case m.chunked:
+		case headers["transfer-encoding"] != "":
+			return fmt.Errorf("Unsupported Transfer-Encoding %q", headers["transfer-encoding"])
+		case length < 0:
+			length = 0
+		}
+		m.length = length
+		side.msg = m
+		return nil
+	}
+
+	// A response goes with the oldest request not answered yet, unless it
+	// is an interim one
+	var request *httpMessage
+	if len(c.requests) > 0 {
+		request = c.requests[0]
+		m.method, m.uri = request.method, request.uri
+	}
+	if m.status >= 200 && len(c.requests) > 0 {
+		c.requests = c.requests[1:]
+	}
+	switch {
+	case m.status < 200 || m.status == 204 || m.status == 304 || m.method == "HEAD":
+		m.chunked = false
+		length = 0
+	case m.chunked:
+	case headers["transfer-encoding"] != "":
+		length = -1
+	}
+	m.upgrade = m.status == 101 || (m.method == "CONNECT" && m.status < 300)
+	if m.upgrade {
+		length = 0
+	}
+	m.length = length
+	side.msg = m
+	return nil
+}
+
+// chunks reads the chunked body of m in buf, returning the end of the
+// message, or 0 if it is not all there.
+func (m *httpMessage) chunks(buf []byte) (int, error) {
+	if m.pos == 0 {
+		m.pos = len(m.header)
+	}
+	for {
+		i := bytes.IndexByte(buf[m.pos:], '\n')
+		if i < 0 {
+			if len(buf)-m.pos > maxHTTPHeader {
+				return 0, fmt.Errorf("Chunk size line longer than %d bytes", maxHTTPHeader)
+			}
+			return 0, nil
+		}
+		line := strings.TrimSpace(string(buf[m.pos : m.pos+i]))
+		next := m.pos + i + 1
+		if m.trailer {
+			// The trailers end with an empty line
+			m.pos = next
+			if line == "" {
+				return next, nil
+			}
+			continue
+		}
+		if j := strings.IndexByte(line, ';'); j >= 0 {
+			line = strings.TrimSpace(line[:j])
+		}
+		size, err := strconv.ParseUint(line, 16, 31)
+		if err != nil {
+			return 0, fmt.Errorf("Invalid chunk size %q", line)
+		}
+		if size == 0 {
+			m.pos, m.trailer = next, true
+			continue
+		}
+		end := next + int(size)
+		switch {
+		case len(buf) > end && buf[end] == '\n':
+			m.pos = end + 1
+		case len(buf) > end+1 && buf[end] == '\r' && buf[end+1] == '\n':
+			m.pos = end + 2
+		case len(buf) < end+2:
+			return 0, nil
+		default:
+			return 0, fmt.Errorf("Chunk not followed by a line break")
+		}
+		m.decoded = append(m.decoded, buf[next:end]...)
+	}
+}
+
+// dechunked returns m with its decoded body, and a Content-Length instead
+// of the Transfer-Encoding.
+func (m *httpMessage) dechunked() []byte {
+	var out []byte
+	lines := strings.Split(strings.TrimRight(string(m.header), "\r\n"), "\n")
+	for i, line := range lines {
+		line = strings.TrimRight(line, "\r")
+		if i > 0 && strings.HasPrefix(strings.ToLower(line), "transfer-encoding:") {
+			continue
+		}
+		out = append(out, line...)
+		out = append(out, "\r\n"...)
+	}
+	out = append(out, fmt.Sprintf("Content-Length: %d\r\n\r\n", len(m.decoded))...)
+	return append(out, m.decoded...)
+}
+
+// next returns the next message of side and its metadata if it is all
+// there, along with how much of side.buf it takes, 0 if it is not.
+func (c *httpConversation) next(side *httpSide, dechunk bool) (int, []byte, pkt.Metadata, error) {
+	if side.msg == nil {
+		if err := c.start(side); err != nil || side.msg == nil {
+			return 0, nil, nil, err
+		}
+	}
+	m := side.msg
+	var n int
+	record := side.buf
+	switch {
+	case m.chunked:
+		end, err := m.chunks(side.buf)
+		if err != nil || end == 0 {
+			return 0, nil, nil, err
+		}
+		n = end
+		record = side.buf[:end]
+		if dechunk {
+			record = m.dechunked()
+		}
+	case m.length < 0:
+		// The body ends with the connection
+		return 0, nil, nil, nil
+	default:
+		n = len(m.header) + m.length
+		if len(side.buf) < n {
+			return 0, nil, nil, nil
+		}
+		record = side.buf[:n]
+	}
+	side.msg = nil
+	c.raw = m.upgrade
+	return n, record, m.meta(c.meta), nil
+}
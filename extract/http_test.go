@@ -0,0 +1,153 @@
+package extract
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+
+	"github.com/JustinAzoff/pcap_simplify/pkt"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+const (
+	httpRequests = "GET /a HTTP/1.1\r\nHost: example.com\r\n\r\n" +
+		"HEAD /h HTTP/1.1\r\nHost: example.com\r\n\r\n" +
+		"POST /b HTTP/1.1\r\nContent-Type: text/plain\r\nContent-Length: 5\r\n\r\nhello"
+	httpChunked  = "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabc\r\n2;ext\r\nde\r\n0\r\n\r\n"
+	httpHead     = "HTTP/1.1 200 OK\r\nContent-Length: 10\r\n\r\n"
+	httpUntilEnd = "HTTP/1.0 201 Created\r\n\r\ncreated"
+)
+
+// httpCapture writes an HTTP conversation on port 80, cut in segments of
+// 7 bytes with the second and third of each side swapped, and a
+// conversation that is not HTTP on port 22.
+func httpCapture(t *testing.T) *Reader {
+	var file bytes.Buffer
+	pw := pcapgo.NewWriter(&file)
+	if err := pw.WriteFileHeader(65536, layers.LinkTypeRaw); err != nil {
+		t.Fatal(err)
+	}
+	for _, side := range []struct {
+		client bool
+		data   string
+	}{
+		{true, httpRequests},
+		{false, httpChunked + httpHead + httpUntilEnd},
+	} {
+		var segments []tcpSegment
+		for i := 0; i < len(side.data); i += 7 {
+			end := i + 7
+			if end > len(side.data) {
+				end = len(side.data)
+			}
+			segments = append(segments, tcpSegment{side.client, uint32(100 + i), []byte(side.data[i:end])})
+		}
+		segments[1], segments[2] = segments[2], segments[1]
+		for _, s := range segments {
+			writeTCPSegment(t, pw, s.client, 40000, 80, s.seq, s.data)
+		}
+	}
+	writeTCPSegment(t, pw, true, 40001, 22, 1, []byte("SSH-2.0-"))
+	writeTCPSegment(t, pw, true, 40001, 22, 9, []byte("test\r\n"))
+	r, err := NewReader(bytes.NewReader(file.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+type httpRecord struct {
+	isOrig  bool
+	payload string
+	method  string
+	uri     string
+	status  string
+}
+
+func TestSimplifyHTTP(t *testing.T) {
+	for _, dechunk := range []bool{false, true} {
+		opts := Options{HTTP: &HTTPOptions{Dechunk: dechunk}}
+		var out bytes.Buffer
+		if _, _, err := Simplify(httpCapture(t), &out, opts); err != nil {
+			t.Fatal(err)
+		}
+		r, err := pkt.NewReader(out.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []httpRecord
+		for {
+			isOrig, payload, err := r.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, httpRecord{isOrig, string(payload), r.Metadata["http_method"], r.Metadata["http_uri"], r.Metadata["http_status"]})
+		}
+
+		chunked := httpChunked
+		if dechunk {
+			chunked = "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nContent-Length: 5\r\n\r\nabcde"
+		}
+		want := []httpRecord{
+			{true, "GET /a HTTP/1.1\r\nHost: example.com\r\n\r\n", "GET", "/a", ""},
+			{true, "HEAD /h HTTP/1.1\r\nHost: example.com\r\n\r\n", "HEAD", "/h", ""},
+			{true, "POST /b HTTP/1.1\r\nContent-Type: text/plain\r\nContent-Length: 5\r\n\r\nhello", "POST", "/b", ""},
+			{false, chunked, "GET", "/a", "200"},
+			{false, httpHead, "HEAD", "/h", "200"},
+			// Data that is not HTTP comes as it arrives
+			{false, "SSH-2.0-", "", "", ""},
+			{false, "test\r\n", "", "", ""},
+			// The body of the last response ends with the conversation
+			{false, httpUntilEnd, "POST", "/b", "201"},
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("dechunk %v: got records\n%v\nexpected\n%v", dechunk, got, want)
+		}
+
+		messages := opts.HTTP.Messages
+		if len(messages) != 6 {
+			t.Fatalf("dechunk %v: %d messages in the manifest, expected 6", dechunk, len(messages))
+		}
+		if m := messages[3]; m.Record != 4 || m.Request || m.Method != "GET" || m.Status != 200 || m.ContentType != "text/plain" || m.Bytes != len(chunked) {
+			t.Errorf("dechunk %v: manifest entry %+v", dechunk, m)
+		}
+		if m := messages[5]; m.Record != 8 || m.Status != 201 || m.URI != "/b" {
+			t.Errorf("dechunk %v: manifest entry %+v", dechunk, m)
+		}
+	}
+}
+
+func TestHTTPChunks(t *testing.T) {
+	for _, tt := range []struct {
+		body    string
+		end     int
+		decoded string
+		bad     bool
+	}{
+		{"3\r\nabc\r\n0\r\n\r\n", 13, "abc", false},
+		{"3\r\nabc\r\n0\r\nTrailer: x\r\n\r\n", 25, "abc", false},
+		{"3\nabc\n0\n\n", 9, "abc", false},
+		{"3\r\nabc\r\n", 0, "abc", false},
+		{"3\r\nab", 0, "", false},
+		{"zz\r\n", 0, "", true},
+		{"3\r\nabcd\r\n", 0, "", true},
+	} {
+		m := &httpMessage{header: []byte("H\r\n\r\n")}
+		end, err := m.chunks(append([]byte("H\r\n\r\n"), tt.body...))
+		if (err != nil) != tt.bad {
+			t.Errorf("%q: error %v", tt.body, err)
+			continue
+		}
+		if end != 0 {
+			end -= len(m.header)
+		}
+		if !tt.bad && (end != tt.end || string(m.decoded) != tt.decoded) {
+			t.Errorf("%q: end %d and %q, expected %d and %q", tt.body, end, m.decoded, tt.end, tt.decoded)
+		}
+	}
+}
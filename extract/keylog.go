@@ -0,0 +1,78 @@
+package extract
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// KeyLog holds the TLS secrets of an NSS key log file, the format browsers,
+// curl and Go's crypto/tls write to the file named by SSLKEYLOGFILE.
+type KeyLog struct {
+	// secrets maps the label of a secret and the client random of the
+	// session, in hex, to the secret
+	secrets map[string]map[string][]byte
+}
+
+// ReadKeyLog reads an NSS key log file. Each line holds a label, the
+// client random of a session and a secret, all but the label in hex.
+func ReadKeyLog(r io.Reader) (*KeyLog, error) {
+	k := &KeyLog{secrets: map[string]map[string][]byte{}}
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("Line %d of the key log: expected a label, a client random and a secret", n)
+		}
+		random, err := hex.DecodeString(fields[1])
+		if err != nil || len(random) != 32 {
+			return nil, fmt.Errorf("Line %d of the key log: invalid client random %q", n, fields[1])
+		}
+		secret, err := hex.DecodeString(fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("Line %d of the key log: invalid secret", n)
+		}
+		if k.secrets[fields[0]] == nil {
+			k.secrets[fields[0]] = map[string][]byte{}
+		}
+		k.secrets[fields[0]][hex.EncodeToString(random)] = secret
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// Len is the number of sessions k has secrets for.
+func (k *KeyLog) Len() int {
+	sessions := map[string]bool{}
+	for _, secrets := range k.secrets {
+		for random := range secrets {
+			sessions[random] = true
+		}
+	}
+	return len(sessions)
+}
+
+// secret returns the secret with label of the session with clientRandom,
+// or nil if there is none.
+func (k *KeyLog) secret(label string, clientRandom []byte) []byte {
+	return k.secrets[label][hex.EncodeToString(clientRandom)]
+}
+
+// has is whether k has any secret of the session with clientRandom.
+func (k *KeyLog) has(clientRandom []byte) bool {
+	random := hex.EncodeToString(clientRandom)
+	for _, secrets := range k.secrets {
+		if secrets[random] != nil {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,160 @@
+package extract
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/JustinAzoff/pcap_simplify/internal/pcapng"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// LinkType is a pcap link type. layers.LinkType is only 8 bits wide, which
+// is too small for newer types such as Linux SLL2.
+type LinkType uint16
+
+const (
+	// LinkTypeLinuxSLL2 is written by tcpdump -i any with newer versions
+	// of libpcap.
+	LinkTypeLinuxSLL2 LinkType = 276
+)
+
+func (lt LinkType) String() string {
+	if lt == LinkTypeLinuxSLL2 {
+		return "LinuxSLL2"
+	}
+	if lt < 256 {
+		return layers.LinkType(lt).String()
+	}
+	return fmt.Sprintf("LinkType(%d)", uint16(lt))
+}
+
+// linkTypes maps every link type the extractors have been tested with to
+// the decoder for it.
+var linkTypes = map[LinkType]gopacket.Decoder{
+	LinkType(layers.LinkTypeEthernet): layers.LinkTypeEthernet,
+	LinkType(layers.LinkTypeNull):     layers.LinkTypeNull,
+	LinkType(layers.LinkTypeLoop):     layers.LinkTypeLoop,
+	LinkType(layers.LinkTypeRaw):      layers.LinkTypeRaw,
+	LinkType(layers.LinkTypeIPv4):     layers.LayerTypeIPv4,
+	LinkType(layers.LinkTypeIPv6):     layers.LayerTypeIPv6,
+	LinkType(layers.LinkTypeLinuxSLL): layers.LinkTypeLinuxSLL,
+	LinkTypeLinuxSLL2:                 gopacket.DecodeFunc(decodeLinuxSLL2),
+	// gopacket expects 802.11 frames without radiotap to end in an FCS
+	LinkType(layers.LinkTypeIEEE802_11):     layers.LinkTypeIEEE802_11,
+	LinkType(layers.LinkTypeIEEE80211Radio): layers.LinkTypeIEEE80211Radio,
+}
+
+// LinkDecoder returns the decoder for packets captured with link type lt,
+// or an error if the extractors can't handle it. Without this check an
+// unknown link type decodes every packet as a failure and the extractors
+// silently write an empty file.
+func LinkDecoder(lt LinkType) (gopacket.Decoder, error) {
+	if d, ok := linkTypes[lt]; ok {
+		return d, nil
+	}
+	return nil, fmt.Errorf("Unsupported link type %v (%d), supported link types are Ethernet, Null, Loop, Raw, IPv4, IPv6, Linux SLL, Linux SLL2, 802.11 and 802.11 radiotap", lt, uint16(lt))
+}
+
+// Reader reads a pcap or pcapng file just like pcapgo.Reader and
+// pcapgo.NgReader, but keeps the full link type from the file header.
+type Reader struct {
+	gopacket.PacketDataSource
+	linkType LinkType
+}
+
+// maxSnaplen is the largest packet read from a pcap file, the same limit
+// tcpdump uses. The snaplen in the file header is ignored, it is too small
+// in files written by some tools and a corrupt header could make every
+// packet allocate gigabytes.
+const maxSnaplen = 262144
+
+func NewReader(r io.Reader) (*Reader, error) {
+	header := make([]byte, 24)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if binary.LittleEndian.Uint32(header[0:4]) == pcapng.BlockSectionHeader {
+		return newNgReader(io.MultiReader(bytes.NewReader(header), r))
+	}
+	var order binary.ByteOrder = binary.BigEndian
+	switch binary.LittleEndian.Uint32(header[0:4]) {
+	case 0xa1b2c3d4, 0xa1b23c4d:
+		order = binary.LittleEndian
+	}
+	pr, err := pcapgo.NewReader(io.MultiReader(bytes.NewReader(header), r))
+	if err != nil {
+		return nil, err
+	}
+	pr.SetSnaplen(maxSnaplen)
+	// The upper 16 bits of the link type field hold the FCS length
+	return &Reader{
+		PacketDataSource: pr,
+		linkType:         LinkType(order.Uint32(header[20:24]) & 0xffff),
+	}, nil
+}
+
+// LinkType returns the link type of the packets in the file.
+func (r *Reader) LinkType() LinkType {
+	return r.linkType
+}
+
+// LayerTypeLinuxSLL2 is the layer type of LinuxSLL2.
+var LayerTypeLinuxSLL2 = gopacket.RegisterLayerType(1276, gopacket.LayerTypeMetadata{
+	Name:    "LinuxSLL2",
+	Decoder: gopacket.DecodeFunc(decodeLinuxSLL2),
+})
+
+// LinuxSLL2 is the Linux "cooked" capture header version 2, see
+// https://www.tcpdump.org/linktypes/LINKTYPE_LINUX_SLL2.html
+type LinuxSLL2 struct {
+	layers.BaseLayer
+	ProtocolType    layers.EthernetType
+	InterfaceIndex  uint32
+	ARPHardwareType uint16
+	PacketType      layers.LinuxSLLPacketType
+	Addr            net.HardwareAddr
+}
+
+func (s *LinuxSLL2) LayerType() gopacket.LayerType { return LayerTypeLinuxSLL2 }
+
+func (s *LinuxSLL2) CanDecode() gopacket.LayerClass { return LayerTypeLinuxSLL2 }
+
+func (s *LinuxSLL2) NextLayerType() gopacket.LayerType { return s.ProtocolType.LayerType() }
+
+func (s *LinuxSLL2) LinkFlow() gopacket.Flow {
+	return gopacket.NewFlow(layers.EndpointMAC, s.Addr, nil)
+}
+
+func (s *LinuxSLL2) DecodeFromBytes(data []byte, df gopacket.DecodeFeedback) error {
+	if len(data) < 20 {
+		df.SetTruncated()
+		return errors.New("Linux SLL2 packet too small")
+	}
+	s.ProtocolType = layers.EthernetType(binary.BigEndian.Uint16(data[0:2]))
+	s.InterfaceIndex = binary.BigEndian.Uint32(data[4:8])
+	s.ARPHardwareType = binary.BigEndian.Uint16(data[8:10])
+	s.PacketType = layers.LinuxSLLPacketType(data[10])
+	addrLen := int(data[11])
+	if addrLen > 8 {
+		addrLen = 8
+	}
+	s.Addr = net.HardwareAddr(data[12 : 12+addrLen])
+	s.BaseLayer = layers.BaseLayer{Contents: data[:20], Payload: data[20:]}
+	return nil
+}
+
+func decodeLinuxSLL2(data []byte, p gopacket.PacketBuilder) error {
+	s := &LinuxSLL2{}
+	if err := s.DecodeFromBytes(data, p); err != nil {
+		return err
+	}
+	p.AddLayer(s)
+	p.SetLinkLayer(s)
+	return p.NextDecoder(s.ProtocolType)
+}
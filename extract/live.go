@@ -0,0 +1,163 @@
+package extract
+
+import (
+	"io"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// LiveSource is a network interface open for capturing, such as a
+// pcap.Handle.
+type LiveSource interface {
+	gopacket.PacketDataSource
+	LinkType() layers.LinkType
+}
+
+// Stop says when a live capture ends, whichever comes first. The zero Stop
+// only ends it when the source fails.
+type Stop struct {
+	// Packets is how many packets to capture
+	Packets int
+	// Duration is how long to capture for
+	Duration time.Duration
+	// FlowClosed ends the capture once the first TCP connection seen is
+	// closed, by a FIN from both sides or a RST
+	FlowClosed bool
+	// Done ends the capture when it is closed, such as on an interrupt
+	Done <-chan struct{}
+}
+
+// livePacket is what a read from a LiveSource returned.
+type livePacket struct {
+	data []byte
+	ci   gopacket.CaptureInfo
+	err  error
+}
+
+// liveSource reads the packets of a LiveSource in the background, so the
+// capture can end while a read waits for a packet that may never come.
+type liveSource struct {
+	packets chan livePacket
+	done    chan struct{}
+	stop    Stop
+	timeout <-chan time.Time
+	closing *flowClosing
+	count   int
+	over    bool
+}
+
+// NewLiveReader returns a Reader of the packets captured by src, which
+// ends with io.EOF once stop says so. The caller closes src once done with
+// the Reader, a read it was waiting on is then thrown away.
+func NewLiveReader(src LiveSource, stop Stop) (*Reader, error) {
+	lt := LinkType(src.LinkType())
+	dec, err := LinkDecoder(lt)
+	if err != nil {
+		return nil, err
+	}
+	s := &liveSource{
+		packets: make(chan livePacket),
+		done:    make(chan struct{}),
+		stop:    stop,
+	}
+	if stop.Duration > 0 {
+		s.timeout = time.After(stop.Duration)
+	}
+	if stop.FlowClosed {
+		s.closing = &flowClosing{dec: dec, fin: map[string]bool{}}
+	}
+	go func() {
+		for {
+			data, ci, err := src.ReadPacketData()
+			select {
+			case s.packets <- livePacket{data, ci, err}:
+			case <-s.done:
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return &Reader{PacketDataSource: s, linkType: lt}, nil
+}
+
+// finish stops the reads in the background.
+func (s *liveSource) finish() {
+	if !s.over {
+		s.over = true
+		close(s.done)
+	}
+}
+
+func (s *liveSource) end() ([]byte, gopacket.CaptureInfo, error) {
+	s.finish()
+	return nil, gopacket.CaptureInfo{}, io.EOF
+}
+
+func (s *liveSource) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	if s.over || (s.stop.Packets > 0 && s.count >= s.stop.Packets) {
+		return s.end()
+	}
+	// A capture that is over ends even if packets are waiting
+	select {
+	case <-s.timeout:
+		return s.end()
+	case <-s.stop.Done:
+		return s.end()
+	default:
+	}
+	var p livePacket
+	select {
+	case p = <-s.packets:
+	case <-s.timeout:
+		return s.end()
+	case <-s.stop.Done:
+		return s.end()
+	}
+	if p.err != nil {
+		s.finish()
+		return nil, p.ci, p.err
+	}
+	s.count++
+	if s.closing != nil && s.closing.closes(p.data) {
+		// This packet is still read, the next one is not
+		s.finish()
+	}
+	return p.data, p.ci, nil
+}
+
+// flowClosing tells when the first TCP connection seen is closed.
+type flowClosing struct {
+	dec          gopacket.Decoder
+	conversation string
+	// fin holds the sides that sent a FIN
+	fin map[string]bool
+}
+
+// closes is whether the packet data closes the connection.
+func (f *flowClosing) closes(data []byte) bool {
+	packet := gopacket.NewPacket(data, f.dec, gopacket.NoCopy)
+	nl := packet.NetworkLayer()
+	tcp, ok := packet.Layer(layers.LayerTypeTCP).(*layers.TCP)
+	if nl == nil || !ok {
+		return false
+	}
+	src, dst := tcp.TransportFlow().Src().String(), tcp.TransportFlow().Dst().String()
+	c := conversation(ProtoTCP, nl, src, dst)
+	if f.conversation == "" {
+		f.conversation = c
+	}
+	if c != f.conversation {
+		return false
+	}
+	if tcp.RST {
+		return true
+	}
+	if tcp.FIN {
+		f.fin[nl.NetworkFlow().Src().String()+" "+src] = true
+	}
+	return len(f.fin) == 2
+}
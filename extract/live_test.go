@@ -0,0 +1,112 @@
+package extract
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// fakeSource hands out packets, then blocks like an interface with no
+// traffic.
+type fakeSource struct {
+	packets [][]byte
+}
+
+func (s *fakeSource) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	if len(s.packets) == 0 {
+		select {}
+	}
+	data := s.packets[0]
+	s.packets = s.packets[1:]
+	ci := gopacket.CaptureInfo{Timestamp: time.Unix(1600000000, 0), CaptureLength: len(data), Length: len(data)}
+	return data, ci, nil
+}
+
+func (s *fakeSource) LinkType() layers.LinkType {
+	return layers.LinkTypeRaw
+}
+
+// failingSource fails every read.
+type failingSource struct{}
+
+func (failingSource) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	return nil, gopacket.CaptureInfo{}, errors.New("interface went down")
+}
+
+func (failingSource) LinkType() layers.LinkType {
+	return layers.LinkTypeRaw
+}
+
+// tcpPacket returns a raw IPv4 TCP packet between 10.0.0.1, the client, and
+// 10.0.0.2 on port 80.
+func tcpPacket(t *testing.T, client bool, sport int, fin, rst bool, payload string) []byte {
+	src, dst := net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2")
+	dport := 80
+	if !client {
+		src, dst, sport, dport = dst, src, dport, sport
+	}
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: src, DstIP: dst}
+	tcp := &layers.TCP{SrcPort: layers.TCPPort(sport), DstPort: layers.TCPPort(dport), ACK: true, FIN: fin, RST: rst, Window: 65535}
+	tcp.SetNetworkLayerForChecksum(ip)
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, ip, tcp, gopacket.Payload(payload)); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestLiveReader(t *testing.T) {
+	packets := [][]byte{
+		tcpPacket(t, true, 40000, false, false, "hello"),
+		// Another connection closing doesn't count
+		tcpPacket(t, true, 40001, false, true, ""),
+		tcpPacket(t, false, 40000, false, false, "world"),
+		tcpPacket(t, true, 40000, true, false, ""),
+		tcpPacket(t, false, 40000, true, false, ""),
+		tcpPacket(t, true, 40000, false, false, "late"),
+	}
+	done := make(chan struct{})
+	close(done)
+	for _, tt := range []struct {
+		name    string
+		stop    Stop
+		packets int
+	}{
+		{"count", Stop{Packets: 2}, 2},
+		{"flow closed", Stop{FlowClosed: true}, 5},
+		{"duration", Stop{Duration: 50 * time.Millisecond}, 6},
+		{"done", Stop{Done: done}, 0},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := NewLiveReader(&fakeSource{packets: packets}, tt.stop)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var out bytes.Buffer
+			totalPackets, _, err := Simplify(r, &out, Options{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if totalPackets != tt.packets {
+				t.Errorf("read %d packets, expected %d", totalPackets, tt.packets)
+			}
+		})
+	}
+}
+
+func TestLiveReaderError(t *testing.T) {
+	r, err := NewLiveReader(failingSource{}, Stop{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if _, _, err := Simplify(r, &out, Options{}); err == nil {
+		t.Error("expected the error of the source")
+	}
+}
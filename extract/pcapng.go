@@ -0,0 +1,287 @@
+package extract
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/JustinAzoff/pcap_simplify/internal/pcapng"
+	"github.com/google/gopacket"
+)
+
+// ngMaxBlockLength bounds the memory a single block can take
+const ngMaxBlockLength = 16 << 20
+
+// ngInterface is what ngReader keeps of an interface description block.
+type ngInterface struct {
+	linkType LinkType
+	snaplen  uint32
+	// ticksPerSecond is the unit of the packet timestamps
+	ticksPerSecond uint64
+	// offset in seconds is added to every timestamp
+	offset int64
+}
+
+// ngReader reads the packets of a pcapng file.
+//
+// pcapgo.NgReader truncates link types to 8 bits, panics on some invalid
+// options and allocates whatever the packet lengths in a file ask for, so
+// the few blocks needed here are read directly. Blocks other than section
+// headers, interface descriptions and packets are skipped.
+//
+// Every packet is decoded with the link type of the first interface, so a
+// packet on an interface of another link type is an error.
+type ngReader struct {
+	r        *bufio.Reader
+	order    binary.ByteOrder
+	ifaces   []ngInterface
+	linkType LinkType
+}
+
+// newNgReader reads the section header and the first interface
+// description of the pcapng file in r.
+func newNgReader(r io.Reader) (*Reader, error) {
+	ng := &ngReader{r: bufio.NewReader(r)}
+	for len(ng.ifaces) == 0 {
+		typ, body, err := ng.readBlock()
+		if err == io.EOF {
+			return nil, errors.New("No interface description in the pcapng file")
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch typ {
+		case pcapng.BlockPacket, pcapng.BlockSimplePacket, pcapng.BlockEnhancedPacket:
+			return nil, errors.New("Packet before the first interface description in the pcapng file")
+		}
+		if err := ng.handle(typ, body); err != nil {
+			return nil, err
+		}
+	}
+	ng.linkType = ng.ifaces[0].linkType
+	return &Reader{
+		PacketDataSource: ng,
+		linkType:         ng.linkType,
+	}, nil
+}
+
+// readBlock returns the type and the body of the next block. The body of
+// a section header block starts after the byte order magic.
+func (ng *ngReader) readBlock() (uint32, []byte, error) {
+	var header [12]byte
+	if _, err := io.ReadFull(ng.r, header[:8]); err != nil {
+		return 0, nil, err
+	}
+	typ := binary.LittleEndian.Uint32(header[0:4])
+	read := 8
+	if typ == pcapng.BlockSectionHeader {
+		// The byte order of a section is only known from the magic
+		// that follows the block length
+		if _, err := io.ReadFull(ng.r, header[8:12]); err != nil {
+			return 0, nil, unexpected(err)
+		}
+		switch {
+		case binary.LittleEndian.Uint32(header[8:12]) == pcapng.ByteOrderMagic:
+			ng.order = binary.LittleEndian
+		case binary.BigEndian.Uint32(header[8:12]) == pcapng.ByteOrderMagic:
+			ng.order = binary.BigEndian
+		default:
+			return 0, nil, fmt.Errorf("Invalid pcapng byte order magic %x", header[8:12])
+		}
+		read = 12
+	} else if ng.order == nil {
+		return 0, nil, errors.New("No section header at the start of the pcapng file")
+	} else {
+		typ = ng.order.Uint32(header[0:4])
+	}
+	length := ng.order.Uint32(header[4:8])
+	if length < uint32(read)+4 || length > ngMaxBlockLength || length%4 != 0 {
+		return 0, nil, fmt.Errorf("Invalid pcapng block length %d", length)
+	}
+	body := make([]byte, int(length)-read)
+	if _, err := io.ReadFull(ng.r, body); err != nil {
+		return 0, nil, unexpected(err)
+	}
+	// The block ends with its length again
+	if trailer := ng.order.Uint32(body[len(body)-4:]); trailer != length {
+		return 0, nil, fmt.Errorf("Invalid pcapng block, length %d at the end, %d at the start", trailer, length)
+	}
+	return typ, body[:len(body)-4], nil
+}
+
+// unexpected turns io.EOF in the middle of a block into io.ErrUnexpectedEOF.
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// handle processes the blocks that aren't packets.
+func (ng *ngReader) handle(typ uint32, body []byte) error {
+	switch typ {
+	case pcapng.BlockSectionHeader:
+		if len(body) < 12 {
+			return errors.New("Pcapng section header is too short")
+		}
+		if v := ng.order.Uint16(body[0:2]); v != pcapng.MajorVersion {
+			return fmt.Errorf("Unsupported pcapng version %d", v)
+		}
+		// Interfaces are numbered per section
+		ng.ifaces = nil
+	case pcapng.BlockInterface:
+		iface, err := ng.parseInterface(body)
+		if err != nil {
+			return err
+		}
+		ng.ifaces = append(ng.ifaces, iface)
+	}
+	return nil
+}
+
+func (ng *ngReader) parseInterface(body []byte) (ngInterface, error) {
+	if len(body) < 8 {
+		return ngInterface{}, errors.New("Pcapng interface description is too short")
+	}
+	iface := ngInterface{
+		linkType:       LinkType(ng.order.Uint16(body[0:2])),
+		snaplen:        ng.order.Uint32(body[4:8]),
+		ticksPerSecond: 1000000,
+	}
+	options := body[8:]
+	for len(options) >= 4 {
+		code := ng.order.Uint16(options[0:2])
+		length := int(ng.order.Uint16(options[2:4]))
+		options = options[4:]
+		if code == pcapng.OptionEnd {
+			break
+		}
+		if length > len(options) {
+			return iface, fmt.Errorf("Pcapng option %d is longer than its block", code)
+		}
+		value := options[:length]
+		options = options[(length+3)&^3:]
+		switch code {
+		case pcapng.OptionIfTsResol:
+			if length != 1 {
+				return iface, fmt.Errorf("Invalid pcapng timestamp resolution length %d", length)
+			}
+			ticks, err := ticksPerSecond(value[0])
+			if err != nil {
+				return iface, err
+			}
+			iface.ticksPerSecond = ticks
+		case pcapng.OptionIfTsOffset:
+			if length != 8 {
+				return iface, fmt.Errorf("Invalid pcapng timestamp offset length %d", length)
+			}
+			iface.offset = int64(ng.order.Uint64(value))
+		}
+	}
+	return iface, nil
+}
+
+// ticksPerSecond decodes if_tsresol, a negative power of 10, or of 2 when
+// the high bit is set.
+func ticksPerSecond(resol byte) (uint64, error) {
+	exp := uint64(resol & 0x7f)
+	if resol&0x80 != 0 {
+		if exp > 63 {
+			return 0, fmt.Errorf("Invalid pcapng timestamp resolution 2^-%d", exp)
+		}
+		return 1 << exp, nil
+	}
+	if exp > 19 {
+		return 0, fmt.Errorf("Invalid pcapng timestamp resolution 10^-%d", exp)
+	}
+	ticks := uint64(1)
+	for i := uint64(0); i < exp; i++ {
+		ticks *= 10
+	}
+	return ticks, nil
+}
+
+func (ng *ngReader) iface(index uint32) (ngInterface, error) {
+	if int64(index) >= int64(len(ng.ifaces)) {
+		return ngInterface{}, fmt.Errorf("Packet for interface %d, but the section only describes %d", index, len(ng.ifaces))
+	}
+	iface := ng.ifaces[index]
+	if iface.linkType != ng.linkType {
+		return iface, fmt.Errorf("Packet for interface %d with link type %v, but the file started with %v, mixed link types are not supported", index, iface.linkType, ng.linkType)
+	}
+	return iface, nil
+}
+
+func (iface ngInterface) timestamp(ticks uint64) time.Time {
+	sec := ticks / iface.ticksPerSecond
+	frac := ticks % iface.ticksPerSecond
+	nsec := int64(float64(frac) / float64(iface.ticksPerSecond) * 1e9)
+	return time.Unix(int64(sec)+iface.offset, nsec).UTC()
+}
+
+// ReadPacketData returns the next packet in the file.
+func (ng *ngReader) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	for {
+		typ, body, err := ng.readBlock()
+		if err != nil {
+			return nil, gopacket.CaptureInfo{}, err
+		}
+		var ci gopacket.CaptureInfo
+		var data []byte
+		switch typ {
+		case pcapng.BlockEnhancedPacket, pcapng.BlockPacket:
+			if len(body) < 20 {
+				return nil, ci, errors.New("Pcapng packet block is too short")
+			}
+			index := ng.order.Uint32(body[0:4])
+			if typ == pcapng.BlockPacket {
+				// The obsolete packet block has a 16 bit interface id
+				// followed by a drop count
+				index = uint32(ng.order.Uint16(body[0:2]))
+			}
+			iface, err := ng.iface(index)
+			if err != nil {
+				return nil, ci, err
+			}
+			ticks := uint64(ng.order.Uint32(body[4:8]))<<32 | uint64(ng.order.Uint32(body[8:12]))
+			caplen := ng.order.Uint32(body[12:16])
+			if uint64(caplen) > uint64(len(body)-20) {
+				return nil, ci, fmt.Errorf("Pcapng packet length %d is longer than its block", caplen)
+			}
+			data = body[20 : 20+caplen]
+			ci.Timestamp = iface.timestamp(ticks)
+			ci.Length = int(ng.order.Uint32(body[16:20]))
+			ci.InterfaceIndex = int(index)
+		case pcapng.BlockSimplePacket:
+			if len(body) < 4 {
+				return nil, ci, errors.New("Pcapng simple packet block is too short")
+			}
+			iface, err := ng.iface(0)
+			if err != nil {
+				return nil, ci, err
+			}
+			data = body[4:]
+			ci.Length = int(ng.order.Uint32(body[0:4]))
+			if ci.Length < len(data) {
+				// The rest is padding
+				data = data[:ci.Length]
+			}
+			if iface.snaplen != 0 && uint32(len(data)) > iface.snaplen {
+				data = data[:iface.snaplen]
+			}
+		default:
+			if err := ng.handle(typ, body); err != nil {
+				return nil, ci, err
+			}
+			continue
+		}
+		ci.CaptureLength = len(data)
+		if ci.Length < ci.CaptureLength {
+			ci.Length = ci.CaptureLength
+		}
+		return data, ci, nil
+	}
+}
@@ -0,0 +1,96 @@
+package extract
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/JustinAzoff/pcap_simplify/internal/pcapng"
+)
+
+func ngBlock(typ uint32, body ...[]byte) []byte {
+	data := bytes.Join(body, nil)
+	for len(data)%4 != 0 {
+		data = append(data, 0)
+	}
+	length := le32(uint32(len(data) + 12))
+	return bytes.Join([][]byte{le32(typ), length, data, length}, nil)
+}
+
+func le16(v uint16) []byte {
+	b := make([]byte, 2)
+	binary.LittleEndian.PutUint16(b, v)
+	return b
+}
+
+func le32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, v)
+	return b
+}
+
+var ngSection = ngBlock(pcapng.BlockSectionHeader, le32(pcapng.ByteOrderMagic), le16(1), le16(0), bytes.Repeat([]byte{0xff}, 8))
+
+func ngInterfaceBlock(linkType uint16, options ...[]byte) []byte {
+	return ngBlock(pcapng.BlockInterface, append([][]byte{le16(linkType), le16(0), le32(0)}, options...)...)
+}
+
+func ngPacket(index uint32, ticks uint64, data []byte) []byte {
+	return ngBlock(pcapng.BlockEnhancedPacket, le32(index), le32(uint32(ticks>>32)), le32(uint32(ticks)), le32(uint32(len(data))), le32(uint32(len(data))), data)
+}
+
+func TestNgReader(t *testing.T) {
+	tsresol := append(append(le16(pcapng.OptionIfTsResol), le16(1)...), 9, 0, 0, 0)
+	file := bytes.Join([][]byte{
+		ngSection,
+		ngInterfaceBlock(uint16(LinkTypeLinuxSLL2), tsresol, le32(0)),
+		ngBlock(0x0BAD, []byte("skipped")),
+		ngPacket(0, 1500000000123456789, []byte("first")),
+		ngBlock(pcapng.BlockSimplePacket, le32(6), []byte("second")),
+	}, nil)
+	r, err := NewReader(bytes.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.LinkType() != LinkTypeLinuxSLL2 {
+		t.Errorf("link type %v, expected Linux SLL2", r.LinkType())
+	}
+	data, ci, err := r.ReadPacketData()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Unix(1500000000, 123456789); string(data) != "first" || !ci.Timestamp.Equal(want) {
+		t.Errorf("got %q at %v, expected \"first\" at %v", data, ci.Timestamp, want)
+	}
+	if data, _, err = r.ReadPacketData(); err != nil || string(data) != "second" {
+		t.Errorf("got %q, %v, expected \"second\"", data, err)
+	}
+	if _, _, err = r.ReadPacketData(); err != io.EOF {
+		t.Errorf("got %v at the end, expected EOF", err)
+	}
+}
+
+func TestNgReaderInvalid(t *testing.T) {
+	iface := ngInterfaceBlock(1)
+	huge := ngPacket(0, 0, []byte("data"))
+	binary.LittleEndian.PutUint32(huge[20:], 0xffffffff)
+	for name, file := range map[string][]byte{
+		"no interface":  ngSection,
+		"bad tsresol":   bytes.Join([][]byte{ngSection, ngInterfaceBlock(1, le16(pcapng.OptionIfTsResol), le16(1), []byte{0x7f})}, nil),
+		"bad interface": bytes.Join([][]byte{ngSection, iface, ngPacket(1, 0, []byte("data"))}, nil),
+		"mixed links":   bytes.Join([][]byte{ngSection, iface, ngInterfaceBlock(101), ngPacket(1, 0, []byte("data"))}, nil),
+		"huge packet":   bytes.Join([][]byte{ngSection, iface, huge}, nil),
+		"bad length":    bytes.Join([][]byte{ngSection, iface, ngBlock(pcapng.BlockEnhancedPacket)[:4], le32(0xfffffff0)}, nil),
+		"truncated":     bytes.Join([][]byte{ngSection, iface, ngPacket(0, 0, []byte("data"))[:30]}, nil),
+	} {
+		r, err := NewReader(bytes.NewReader(file))
+		if err == nil {
+			_, _, err = r.ReadPacketData()
+		}
+		if err == nil || err == io.EOF {
+			t.Errorf("%s: got %v, expected an error", name, err)
+		}
+	}
+}
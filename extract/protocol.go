@@ -0,0 +1,240 @@
+package extract
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/JustinAzoff/pcap_simplify/pkt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// The protocols Simplify and Split extract records from, as recorded in
+// the protocol metadata.
+const (
+	ProtoTCP    = "tcp"
+	ProtoUDP    = "udp"
+	ProtoSCTP   = "sctp"
+	ProtoICMP   = "icmp"
+	ProtoICMPv6 = "icmpv6"
+	// ProtoIP is any other IP protocol, the ip_protocol metadata holds its
+	// number and the records the whole IP payload
+	ProtoIP = "ip"
+)
+
+var protocolNames = []string{ProtoTCP, ProtoUDP, ProtoSCTP, ProtoICMP, ProtoICMPv6, ProtoIP}
+
+// Protocols is the set of protocols to extract records from.
+type Protocols map[string]bool
+
+// DefaultProtocols is what is extracted when Options.Protocols is nil.
+var DefaultProtocols = Protocols{ProtoTCP: true, ProtoUDP: true, ProtoSCTP: true}
+
+// ParseProtocols parses a comma separated list of protocols, as given to
+// the -protocols flag. "all" enables every protocol.
+func ParseProtocols(s string) (Protocols, error) {
+	p := Protocols{}
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(strings.ToLower(name))
+		switch name {
+		case "":
+			continue
+		case "all":
+			for _, n := range protocolNames {
+				p[n] = true
+			}
+			continue
+		}
+		if !p.known(name) {
+			return nil, fmt.Errorf("Unknown protocol %q, expected one of %s or all", name, strings.Join(protocolNames, ", "))
+		}
+		p[name] = true
+	}
+	return p, nil
+}
+
+func (p Protocols) known(name string) bool {
+	for _, n := range protocolNames {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (opts Options) protocols() Protocols {
+	if opts.Protocols == nil {
+		return DefaultProtocols
+	}
+	return opts.Protocols
+}
+
+// message is the part of a packet that becomes a record.
+type message struct {
+	proto string
+	// src and dst tell the conversations of a protocol between the same
+	// hosts apart. They are the ports, or the echo identifier for ICMP,
+	// and empty for other IP protocols.
+	src, dst string
+	payload  []byte
+	// meta goes with the record, such as the SCTP stream
+	meta pkt.Metadata
+	// seq is the TCP sequence number of the payload
+	seq uint32
+	// fin and rst are the TCP flags that end a connection
+	fin, rst bool
+}
+
+// hasPorts is whether the src and dst of m are ports.
+func (m message) hasPorts() bool {
+	return m.proto == ProtoTCP || m.proto == ProtoUDP || m.proto == ProtoSCTP
+}
+
+// name tells the protocol of m apart from all others, raw IP protocols
+// include their number.
+func (m message) name() string {
+	if m.proto == ProtoIP {
+		return m.proto + ":" + m.meta["ip_protocol"]
+	}
+	return m.proto
+}
+
+// messages returns the records carried by a packet. SCTP packets may
+// bundle several DATA chunks, and control packets such as an SCTP SACK or
+// an ICMP error carry none. It returns false for packets that have a
+// transport protocol that failed to decode.
+func messages(nl gopacket.NetworkLayer, tl gopacket.TransportLayer) ([]message, bool) {
+	if sctp, ok := tl.(*layers.SCTP); ok {
+		return sctpMessages(sctp), true
+	}
+	if tl != nil {
+		proto := strings.ToLower(tl.LayerType().String())
+		m := message{
+			proto:   proto,
+			src:     tl.TransportFlow().Src().String(),
+			dst:     tl.TransportFlow().Dst().String(),
+			payload: tl.LayerPayload(),
+			meta:    pkt.Metadata{"protocol": proto},
+		}
+		if tcp, ok := tl.(*layers.TCP); ok {
+			m.seq, m.fin, m.rst = tcp.Seq, tcp.FIN, tcp.RST
+		}
+		return []message{m}, true
+	}
+	proto, payload := ipProtocol(nl)
+	switch {
+	case proto == layers.IPProtocolICMPv4 && nl.LayerType() == layers.LayerTypeIPv4:
+		return echoMessages(ProtoICMP, payload, 8, 0), true
+	case proto == layers.IPProtocolICMPv6 && nl.LayerType() == layers.LayerTypeIPv6:
+		return echoMessages(ProtoICMPv6, payload, 128, 129), true
+	case proto == layers.IPProtocolTCP || proto == layers.IPProtocolUDP || proto == layers.IPProtocolSCTP:
+		return nil, false
+	}
+	m := message{
+		proto:   ProtoIP,
+		payload: payload,
+		meta:    pkt.Metadata{"protocol": ProtoIP, "ip_protocol": strconv.Itoa(int(proto))},
+	}
+	return []message{m}, true
+}
+
+// ipProtocol returns the protocol carried by nl and its payload.
+func ipProtocol(nl gopacket.NetworkLayer) (layers.IPProtocol, []byte) {
+	switch ip := nl.(type) {
+	case *layers.IPv4:
+		return ip.Protocol, ip.Payload
+	case *layers.IPv6:
+		if ip.HopByHop != nil {
+			return ip.HopByHop.NextHeader, ip.Payload
+		}
+		return ip.NextHeader, ip.Payload
+	}
+	return 0, nl.LayerPayload()
+}
+
+// echoMessages returns the data of an ICMP echo request or reply. Both
+// directions use the identifier of the echo as their "port".
+func echoMessages(proto string, data []byte, request, reply uint8) []message {
+	if len(data) < 8 || (data[0] != request && data[0] != reply) || data[1] != 0 {
+		return nil
+	}
+	id := strconv.Itoa(int(binary.BigEndian.Uint16(data[4:6])))
+	return []message{{
+		proto:   proto,
+		src:     id,
+		dst:     id,
+		payload: data[8:],
+		meta:    pkt.Metadata{"protocol": proto},
+	}}
+}
+
+// SCTP chunk types and header lengths, see RFC 9260
+const (
+	sctpChunkData        = 0
+	sctpChunkHeaderLen   = 4
+	sctpDataHeaderLength = 16
+)
+
+// sctpMessages returns the user data of every DATA chunk in the packet.
+// gopacket treats everything after the first DATA chunk as its payload, so
+// the chunks are walked here.
+func sctpMessages(sctp *layers.SCTP) []message {
+	var msgs []message
+	src, dst := sctp.TransportFlow().Src().String(), sctp.TransportFlow().Dst().String()
+	data := sctp.Payload
+	for len(data) >= sctpChunkHeaderLen {
+		length := int(binary.BigEndian.Uint16(data[2:4]))
+		if length < sctpChunkHeaderLen || length > len(data) {
+			break
+		}
+		if data[0] == sctpChunkData && length >= sctpDataHeaderLength {
+			msgs = append(msgs, message{
+				proto:   ProtoSCTP,
+				src:     src,
+				dst:     dst,
+				payload: data[sctpDataHeaderLength:length],
+				meta: pkt.Metadata{
+					"protocol":    ProtoSCTP,
+					"sctp_stream": strconv.Itoa(int(binary.BigEndian.Uint16(data[8:10]))),
+					"sctp_ppid":   strconv.Itoa(int(binary.BigEndian.Uint32(data[12:16]))),
+				},
+			})
+		}
+		// Chunks are padded to 4 bytes, the last one may not be
+		padded := (length + 3) &^ 3
+		if padded > len(data) {
+			break
+		}
+		data = data[padded:]
+	}
+	return msgs
+}
+
+// metaWriter writes a metadata record before a data record whenever the
+// metadata that goes with it changes.
+type metaWriter struct {
+	w    *pkt.Writer
+	last pkt.Metadata
+}
+
+func newMetaWriter(w *pkt.Writer) *metaWriter {
+	return &metaWriter{w: w, last: pkt.Metadata{}}
+}
+
+// update writes the values of meta that changed. A missing key counts as
+// empty, so an empty value is only ever written to undo an earlier one.
+func (m *metaWriter) update(meta pkt.Metadata) error {
+	changed := pkt.Metadata{}
+	for k, v := range meta {
+		if m.last[k] != v {
+			changed[k] = v
+			m.last[k] = v
+		}
+	}
+	if len(changed) == 0 {
+		return nil
+	}
+	return m.w.WriteMetadata(changed)
+}
@@ -0,0 +1,190 @@
+package extract
+
+import (
+	"log"
+
+	"github.com/JustinAzoff/pcap_simplify/pkt"
+)
+
+// recordWriter writes a record from the originator if isOrig is set, or
+// from the responder otherwise, along with its metadata.
+type recordWriter func(isOrig bool, payload []byte, meta pkt.Metadata) error
+
+// pipeline turns the packets of a capture into records, decrypting TLS
+// sessions, cutting HTTP conversations into messages and pairing DNS
+// messages when the options ask for it.
+type pipeline struct {
+	tls  *tlsDecrypter
+	http *httpExtractor
+	dns  *dnsExtractor
+}
+
+func newPipeline(opts Options) *pipeline {
+	p := &pipeline{}
+	if opts.KeyLog != nil {
+		p.tls = newTLSDecrypter(opts.KeyLog)
+	}
+	if opts.HTTP != nil {
+		p.http = newHTTPExtractor(opts.HTTP)
+	}
+	if opts.DNS != nil {
+		p.dns = newDNSExtractor()
+	}
+	return p
+}
+
+// meta is the metadata of the records of p, isOrig telling whether p
+// comes from the originator. The keys of the stages in use are cleared,
+// for the stages that apply to set them.
+func (pl *pipeline) meta(p transportPacket, isOrig bool) pkt.Metadata {
+	meta := p.meta(isOrig)
+	var keys []string
+	if pl.http != nil {
+		keys = append(keys, httpMetadata...)
+	}
+	if pl.tls != nil {
+		keys = append(keys, tlsMetadata...)
+	}
+	if pl.dns != nil {
+		keys = append(keys, dnsMetadata...)
+	}
+	for _, k := range keys {
+		meta[k] = ""
+	}
+	return meta
+}
+
+// exchanges returns the DNS transactions that p completes. It returns
+// false if DNS messages are not paired or p is not one, for p to go
+// through packet instead.
+func (pl *pipeline) exchanges(p transportPacket) ([]*dnsExchange, bool) {
+	if pl.dns == nil || !isDNS(p) {
+		return nil, false
+	}
+	return pl.dns.packet(p), true
+}
+
+// unanswered returns the DNS queries that are still waiting for their
+// response once the capture is over.
+func (pl *pipeline) unanswered() []*dnsExchange {
+	if pl.dns == nil {
+		return nil
+	}
+	return pl.dns.close()
+}
+
+// writeExchange passes the messages of a DNS transaction to write, the
+// query from the originator.
+func (pl *pipeline) writeExchange(x *dnsExchange, write recordWriter) error {
+	for _, m := range x.messages() {
+		isOrig := !m.dns.QR
+		if err := write(isOrig, m.wire, m.meta(pl.meta(m.p, isOrig))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// packet passes the records of p to write, isOrig telling whether p comes
+// from the originator.
+func (pl *pipeline) packet(p transportPacket, isOrig bool, write recordWriter) error {
+	meta := pl.meta(p, isOrig)
+	if pl.tls != nil {
+		plaintext := write
+		if pl.http != nil {
+			key := p.conversation()
+			plaintext = func(isOrig bool, payload []byte, meta pkt.Metadata) error {
+				return pl.http.data(key, isOrig, payload, meta, write)
+			}
+		}
+		if ok, err := pl.tls.packet(p, isOrig, meta, plaintext); ok || err != nil {
+			return err
+		}
+	}
+	if pl.http != nil && p.proto == ProtoTCP {
+		return pl.http.packet(p, isOrig, meta, write)
+	}
+	return write(isOrig, p.payload, meta)
+}
+
+// close writes what is left of a conversation that is over, and forgets
+// it, so a conversation reusing its addresses and ports starts over.
+func (pl *pipeline) close(conversation string) error {
+	if pl.tls != nil {
+		if err := pl.tls.close(conversation); err != nil {
+			return err
+		}
+	}
+	if pl.http != nil {
+		return pl.http.close(conversation)
+	}
+	return nil
+}
+
+// closeAll writes what is left of every conversation.
+func (pl *pipeline) closeAll() error {
+	if pl.tls != nil {
+		if err := pl.tls.closeAll(); err != nil {
+			return err
+		}
+	}
+	if pl.http != nil {
+		return pl.http.closeAll()
+	}
+	return nil
+}
+
+// maxPendingSegments is how many segments past a gap a tcpStream keeps
+// before giving up on the missing data.
+const maxPendingSegments = 1024
+
+// tcpStream puts the payloads of one side of a TCP connection back in
+// order, dropping retransmissions.
+type tcpStream struct {
+	started bool
+	next    uint32
+	pending map[uint32][]byte
+}
+
+// add returns the bytes that payload at seq makes contiguous.
+func (s *tcpStream) add(seq uint32, payload []byte) []byte {
+	if len(payload) == 0 {
+		return nil
+	}
+	if !s.started {
+		s.started, s.next = true, seq
+		s.pending = map[uint32][]byte{}
+	}
+	if len(payload) > len(s.pending[seq]) {
+		s.pending[seq] = payload
+	}
+	if len(s.pending) > maxPendingSegments {
+		// The capture lost something, carry on after the gap
+		lowest := seq
+		for seq := range s.pending {
+			if int32(seq-lowest) < 0 {
+				lowest = seq
+			}
+		}
+		log.Printf("Missing %d bytes of a TCP stream", lowest-s.next)
+		s.next = lowest
+	}
+	var out []byte
+	for progress := true; progress; {
+		progress = false
+		for seq, payload := range s.pending {
+			// seen is how much of payload came before
+			seen := int32(s.next - seq)
+			if seen < 0 {
+				continue
+			}
+			delete(s.pending, seq)
+			if int(seen) < len(payload) {
+				out = append(out, payload[seen:]...)
+				s.next += uint32(len(payload) - int(seen))
+				progress = true
+			}
+		}
+	}
+	return out
+}
@@ -0,0 +1,298 @@
+package extract
+
+import (
+	"container/list"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/JustinAzoff/pcap_simplify/pkt"
+)
+
+// Conversation is one of the flows written by Split.
+type Conversation struct {
+	// Name is the file name the conversation was written to, made of its
+	// start time and five-tuple
+	Name  string
+	Proto string
+	// The client is whoever sent the first packet
+	Client     string
+	ClientPort string
+	Server     string
+	ServerPort string
+	// Start and End are the timestamps of the first and last packet
+	Start time.Time
+	End   time.Time
+	// FirstPacket and LastPacket are the numbers of the first and last
+	// packet in the capture, counting from 1
+	FirstPacket int
+	LastPacket  int
+	Packets     int
+	ClientBytes int
+	ServerBytes int
+
+	key  string
+	file *splitFile
+	w    *pkt.Writer
+	meta *metaWriter
+	// fin holds the sides of a TCP conversation that sent a FIN
+	fin map[bool]bool
+}
+
+// maxOpenFiles is how many conversation files Split keeps open at once.
+var maxOpenFiles = 256
+
+// splitFiles keeps at most max of the files of Split open, closing the
+// least recently written one to open another.
+type splitFiles struct {
+	create func(name string, reopen bool) (io.WriteCloser, error)
+	max    int
+	// open holds the open files, the most recently written first
+	open *list.List
+}
+
+// splitFile is the file of a conversation. It may be closed while the
+// conversation goes on, and is opened again to append to it when written.
+type splitFile struct {
+	files   *splitFiles
+	name    string
+	out     io.WriteCloser
+	created bool
+	elem    *list.Element
+}
+
+func (f *splitFile) Write(b []byte) (int, error) {
+	if err := f.files.use(f); err != nil {
+		return 0, err
+	}
+	return f.out.Write(b)
+}
+
+// use opens f unless it is open, closing the least recently used file if
+// there are too many.
+func (fs *splitFiles) use(f *splitFile) error {
+	if f.out != nil {
+		fs.open.MoveToFront(f.elem)
+		return nil
+	}
+	if fs.open.Len() >= fs.max {
+		if err := fs.close(fs.open.Back().Value.(*splitFile)); err != nil {
+			return err
+		}
+	}
+	out, err := fs.create(f.name, f.created)
+	if err != nil {
+		return err
+	}
+	f.out, f.created = out, true
+	f.elem = fs.open.PushFront(f)
+	return nil
+}
+
+// close closes f if it is open.
+func (fs *splitFiles) close(f *splitFile) error {
+	if f.out == nil {
+		return nil
+	}
+	fs.open.Remove(f.elem)
+	err := f.out.Close()
+	f.out, f.elem = nil, nil
+	return err
+}
+
+// fileName names a conversation by its start time and five-tuple, using
+// only characters that are safe in file names everywhere.
+func (c *Conversation) fileName() string {
+	name := fmt.Sprintf("%s_%s_%s_%s_%s_%s",
+		c.Start.UTC().Format("20060102T150405.000000Z"),
+		c.Proto, c.Client, c.ClientPort, c.Server, c.ServerPort)
+	return strings.NewReplacer(":", "-", "/", "-", "\\", "-").Replace(name)
+}
+
+// Split writes the payloads of every conversation in r to a .pkt file of
+// its own, created by calling create with the name of the conversation.
+// The first packet of a conversation decides which side is the client. A
+// conversation that saw no packets for longer than idle is finished, so a
+// reused port pair later on starts a new one, and its file is closed. With
+// an idle of 0 conversations never time out. With Options.DNS every DNS
+// transaction is a conversation of its own, the client being whoever sent
+// the query. It returns the conversations in the order they started.
+//
+// The file of a TCP conversation is closed once both sides sent a FIN or
+// one sent a RST, and only so many files are kept open at once. A file
+// closed early is opened again by calling create with reopen set if its
+// conversation has more to write, and has to be appended to.
+func Split(r *Reader, create func(name string, reopen bool) (io.WriteCloser, error), idle time.Duration, opts Options) ([]*Conversation, error) {
+	var all []*Conversation
+	open := map[string]*Conversation{}
+	names := map[string]bool{}
+	stats := opts.stats()
+	var lastSweep time.Time
+	files := &splitFiles{create: create, max: maxOpenFiles, open: list.New()}
+
+	streams := newPipeline(opts)
+	finish := func(c *Conversation) error {
+		delete(open, c.key)
+		err := streams.close(c.key)
+		if cerr := files.close(c.file); err == nil {
+			err = cerr
+		}
+		return err
+	}
+	// sweep finishes every conversation idle at ts, so files don't stay
+	// open until the end of the capture
+	sweep := func(ts time.Time) error {
+		if idle == 0 || ts.Sub(lastSweep) < idle {
+			return nil
+		}
+		lastSweep = ts
+		var idleConversations []*Conversation
+		for _, c := range open {
+			if ts.Sub(c.End) > idle {
+				idleConversations = append(idleConversations, c)
+			}
+		}
+		for _, c := range idleConversations {
+			if err := finish(c); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// start creates the file of a conversation starting with p, between
+	// the client and the server
+	start := func(p transportPacket, key, client, clientPort, server, serverPort string) (*Conversation, error) {
+		c := &Conversation{
+			Proto:       p.name(),
+			Client:      client,
+			ClientPort:  clientPort,
+			Server:      server,
+			ServerPort:  serverPort,
+			Start:       p.ts,
+			FirstPacket: p.n,
+			key:         key,
+		}
+		c.Name = c.fileName() + ".pkt"
+		for n := 2; names[c.Name]; n++ {
+			c.Name = fmt.Sprintf("%s_%d.pkt", c.fileName(), n)
+		}
+		names[c.Name] = true
+		// The file is created right away, for conversations without
+		// payloads to have one too
+		c.file = &splitFile{files: files, name: c.Name}
+		if err := files.use(c.file); err != nil {
+			return nil, err
+		}
+		c.w = pkt.NewWriter(c.file)
+		c.meta = newMetaWriter(c.w)
+		c.fin = map[bool]bool{}
+		all = append(all, c)
+		return c, nil
+	}
+	// record returns the writer of the records of c
+	record := func(c *Conversation) recordWriter {
+		return func(isOrig bool, payload []byte, m pkt.Metadata) error {
+			if err := c.meta.update(m); err != nil {
+				return err
+			}
+			if err := c.w.Write(isOrig, payload); err != nil {
+				return err
+			}
+			stats.written(isOrig, len(payload), c.key)
+			c.Packets++
+			if opts.HTTP != nil {
+				opts.HTTP.add(c.Name, c.Packets, payload, m)
+			}
+			if isOrig {
+				c.ClientBytes += len(payload)
+			} else {
+				c.ServerBytes += len(payload)
+			}
+			return nil
+		}
+	}
+	// writeExchanges writes every DNS transaction to a file of its own
+	writeExchanges := func(exchanges []*dnsExchange) error {
+		for _, x := range exchanges {
+			msgs := x.messages()
+			client, clientPort := x.client()
+			server, serverPort := x.server()
+			c, err := start(msgs[0].p, x.key, client, clientPort, server, serverPort)
+			if err != nil {
+				return err
+			}
+			last := msgs[len(msgs)-1].p
+			c.End, c.LastPacket = last.ts, last.n
+			opts.DNS.add(c.Name, 1, x)
+			err = streams.writeExchange(x, record(c))
+			if cerr := files.close(c.file); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	_, err := eachTransport(r, opts, func(p transportPacket) error {
+		if err := sweep(p.ts); err != nil {
+			return err
+		}
+		if exchanges, ok := streams.exchanges(p); ok {
+			return writeExchanges(exchanges)
+		}
+		key := p.conversation()
+		c := open[key]
+		if c != nil && idle != 0 && p.ts.Sub(c.End) > idle {
+			if err := finish(c); err != nil {
+				return err
+			}
+			c = nil
+		}
+		if c == nil {
+			var err error
+			c, err = start(p, key, p.nl.NetworkFlow().Src().String(), p.src, p.nl.NetworkFlow().Dst().String(), p.dst)
+			if err != nil {
+				return err
+			}
+			open[key] = c
+		}
+		isOrig := p.nl.NetworkFlow().Src().String() == c.Client && p.src == c.ClientPort
+		c.End = p.ts
+		c.LastPacket = p.n
+		if err := streams.packet(p, isOrig, record(c)); err != nil {
+			return err
+		}
+		if p.fin {
+			c.fin[isOrig] = true
+		}
+		if p.rst || len(c.fin) == 2 {
+			// The connection is over, what reassembly still holds
+			// opens the file again
+			return files.close(c.file)
+		}
+		return nil
+	})
+	if err == nil {
+		err = writeExchanges(streams.unanswered())
+	}
+
+	// Close whatever is left, in a stable order
+	left := make([]*Conversation, 0, len(open))
+	for _, c := range open {
+		left = append(left, c)
+	}
+	sort.Slice(left, func(i, j int) bool { return left[i].FirstPacket < left[j].FirstPacket })
+	for _, c := range left {
+		if cerr := finish(c); err == nil {
+			err = cerr
+		}
+	}
+	// DNS transactions are written once complete
+	sort.SliceStable(all, func(i, j int) bool { return all[i].FirstPacket < all[j].FirstPacket })
+	return all, err
+}
@@ -0,0 +1,234 @@
+package extract
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+type splitPacket struct {
+	at       time.Duration
+	src, dst string
+	sport    int
+	dport    int
+	payload  string
+}
+
+// splitCapture writes raw IPv4 UDP packets to a pcap.
+func splitCapture(t *testing.T, packets []splitPacket) *Reader {
+	var file bytes.Buffer
+	w := pcapgo.NewWriter(&file)
+	if err := w.WriteFileHeader(65536, layers.LinkTypeRaw); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	for _, p := range packets {
+		ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: net.ParseIP(p.src), DstIP: net.ParseIP(p.dst)}
+		udp := &layers.UDP{SrcPort: layers.UDPPort(p.sport), DstPort: layers.UDPPort(p.dport)}
+		udp.SetNetworkLayerForChecksum(ip)
+		buf := gopacket.NewSerializeBuffer()
+		opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+		if err := gopacket.SerializeLayers(buf, opts, ip, udp, gopacket.Payload(p.payload)); err != nil {
+			t.Fatal(err)
+		}
+		data := buf.Bytes()
+		ci := gopacket.CaptureInfo{Timestamp: start.Add(p.at), CaptureLength: len(data), Length: len(data)}
+		if err := w.WritePacket(ci, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r, err := NewReader(bytes.NewReader(file.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+type bufferCloser struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (b *bufferCloser) Close() error {
+	b.closed = true
+	return nil
+}
+
+// bufferFiles returns the create func of Split, which keeps the files in
+// memory, and the files it created.
+func bufferFiles(t *testing.T) (map[string]*bufferCloser, func(string, bool) (io.WriteCloser, error)) {
+	files := map[string]*bufferCloser{}
+	return files, func(name string, reopen bool) (io.WriteCloser, error) {
+		f := files[name]
+		if reopen != (f != nil) {
+			t.Fatalf("%s opened again with reopen %v", name, reopen)
+		}
+		if f == nil {
+			f = &bufferCloser{}
+			files[name] = f
+		}
+		if !f.closed && reopen {
+			t.Fatalf("%s opened again while open", name)
+		}
+		f.closed = false
+		return f, nil
+	}
+}
+
+func TestSplit(t *testing.T) {
+	r := splitCapture(t, []splitPacket{
+		{0, "10.0.0.1", "10.0.0.2", 1000, 53, "query"},
+		{time.Second, "10.0.0.3", "10.0.0.2", 2000, 53, "other"},
+		{2 * time.Second, "10.0.0.2", "10.0.0.1", 53, 1000, "answer"},
+		// The same port pair again after a long pause
+		{time.Minute, "10.0.0.2", "10.0.0.1", 53, 1000, "late"},
+	})
+	files, create := bufferFiles(t)
+	conversations, err := Split(r, create, 30*time.Second, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []struct {
+		name    string
+		first   int
+		last    int
+		packets int
+		records []string
+	}{
+		{"20200102T030405.000000Z_udp_10.0.0.1_1000_10.0.0.2_53.pkt", 1, 3, 2, []string{"query", "answer"}},
+		{"20200102T030406.000000Z_udp_10.0.0.3_2000_10.0.0.2_53.pkt", 2, 2, 1, []string{"other"}},
+		{"20200102T030505.000000Z_udp_10.0.0.2_53_10.0.0.1_1000.pkt", 4, 4, 1, []string{"late"}},
+	}
+	if len(conversations) != len(want) || len(files) != len(want) {
+		t.Fatalf("got %d conversations and %d files, expected %d", len(conversations), len(files), len(want))
+	}
+	for i, w := range want {
+		c := conversations[i]
+		if c.Name != w.name || c.FirstPacket != w.first || c.LastPacket != w.last || c.Packets != w.packets {
+			t.Errorf("conversation %d is %+v, expected %+v", i, c, w)
+		}
+		f := files[w.name]
+		if f == nil || !f.closed {
+			t.Errorf("%s was not written and closed", w.name)
+			continue
+		}
+		_, records := readRecords(t, f.Bytes())
+		if len(records) != len(w.records) {
+			t.Errorf("%s has %d records, expected %d", w.name, len(records), len(w.records))
+			continue
+		}
+		for j, rec := range records {
+			if string(rec) != w.records[j] {
+				t.Errorf("%s record %d is %q, expected %q", w.name, j, rec, w.records[j])
+			}
+		}
+	}
+	// The answer came from the server
+	if c := conversations[0]; c.ClientBytes != 5 || c.ServerBytes != 6 {
+		t.Errorf("%d bytes from the client and %d from the server, expected 5 and 6", c.ClientBytes, c.ServerBytes)
+	}
+}
+
+func TestSplitOpenFiles(t *testing.T) {
+	defer func(max int) { maxOpenFiles = max }(maxOpenFiles)
+	maxOpenFiles = 2
+	// Three conversations taking turns keep closing and reopening files
+	var packets []splitPacket
+	for i := 0; i < 3; i++ {
+		for _, src := range []string{"10.0.0.1", "10.0.0.3", "10.0.0.4"} {
+			packets = append(packets, splitPacket{time.Duration(i) * time.Second, src, "10.0.0.2", 1000, 53, src})
+		}
+	}
+	files, create := bufferFiles(t)
+	counting := func(name string, reopen bool) (io.WriteCloser, error) {
+		open := 0
+		for _, f := range files {
+			if !f.closed {
+				open++
+			}
+		}
+		if open >= maxOpenFiles {
+			t.Fatalf("%d files open when opening %s", open, name)
+		}
+		return create(name, reopen)
+	}
+	conversations, err := Split(splitCapture(t, packets), counting, 0, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conversations) != 3 {
+		t.Fatalf("got %d conversations, expected 3", len(conversations))
+	}
+	for _, c := range conversations {
+		f := files[c.Name]
+		if !f.closed {
+			t.Errorf("%s was not closed", c.Name)
+		}
+		_, records := readRecords(t, f.Bytes())
+		if len(records) != 3 {
+			t.Errorf("%s has %d records, expected 3", c.Name, len(records))
+		}
+		for _, rec := range records {
+			if string(rec) != c.Client {
+				t.Errorf("%s has a record %q from another conversation", c.Name, rec)
+			}
+		}
+	}
+}
+
+func TestSplitClosedFlow(t *testing.T) {
+	var file bytes.Buffer
+	w := pcapgo.NewWriter(&file)
+	if err := w.WriteFileHeader(65536, layers.LinkTypeRaw); err != nil {
+		t.Fatal(err)
+	}
+	for i, data := range [][]byte{
+		tcpPacket(t, true, 40000, false, false, "hello"),
+		tcpPacket(t, false, 40000, false, false, "world"),
+		tcpPacket(t, true, 40000, true, false, ""),
+		tcpPacket(t, false, 40000, true, false, ""),
+		tcpPacket(t, true, 40000, false, false, ""),
+		tcpPacket(t, true, 40001, false, false, "next"),
+		tcpPacket(t, true, 40001, false, true, ""),
+	} {
+		ci := gopacket.CaptureInfo{Timestamp: time.Unix(1600000000+int64(i), 0), CaptureLength: len(data), Length: len(data)}
+		if err := w.WritePacket(ci, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r, err := NewReader(bytes.NewReader(file.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, create := bufferFiles(t)
+	var closedBefore bool
+	checking := func(name string, reopen bool) (io.WriteCloser, error) {
+		if len(files) == 1 {
+			// The first connection is over when the second starts
+			for _, f := range files {
+				closedBefore = f.closed
+			}
+		}
+		return create(name, reopen)
+	}
+	conversations, err := Split(r, checking, 0, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conversations) != 2 || !closedBefore {
+		t.Fatalf("got %d conversations, the first closed early: %v", len(conversations), closedBefore)
+	}
+	// Every packet is a record, even the ACK after the FINs which opens
+	// the file again
+	for i, want := range []int{5, 2} {
+		if _, records := readRecords(t, files[conversations[i].Name].Bytes()); len(records) != want {
+			t.Errorf("conversation %d has %d records, expected %d", i, len(records), want)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package extract
+
+import (
+	"time"
+
+	"github.com/google/gopacket"
+)
+
+// Reasons a packet is not written, the keys of Stats.Skipped.
+const (
+	SkipNoNetworkLayer   = "no_network_layer"
+	SkipNoTransportLayer = "no_transport_layer"
+	// SkipFragment counts the fragments held until the whole datagram
+	// was seen, which is then written once
+	SkipFragment = "fragment"
+	// SkipBadFragment counts fragments that could not be reassembled
+	SkipBadFragment = "bad_fragment"
+	// SkipControl counts packets without data, such as SCTP SACKs or ICMP
+	// errors
+	SkipControl = "control"
+	// SkipProtocol counts packets of protocols that were not asked for
+	SkipProtocol = "protocol"
+)
+
+// Stats counts what Simplify and SimplifyWithHeaders did with the packets
+// they read. Set Options.Stats to collect them.
+type Stats struct {
+	PacketsRead    int
+	PacketsWritten int
+	// Skipped counts the packets that were not written by reason
+	Skipped map[string]int
+	// OrigBytes and RespBytes are the bytes written for each side,
+	// SimplifyWithHeaders writes everything as coming from the
+	// originator
+	OrigBytes int
+	RespBytes int
+	// Flows is the number of conversations seen, both directions of a
+	// conversation count once
+	Flows int
+	// First and Last are the timestamps of the first and last packet read
+	First time.Time
+	Last  time.Time
+
+	conversations map[string]bool
+}
+
+// stats returns where to count, which is thrown away unless the caller
+// asked for it.
+func (opts Options) stats() *Stats {
+	if opts.Stats != nil {
+		return opts.Stats
+	}
+	return &Stats{}
+}
+
+func (s *Stats) read(packet gopacket.Packet) {
+	s.PacketsRead++
+	ts := packet.Metadata().Timestamp
+	if s.First.IsZero() {
+		s.First = ts
+	}
+	s.Last = ts
+}
+
+func (s *Stats) skip(reason string) {
+	if s.Skipped == nil {
+		s.Skipped = map[string]int{}
+	}
+	s.Skipped[reason]++
+}
+
+// conversation names a conversation of proto the same way for both
+// directions, src and dst being the ports.
+func conversation(proto string, nl gopacket.NetworkLayer, src, dst string) string {
+	a := nl.NetworkFlow().Src().String() + " " + src
+	b := nl.NetworkFlow().Dst().String() + " " + dst
+	if a > b {
+		a, b = b, a
+	}
+	return proto + " " + a + " " + b
+}
+
+func (s *Stats) written(isOrig bool, n int, conversation string) {
+	s.PacketsWritten++
+	if isOrig {
+		s.OrigBytes += n
+	} else {
+		s.RespBytes += n
+	}
+	if s.conversations == nil {
+		s.conversations = map[string]bool{}
+	}
+	if !s.conversations[conversation] {
+		s.conversations[conversation] = true
+		s.Flows++
+	}
+}
+
+// Duration is the time between the first and the last packet read.
+func (s *Stats) Duration() time.Duration {
+	return s.Last.Sub(s.First)
+}
@@ -0,0 +1,628 @@
+package extract
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"log"
+
+	"github.com/JustinAzoff/pcap_simplify/pkt"
+)
+
+// TLS record content types, handshake message types and extensions, see
+// RFC 5246 and RFC 8446.
+const (
+	tlsChangeCipherSpec = 20
+	tlsHandshake        = 22
+	tlsApplicationData  = 23
+
+	tlsClientHello         = 1
+	tlsServerHello         = 2
+	tlsEncryptedExtensions = 8
+	tlsFinished            = 20
+	tlsKeyUpdate           = 24
+
+	tlsExtServerName        = 0
+	tlsExtALPN              = 16
+	tlsExtEncryptThenMAC    = 22
+	tlsExtSupportedVersions = 43
+
+	tlsRecordHeaderLen = 5
+)
+
+// tlsMetadata are the metadata keys describing a TLS session. They are
+// cleared for conversations that are not TLS.
+var tlsMetadata = []string{"tls_version", "tls_cipher", "tls_sni", "tls_alpn"}
+
+// helloRetryRequest is the random of a ServerHello that is a
+// HelloRetryRequest, RFC 8446 section 4.1.3.
+var helloRetryRequest = []byte{
+	0xcf, 0x21, 0xad, 0x74, 0xe5, 0x9a, 0x61, 0x11, 0xbe, 0x1d, 0x8c, 0x02, 0x1e, 0x65, 0xb8, 0x91,
+	0xc2, 0xa2, 0x11, 0x16, 0x7a, 0xbb, 0x8c, 0x5e, 0x07, 0x9e, 0x09, 0xe2, 0xc8, 0xa8, 0x33, 0x9c,
+}
+
+// tlsSuite is what decrypting needs to know about a cipher suite.
+type tlsSuite struct {
+	keyLen int
+	// hash is the hash of the TLS 1.2 PRF or of the TLS 1.3 HKDF
+	hash func() hash.Hash
+	// macLen is the MAC length of CBC suites, 0 for AES-GCM
+	macLen int
+	tls13  bool
+}
+
+// tlsSuites are the cipher suites that can be decrypted, the AES ones.
+// ChaCha20-Poly1305 is not in the standard library.
+var tlsSuites = map[uint16]tlsSuite{
+	tls.TLS_AES_128_GCM_SHA256: {16, sha256.New, 0, true},
+	tls.TLS_AES_256_GCM_SHA384: {32, sha512.New384, 0, true},
+
+	tls.TLS_RSA_WITH_AES_128_GCM_SHA256:         {16, sha256.New, 0, false},
+	tls.TLS_RSA_WITH_AES_256_GCM_SHA384:         {32, sha512.New384, 0, false},
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256:   {16, sha256.New, 0, false},
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384:   {32, sha512.New384, 0, false},
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256: {16, sha256.New, 0, false},
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384: {32, sha512.New384, 0, false},
+	0x009e: {16, sha256.New, 0, false},    // TLS_DHE_RSA_WITH_AES_128_GCM_SHA256
+	0x009f: {32, sha512.New384, 0, false}, // TLS_DHE_RSA_WITH_AES_256_GCM_SHA384
+
+	tls.TLS_RSA_WITH_AES_128_CBC_SHA:            {16, sha256.New, 20, false},
+	tls.TLS_RSA_WITH_AES_256_CBC_SHA:            {32, sha256.New, 20, false},
+	tls.TLS_RSA_WITH_AES_128_CBC_SHA256:         {16, sha256.New, 32, false},
+	0x003d:                                      {32, sha256.New, 32, false}, // TLS_RSA_WITH_AES_256_CBC_SHA256
+	tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA:      {16, sha256.New, 20, false},
+	tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA:      {32, sha256.New, 20, false},
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA:    {16, sha256.New, 20, false},
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA:    {32, sha256.New, 20, false},
+	tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256:   {16, sha256.New, 32, false},
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256: {16, sha256.New, 32, false},
+	0xc028: {32, sha512.New384, 48, false}, // TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA384
+	0xc024: {32, sha512.New384, 48, false}, // TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA384
+}
+
+// prf12 is the TLS 1.2 PRF, RFC 5246 section 5.
+func prf12(h func() hash.Hash, secret []byte, label string, seed []byte, n int) []byte {
+	labelSeed := append([]byte(label), seed...)
+	mac := hmac.New(h, secret)
+	mac.Write(labelSeed)
+	a := mac.Sum(nil)
+	var out []byte
+	for len(out) < n {
+		mac.Reset()
+		mac.Write(a)
+		mac.Write(labelSeed)
+		out = mac.Sum(out)
+		mac.Reset()
+		mac.Write(a)
+		a = mac.Sum(nil)
+	}
+	return out[:n]
+}
+
+// hkdfExpandLabel is HKDF-Expand-Label with an empty context, RFC 8446
+// section 7.1.
+func hkdfExpandLabel(h func() hash.Hash, secret []byte, label string, n int) []byte {
+	label = "tls13 " + label
+	info := append([]byte{byte(n >> 8), byte(n), byte(len(label))}, label...)
+	info = append(info, 0)
+	mac := hmac.New(h, secret)
+	var out, t []byte
+	for i := byte(1); len(out) < n; i++ {
+		mac.Reset()
+		mac.Write(t)
+		mac.Write(info)
+		mac.Write([]byte{i})
+		t = mac.Sum(nil)
+		out = append(out, t...)
+	}
+	return out[:n]
+}
+
+// tlsCipher decrypts the records one side of a session sends.
+type tlsCipher struct {
+	// aead is set for AES-GCM, block for CBC
+	aead  cipher.AEAD
+	block cipher.Block
+	iv    []byte
+	tls13 bool
+	// macLen and encryptThenMAC describe the MAC of CBC records, which is
+	// not checked
+	macLen         int
+	encryptThenMAC bool
+	seq            uint64
+}
+
+// cipher13 returns the cipher for a TLS 1.3 traffic secret.
+func (s tlsSuite) cipher13(secret []byte) (*tlsCipher, error) {
+	block, err := aes.NewCipher(hkdfExpandLabel(s.hash, secret, "key", s.keyLen))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &tlsCipher{aead: aead, iv: hkdfExpandLabel(s.hash, secret, "iv", aead.NonceSize()), tls13: true}, nil
+}
+
+// ciphers12 returns the client and server ciphers of a TLS 1.2 session.
+func (s tlsSuite) ciphers12(master, clientRandom, serverRandom []byte, encryptThenMAC bool) (*tlsCipher, *tlsCipher, error) {
+	ivLen := 4
+	if s.macLen != 0 {
+		ivLen = aes.BlockSize
+	}
+	seed := append(append([]byte{}, serverRandom...), clientRandom...)
+	keys := prf12(s.hash, master, "key expansion", seed, 2*s.macLen+2*s.keyLen+2*ivLen)
+	// The MAC keys come first, they are not needed as MACs are not checked
+	keys = keys[2*s.macLen:]
+	var ciphers [2]*tlsCipher
+	for i := range ciphers {
+		block, err := aes.NewCipher(keys[i*s.keyLen : (i+1)*s.keyLen])
+		if err != nil {
+			return nil, nil, err
+		}
+		if s.macLen != 0 {
+			ciphers[i] = &tlsCipher{block: block, macLen: s.macLen, encryptThenMAC: encryptThenMAC}
+			continue
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, nil, err
+		}
+		iv := keys[2*s.keyLen+i*ivLen : 2*s.keyLen+(i+1)*ivLen]
+		ciphers[i] = &tlsCipher{aead: aead, iv: iv}
+	}
+	return ciphers[0], ciphers[1], nil
+}
+
+// open decrypts a record, returning the type of its content.
+func (c *tlsCipher) open(record []byte) (byte, []byte, error) {
+	header, body := record[:tlsRecordHeaderLen], record[tlsRecordHeaderLen:]
+	seq := c.seq
+	c.seq++
+	switch {
+	case c.tls13:
+		nonce := append([]byte{}, c.iv...)
+		for i := 0; i < 8; i++ {
+			nonce[len(nonce)-1-i] ^= byte(seq >> (8 * i))
+		}
+		plain, err := c.aead.Open(nil, nonce, body, header)
+		if err != nil {
+			return 0, nil, err
+		}
+		// The real content type follows the content, then the padding
+		i := len(plain) - 1
+		for i >= 0 && plain[i] == 0 {
+			i--
+		}
+		if i < 0 {
+			return 0, nil, errors.New("record without a content type")
+		}
+		return plain[i], plain[:i], nil
+	case c.aead != nil:
+		explicit := 8
+		if len(body) < explicit+c.aead.Overhead() {
+			return 0, nil, errors.New("record too short")
+		}
+		nonce := append(append([]byte{}, c.iv...), body[:explicit]...)
+		ad := make([]byte, 13)
+		binary.BigEndian.PutUint64(ad, seq)
+		copy(ad[8:11], header[:3])
+		binary.BigEndian.PutUint16(ad[11:], uint16(len(body)-explicit-c.aead.Overhead()))
+		plain, err := c.aead.Open(nil, nonce, body[explicit:], ad)
+		return header[0], plain, err
+	}
+	if c.encryptThenMAC {
+		if len(body) < c.macLen {
+			return 0, nil, errors.New("record too short")
+		}
+		body = body[:len(body)-c.macLen]
+	}
+	size := c.block.BlockSize()
+	if len(body) < 2*size || len(body)%size != 0 {
+		return 0, nil, errors.New("record is not a whole number of blocks")
+	}
+	plain := make([]byte, len(body)-size)
+	cipher.NewCBCDecrypter(c.block, body[:size]).CryptBlocks(plain, body[size:])
+	padding := int(plain[len(plain)-1]) + 1
+	if !c.encryptThenMAC {
+		padding += c.macLen
+	}
+	if padding > len(plain) {
+		return 0, nil, errors.New("bad padding")
+	}
+	return header[0], plain[:len(plain)-padding], nil
+}
+
+// tlsReader reads the fields of handshake messages, remembering whether
+// any was cut short.
+type tlsReader struct {
+	data []byte
+	bad  bool
+}
+
+func (r *tlsReader) bytes(n int) []byte {
+	if n > len(r.data) {
+		r.bad = true
+		r.data = nil
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *tlsReader) uint(n int) int {
+	v := 0
+	for _, b := range r.bytes(n) {
+		v = v<<8 | int(b)
+	}
+	return v
+}
+
+// vector reads a field preceded by its length in n bytes.
+func (r *tlsReader) vector(n int) *tlsReader {
+	return &tlsReader{data: r.bytes(r.uint(n))}
+}
+
+// extensions returns the extensions at the end of a hello message.
+func (r *tlsReader) extensions() map[int][]byte {
+	exts := map[int][]byte{}
+	if len(r.data) == 0 {
+		return exts
+	}
+	list := r.vector(2)
+	for len(list.data) > 0 && !list.bad {
+		typ := list.uint(2)
+		exts[typ] = list.vector(2).data
+	}
+	return exts
+}
+
+// isClientHello is whether payload starts with a handshake record holding
+// a ClientHello, the start of a TLS session.
+func isClientHello(payload []byte) bool {
+	return len(payload) > tlsRecordHeaderLen && payload[0] == tlsHandshake && payload[1] == 3 &&
+		payload[tlsRecordHeaderLen] == tlsClientHello
+}
+
+// tlsDirection is what a TLS session knows about one of its sides.
+type tlsDirection struct {
+	stream tcpStream
+	// records and handshake hold what is not a whole record or handshake
+	// message yet
+	records   []byte
+	handshake []byte
+	cipher    *tlsCipher
+	// next is the TLS 1.2 cipher that ChangeCipherSpec switches to
+	next *tlsCipher
+	// secret is the TLS 1.3 traffic secret in use, application the one
+	// Finished switches to
+	secret      []byte
+	application []byte
+}
+
+// heldRecord is a record written as is if the session can't be decrypted.
+type heldRecord struct {
+	isOrig bool
+	record []byte
+}
+
+// tlsSession decrypts a TLS session with the keys of a key log.
+type tlsSession struct {
+	keys         *KeyLog
+	clientIsOrig bool
+	dirs         map[bool]*tlsDirection
+	clientRandom []byte
+	suite        tlsSuite
+	meta         pkt.Metadata
+	// held are the records seen before the keys were known. Once they
+	// are, decrypting is set, and if they are not failed is.
+	held       []heldRecord
+	decrypting bool
+	failed     bool
+	// emit writes with the metadata of the last packet, for the records
+	// still held when the conversation ends
+	emit emitFunc
+}
+
+func newTLSSession(keys *KeyLog, clientIsOrig bool) *tlsSession {
+	return &tlsSession{
+		keys:         keys,
+		clientIsOrig: clientIsOrig,
+		dirs:         map[bool]*tlsDirection{true: {}, false: {}},
+		meta:         pkt.Metadata{},
+	}
+}
+
+// emitFunc writes a record of the side isOrig.
+type emitFunc func(isOrig bool, payload []byte) error
+
+// feed reads the TCP payload at seq of the side isOrig, and passes the
+// plaintext of every application data record it completes to emit.
+func (s *tlsSession) feed(isOrig bool, seq uint32, payload []byte, emit emitFunc) error {
+	d := s.dirs[isOrig]
+	d.records = append(d.records, d.stream.add(seq, payload)...)
+	for len(d.records) >= tlsRecordHeaderLen {
+		n := tlsRecordHeaderLen + int(binary.BigEndian.Uint16(d.records[3:5]))
+		if len(d.records) < n {
+			break
+		}
+		record := d.records[:n:n]
+		d.records = d.records[n:]
+		if err := s.record(isOrig, record, emit); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fail gives up on decrypting the session, writing the records held so
+// far, or else record, and all later ones as they are.
+func (s *tlsSession) fail(reason string, isOrig bool, record []byte, emit emitFunc) error {
+	log.Printf("%s, writing the TLS session with client random %x encrypted", reason, s.clientRandom)
+	s.failed = true
+	if s.decrypting {
+		return emit(isOrig, record)
+	}
+	held := s.held
+	s.held = nil
+	for _, h := range held {
+		if err := emit(h.isOrig, h.record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *tlsSession) record(isOrig bool, record []byte, emit emitFunc) error {
+	if s.failed {
+		return emit(isOrig, record)
+	}
+	if !s.decrypting {
+		s.held = append(s.held, heldRecord{isOrig, record})
+	}
+	d := s.dirs[isOrig]
+	typ, body := record[0], record[tlsRecordHeaderLen:]
+	// TLS 1.3 keeps sending ChangeCipherSpec in the clear for middleboxes
+	if d.cipher != nil && !(d.cipher.tls13 && typ == tlsChangeCipherSpec) {
+		var err error
+		if typ, body, err = d.cipher.open(record); err != nil {
+			return s.fail(fmt.Sprintf("Can't decrypt TLS record: %v", err), isOrig, record, emit)
+		}
+	}
+	switch typ {
+	case tlsChangeCipherSpec:
+		if d.next != nil {
+			d.cipher, d.next = d.next, nil
+		}
+	case tlsHandshake:
+		d.handshake = append(d.handshake, body...)
+		if reason := s.handshake(isOrig, d); reason != "" {
+			return s.fail(reason, isOrig, record, emit)
+		}
+	case tlsApplicationData:
+		if d.cipher == nil {
+			return s.fail("TLS application data before the keys were agreed on", isOrig, record, emit)
+		}
+		if len(body) > 0 {
+			return emit(isOrig, body)
+		}
+	}
+	return nil
+}
+
+// handshake reads the handshake messages of d, returning why decrypting
+// is impossible if it is.
+func (s *tlsSession) handshake(isOrig bool, d *tlsDirection) string {
+	for len(d.handshake) >= 4 {
+		n := 4 + (int(d.handshake[1])<<16 | int(d.handshake[2])<<8 | int(d.handshake[3]))
+		if len(d.handshake) < n {
+			break
+		}
+		typ, msg := d.handshake[0], &tlsReader{data: d.handshake[4:n]}
+		d.handshake = d.handshake[n:]
+		switch {
+		case typ == tlsClientHello && isOrig == s.clientIsOrig:
+			if reason := s.clientHello(msg); reason != "" {
+				return reason
+			}
+		case typ == tlsServerHello && isOrig != s.clientIsOrig:
+			if reason := s.serverHello(msg); reason != "" {
+				return reason
+			}
+		case typ == tlsEncryptedExtensions:
+			s.alpn(msg.extensions())
+		case typ == tlsFinished && d.application != nil:
+			if err := s.rekey(d, d.application); err != nil {
+				return err.Error()
+			}
+			d.application = nil
+		case typ == tlsKeyUpdate && d.secret != nil:
+			if err := s.rekey(d, hkdfExpandLabel(s.suite.hash, d.secret, "traffic upd", s.suite.hash().Size())); err != nil {
+				return err.Error()
+			}
+		}
+	}
+	return ""
+}
+
+func (s *tlsSession) clientHello(r *tlsReader) string {
+	r.bytes(2)
+	s.clientRandom = append([]byte{}, r.bytes(32)...)
+	r.vector(1)
+	r.vector(2)
+	r.vector(1)
+	exts := r.extensions()
+	if r.bad {
+		return "Invalid ClientHello"
+	}
+	if sni := (&tlsReader{data: exts[tlsExtServerName]}).vector(2); len(sni.data) > 0 && sni.uint(1) == 0 {
+		s.meta["tls_sni"] = string(sni.vector(2).data)
+	}
+	if !s.keys.has(s.clientRandom) {
+		return "No keys in the key log"
+	}
+	return ""
+}
+
+func (s *tlsSession) alpn(exts map[int][]byte) {
+	if alpn := (&tlsReader{data: exts[tlsExtALPN]}).vector(2); len(alpn.data) > 0 {
+		s.meta["tls_alpn"] = string(alpn.vector(1).data)
+	}
+}
+
+func (s *tlsSession) serverHello(r *tlsReader) string {
+	version := r.uint(2)
+	random := r.bytes(32)
+	r.vector(1)
+	id := uint16(r.uint(2))
+	r.bytes(1)
+	exts := r.extensions()
+	if r.bad || s.clientRandom == nil {
+		return "Invalid ServerHello"
+	}
+	if bytes.Equal(random, helloRetryRequest) {
+		// Another ClientHello and ServerHello follow
+		return ""
+	}
+	if v := exts[tlsExtSupportedVersions]; len(v) == 2 {
+		version = int(binary.BigEndian.Uint16(v))
+	}
+	s.alpn(exts)
+	s.meta["tls_cipher"] = tls.CipherSuiteName(id)
+	suite, ok := tlsSuites[id]
+	switch {
+	case version == tls.VersionTLS13 && suite.tls13:
+		s.meta["tls_version"] = "1.3"
+	case version == tls.VersionTLS12 && ok && !suite.tls13:
+		s.meta["tls_version"] = "1.2"
+	case version != tls.VersionTLS12 && version != tls.VersionTLS13:
+		return fmt.Sprintf("Unsupported TLS version %#04x", version)
+	default:
+		return fmt.Sprintf("Unsupported cipher suite %s", s.meta["tls_cipher"])
+	}
+	s.suite = suite
+	client, server := s.dirs[s.clientIsOrig], s.dirs[!s.clientIsOrig]
+
+	if suite.tls13 {
+		for _, k := range []struct {
+			d                      *tlsDirection
+			handshake, application string
+		}{
+			{client, "CLIENT_HANDSHAKE_TRAFFIC_SECRET", "CLIENT_TRAFFIC_SECRET_0"},
+			{server, "SERVER_HANDSHAKE_TRAFFIC_SECRET", "SERVER_TRAFFIC_SECRET_0"},
+		} {
+			secret := s.keys.secret(k.handshake, s.clientRandom)
+			k.d.application = s.keys.secret(k.application, s.clientRandom)
+			if secret == nil || k.d.application == nil {
+				return fmt.Sprintf("No %s or %s in the key log", k.handshake, k.application)
+			}
+			if err := s.rekey(k.d, secret); err != nil {
+				return err.Error()
+			}
+		}
+	} else {
+		master := s.keys.secret("CLIENT_RANDOM", s.clientRandom)
+		if master == nil {
+			return "No CLIENT_RANDOM in the key log"
+		}
+		_, etm := exts[tlsExtEncryptThenMAC]
+		var err error
+		if client.next, server.next, err = suite.ciphers12(master, s.clientRandom, random, etm); err != nil {
+			return err.Error()
+		}
+	}
+	s.decrypting = true
+	s.held = nil
+	return ""
+}
+
+// rekey switches the TLS 1.3 side d to secret.
+func (s *tlsSession) rekey(d *tlsDirection, secret []byte) error {
+	c, err := s.suite.cipher13(secret)
+	if err != nil {
+		return err
+	}
+	d.cipher, d.secret = c, secret
+	return nil
+}
+
+// tlsDecrypter replaces the payloads of the TLS sessions of a capture with
+// their plaintext.
+type tlsDecrypter struct {
+	keys *KeyLog
+	// sessions has the session of every TCP conversation seen, nil for
+	// the ones that are not TLS
+	sessions map[string]*tlsSession
+	// order has the conversations of the sessions in the order they
+	// started, so what is held at the end is written in a stable order
+	order []string
+}
+
+func newTLSDecrypter(keys *KeyLog) *tlsDecrypter {
+	return &tlsDecrypter{keys: keys, sessions: map[string]*tlsSession{}}
+}
+
+// packet passes the plaintext application data of p to write if p is
+// part of a TLS session, with meta and the metadata of the session, and
+// reports whether it was. Empty TCP payloads count as part of a session
+// and are dropped, as they carry nothing to decrypt.
+func (d *tlsDecrypter) packet(p transportPacket, isOrig bool, meta pkt.Metadata, write recordWriter) (bool, error) {
+	if p.proto != ProtoTCP {
+		return false, nil
+	}
+	if len(p.payload) == 0 {
+		return true, nil
+	}
+	key := p.conversation()
+	s, seen := d.sessions[key]
+	if !seen {
+		if isClientHello(p.payload) {
+			s = newTLSSession(d.keys, isOrig)
+			d.order = append(d.order, key)
+		}
+		d.sessions[key] = s
+	}
+	if s == nil {
+		return false, nil
+	}
+	s.emit = func(isOrig bool, payload []byte) error {
+		for k, v := range s.meta {
+			meta[k] = v
+		}
+		return write(isOrig, payload, meta)
+	}
+	return true, s.feed(isOrig, p.seq, p.payload, s.emit)
+}
+
+// close drops the session of a conversation that is over, so a
+// conversation reusing its addresses and ports starts over. The records of
+// a handshake that never finished are written as they are.
+func (d *tlsDecrypter) close(conversation string) error {
+	s := d.sessions[conversation]
+	delete(d.sessions, conversation)
+	if s == nil || len(s.held) == 0 {
+		return nil
+	}
+	return s.fail("The conversation ended before the TLS handshake did", false, nil, s.emit)
+}
+
+// closeAll writes what is held by every session.
+func (d *tlsDecrypter) closeAll() error {
+	for _, key := range d.order {
+		if err := d.close(key); err != nil {
+			return err
+		}
+	}
+	d.order = nil
+	return nil
+}
@@ -0,0 +1,347 @@
+package extract
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/JustinAzoff/pcap_simplify/pkt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// tlsWrite is what one side of a TLS session wrote to the connection.
+type tlsWrite struct {
+	client bool
+	data   []byte
+}
+
+// recordingConn keeps the writes of both sides of a connection, in order.
+type recordingConn struct {
+	net.Conn
+	client bool
+	mu     *sync.Mutex
+	writes *[]tlsWrite
+}
+
+func (c recordingConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	*c.writes = append(*c.writes, tlsWrite{c.client, append([]byte{}, b...)})
+	c.mu.Unlock()
+	return c.Conn.Write(b)
+}
+
+func testCertificate(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "example.com"},
+		DNSNames:     []string{"example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// tlsSession runs a TLS session where the client sends request and the
+// server answers with response, returning what went over the wire, the key
+// log and the negotiated cipher suite.
+func runTLSSession(t *testing.T, version uint16, suites []uint16, request, response string) ([]tlsWrite, []byte, uint16) {
+	var keylog bytes.Buffer
+	var mu sync.Mutex
+	var writes []tlsWrite
+	c, s := net.Pipe()
+	client := tls.Client(recordingConn{c, true, &mu, &writes}, &tls.Config{
+		ServerName:         "example.com",
+		InsecureSkipVerify: true,
+		NextProtos:         []string{"test/1"},
+		MinVersion:         version,
+		MaxVersion:         version,
+		CipherSuites:       suites,
+		KeyLogWriter:       &keylog,
+	})
+	server := tls.Server(recordingConn{s, false, &mu, &writes}, &tls.Config{
+		Certificates:           []tls.Certificate{testCertificate(t)},
+		NextProtos:             []string{"test/1"},
+		SessionTicketsDisabled: true,
+	})
+	done := make(chan error, 1)
+	go func() {
+		buf := make([]byte, len(request))
+		if _, err := io.ReadFull(server, buf); err != nil {
+			done <- err
+			return
+		}
+		_, err := server.Write([]byte(response))
+		done <- err
+	}()
+	if _, err := client.Write([]byte(request)); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(response))
+	if _, err := io.ReadFull(client, buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	suite := client.ConnectionState().CipherSuite
+	// Closing the TLS connections would wait for close_notify to be read
+	c.Close()
+	s.Close()
+	return writes, keylog.Bytes(), suite
+}
+
+// writeTCPSegment writes a segment between 10.0.0.1, the client, and
+// 10.0.0.2 to pw, from the client if client is set.
+func writeTCPSegment(t *testing.T, pw *pcapgo.Writer, client bool, sport, dport int, seq uint32, data []byte) {
+	src, dst := net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2")
+	if !client {
+		src, dst, sport, dport = dst, src, dport, sport
+	}
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: src, DstIP: dst}
+	tcp := &layers.TCP{SrcPort: layers.TCPPort(sport), DstPort: layers.TCPPort(dport), Seq: seq, ACK: true, PSH: true, Window: 65535}
+	tcp.SetNetworkLayerForChecksum(ip)
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, ip, tcp, gopacket.Payload(data)); err != nil {
+		t.Fatal(err)
+	}
+	ci := gopacket.CaptureInfo{Timestamp: time.Unix(1600000000, 0), CaptureLength: len(buf.Bytes()), Length: len(buf.Bytes())}
+	if err := pw.WritePacket(ci, buf.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+type tcpSegment struct {
+	client bool
+	seq    uint32
+	data   []byte
+}
+
+// tlsCapture writes the writes of a session as TCP segments on port 443 to
+// a pcap, followed by a plain conversation on port 80. Every write is cut
+// in two, and the halves of the second write of each side are sent in the
+// wrong order, the first half twice.
+func tlsCapture(t *testing.T, writes []tlsWrite) *Reader {
+	seqs := map[bool]uint32{true: 1000, false: 5000}
+	count := map[bool]int{}
+	var segments []tcpSegment
+	for _, w := range writes {
+		half := len(w.data) / 2
+		first := tcpSegment{w.client, seqs[w.client], w.data[:half]}
+		second := tcpSegment{w.client, seqs[w.client] + uint32(half), w.data[half:]}
+		seqs[w.client] += uint32(len(w.data))
+		count[w.client]++
+		if count[w.client] == 2 {
+			segments = append(segments, second, first, first)
+		} else {
+			segments = append(segments, first, second)
+		}
+	}
+
+	var file bytes.Buffer
+	pw := pcapgo.NewWriter(&file)
+	if err := pw.WriteFileHeader(65536, layers.LinkTypeRaw); err != nil {
+		t.Fatal(err)
+	}
+	write := func(client bool, sport, dport int, seq uint32, data []byte) {
+		writeTCPSegment(t, pw, client, sport, dport, seq, data)
+	}
+	// The handshake and acks carry nothing and are left out
+	write(true, 40001, 443, 999, nil)
+	for _, s := range segments {
+		write(s.client, 40001, 443, s.seq, s.data)
+		write(!s.client, 40001, 443, 0, nil)
+	}
+	write(true, 40000, 80, 1, []byte("GET / HTTP/1.0\r\n\r\n"))
+	write(false, 40000, 80, 1, []byte("HTTP/1.0 200 OK\r\n\r\n"))
+	r, err := NewReader(bytes.NewReader(file.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+type tlsRecord struct {
+	isOrig  bool
+	payload string
+	meta    pkt.Metadata
+}
+
+func readTLSRecords(t *testing.T, data []byte) []tlsRecord {
+	r, err := pkt.NewReader(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var records []tlsRecord
+	for {
+		isOrig, payload, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		meta := pkt.Metadata{}
+		for _, k := range tlsMetadata {
+			meta[k] = r.Metadata[k]
+		}
+		records = append(records, tlsRecord{isOrig, string(payload), meta})
+	}
+	return records
+}
+
+func TestSimplifyTLS(t *testing.T) {
+	plain := pkt.Metadata{"tls_version": "", "tls_cipher": "", "tls_sni": "", "tls_alpn": ""}
+	for _, tt := range []struct {
+		name    string
+		version uint16
+		suites  []uint16
+	}{
+		{"tls 1.2 gcm", tls.VersionTLS12, []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256}},
+		{"tls 1.2 gcm sha384", tls.VersionTLS12, []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384}},
+		{"tls 1.2 cbc", tls.VersionTLS12, []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA}},
+		{"tls 1.3", tls.VersionTLS13, nil},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			request, response := "hello", strings.Repeat("world", 200)
+			writes, keylog, suite := runTLSSession(t, tt.version, tt.suites, request, response)
+			if _, ok := tlsSuites[suite]; !ok {
+				t.Skipf("negotiated %s, which can't be decrypted", tls.CipherSuiteName(suite))
+			}
+			keys, err := ReadKeyLog(bytes.NewReader(keylog))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var out bytes.Buffer
+			if _, _, err := Simplify(tlsCapture(t, writes), &out, Options{KeyLog: keys}); err != nil {
+				t.Fatal(err)
+			}
+			version := "1.2"
+			if tt.version == tls.VersionTLS13 {
+				version = "1.3"
+			}
+			session := pkt.Metadata{"tls_version": version, "tls_cipher": tls.CipherSuiteName(suite), "tls_sni": "example.com", "tls_alpn": "test/1"}
+			// Only the first flow seen is the originator's
+			want := []tlsRecord{
+				{true, request, session},
+				{false, response, session},
+				{false, "GET / HTTP/1.0\r\n\r\n", plain},
+				{false, "HTTP/1.0 200 OK\r\n\r\n", plain},
+			}
+			if got := readTLSRecords(t, out.Bytes()); !reflect.DeepEqual(got, want) {
+				t.Errorf("got records\n%v\nexpected\n%v", got, want)
+			}
+		})
+	}
+}
+
+func TestSimplifyTLSWithoutKeys(t *testing.T) {
+	writes, _, _ := runTLSSession(t, tls.VersionTLS12, []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256}, "hello", "world")
+	keys, err := ReadKeyLog(strings.NewReader("# no keys\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if _, _, err := Simplify(tlsCapture(t, writes), &out, Options{KeyLog: keys}); err != nil {
+		t.Fatal(err)
+	}
+	// The records are written encrypted, one record each
+	var client, server []byte
+	for _, w := range writes {
+		if w.client {
+			client = append(client, w.data...)
+		} else {
+			server = append(server, w.data...)
+		}
+	}
+	var gotClient, gotServer []byte
+	for _, rec := range readTLSRecords(t, out.Bytes()) {
+		if rec.meta["tls_sni"] != "example.com" {
+			continue
+		}
+		if rec.isOrig {
+			gotClient = append(gotClient, rec.payload...)
+		} else {
+			gotServer = append(gotServer, rec.payload...)
+		}
+	}
+	if !bytes.Equal(gotClient, client) || !bytes.Equal(gotServer, server) {
+		t.Errorf("got %d client and %d server bytes, expected the %d and %d sent", len(gotClient), len(gotServer), len(client), len(server))
+	}
+}
+
+func TestReadKeyLog(t *testing.T) {
+	random := strings.Repeat("ab", 32)
+	keys, err := ReadKeyLog(strings.NewReader("# comment\n\nCLIENT_RANDOM " + random + " 0102\nSERVER_TRAFFIC_SECRET_0 " + random + " 03\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys.Len() != 1 {
+		t.Errorf("keys of %d sessions, expected 1", keys.Len())
+	}
+	for _, bad := range []string{
+		"CLIENT_RANDOM " + random + "\n",
+		"CLIENT_RANDOM abcd 0102\n",
+		"CLIENT_RANDOM " + random + " zz\n",
+	} {
+		if _, err := ReadKeyLog(strings.NewReader(bad)); err == nil {
+			t.Errorf("expected an error for %q", bad)
+		}
+	}
+}
+
+func TestSimplifyTLSClientHelloOnly(t *testing.T) {
+	writes, keylog, _ := runTLSSession(t, tls.VersionTLS12, []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256}, "hello", "world")
+	keys, err := ReadKeyLog(bytes.NewReader(keylog))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The capture ends before the ServerHello
+	hello := writes[:1]
+	check := func(name string, data []byte) {
+		var got []byte
+		for _, rec := range readTLSRecords(t, data) {
+			if rec.meta["tls_sni"] == "example.com" && rec.isOrig {
+				got = append(got, rec.payload...)
+			}
+		}
+		if !bytes.Equal(got, hello[0].data) {
+			t.Errorf("%s: got %d bytes of the ClientHello, expected %d", name, len(got), len(hello[0].data))
+		}
+	}
+
+	var out bytes.Buffer
+	if _, _, err := Simplify(tlsCapture(t, hello), &out, Options{KeyLog: keys}); err != nil {
+		t.Fatal(err)
+	}
+	check("simplify", out.Bytes())
+
+	files, create := bufferFiles(t)
+	conversations, err := Split(tlsCapture(t, hello), create, 0, Options{KeyLog: keys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("split", files[conversations[0].Name].Bytes())
+}
@@ -1,5 +1,11 @@
 module github.com/JustinAzoff/pcap_simplify
 
-go 1.16
+go 1.18
 
-require github.com/google/gopacket v1.1.19
+require (
+	github.com/google/gopacket v1.1.19
+	golang.org/x/net v0.0.0-20190620200207-3b0461eec859
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require golang.org/x/sys v0.0.0-20190412213103-97732733099d // indirect
@@ -0,0 +1,30 @@
+// Package fixtures gives the fuzz tests of every package the same seeds.
+package fixtures
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+// AddCaptures seeds f with every fixture capture in the testdata directory
+// at the top of the repository.
+func AddCaptures(f *testing.F) {
+	_, file, _, ok := runtime.Caller(0)
+	if !ok {
+		f.Fatal("Can't find the testdata directory")
+	}
+	dir := filepath.Join(filepath.Dir(file), "..", "..", "testdata")
+	names, err := filepath.Glob(filepath.Join(dir, "*.pcap*"))
+	if err != nil {
+		f.Fatal(err)
+	}
+	for _, name := range names {
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(data)
+	}
+}
@@ -0,0 +1,34 @@
+// Package pcapng holds the pcapng block types and option codes shared by
+// the reader in extract and the writer in build, see
+// https://www.ietf.org/archive/id/draft-tuexen-opsawg-pcapng-05.html
+package pcapng
+
+// Block types
+const (
+	BlockSectionHeader  = 0x0A0D0D0A
+	BlockInterface      = 0x00000001
+	BlockPacket         = 0x00000002
+	BlockSimplePacket   = 0x00000003
+	BlockEnhancedPacket = 0x00000006
+)
+
+// Option codes. Comment and the end of the options apply to every block,
+// the others to section headers or to interface descriptions.
+const (
+	OptionEnd     = 0
+	OptionComment = 1
+
+	OptionShbUserAppl = 4
+
+	OptionIfName        = 2
+	OptionIfDescription = 3
+	OptionIfTsResol     = 9
+	OptionIfTsOffset    = 14
+)
+
+const (
+	// ByteOrderMagic follows the length of a section header, in the byte
+	// order of the section
+	ByteOrderMagic = 0x1A2B3C4D
+	MajorVersion   = 1
+)
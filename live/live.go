@@ -0,0 +1,66 @@
+// Package live sends packets to and captures them from a network interface
+// using libpcap.
+//
+// It is kept apart from the rest of the tools so that only the binaries
+// that use interfaces need cgo and libpcap to build.
+package live
+
+import (
+	"github.com/JustinAzoff/pcap_simplify/build"
+	"github.com/JustinAzoff/pcap_simplify/extract"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	"golang.org/x/net/bpf"
+)
+
+// snaplen is the largest packet sent or captured.
+const snaplen = 65536
+
+// OpenInterface opens the network interface name for sending packets.
+func OpenInterface(name string) (build.PacketWriter, error) {
+	handle, err := pcap.OpenLive(name, snaplen, true, pcap.BlockForever)
+	if err != nil {
+		return nil, err
+	}
+	return interfaceWriter{handle}, nil
+}
+
+// interfaceWriter is a pcap.Handle as a build.PacketWriter. Closing a
+// handle can't fail.
+type interfaceWriter struct {
+	*pcap.Handle
+}
+
+func (w interfaceWriter) Close() error {
+	w.Handle.Close()
+	return nil
+}
+
+// OpenCapture opens the network interface name for capturing packets,
+// keeping only those matching filter if it is not empty.
+func OpenCapture(name, filter string) (extract.LiveSource, func(), error) {
+	handle, err := pcap.OpenLive(name, snaplen, true, pcap.BlockForever)
+	if err != nil {
+		return nil, nil, err
+	}
+	if filter != "" {
+		if err := handle.SetBPFFilter(filter); err != nil {
+			handle.Close()
+			return nil, nil, err
+		}
+	}
+	return handle, handle.Close, nil
+}
+
+// CompileFilter compiles filter for a capture of Ethernet frames.
+func CompileFilter(filter string) ([]bpf.RawInstruction, error) {
+	insns, err := pcap.CompileBPFFilter(layers.LinkTypeEthernet, snaplen, filter)
+	if err != nil {
+		return nil, err
+	}
+	raw := make([]bpf.RawInstruction, len(insns))
+	for i, insn := range insns {
+		raw[i] = bpf.RawInstruction{Op: insn.Code, Jt: insn.Jt, Jf: insn.Jf, K: insn.K}
+	}
+	return raw, nil
+}
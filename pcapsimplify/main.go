@@ -0,0 +1,21 @@
+// Command pcapsimplify converts pcaps to and from the .pkt format.
+//
+//	pcapsimplify extract capture.pcap conversation.pkt
+//	pcapsimplify build conversation.pkt synthetic.pcap
+//
+// Run pcapsimplify without arguments for the list of commands.
+package main
+
+import (
+	"os"
+
+	"github.com/JustinAzoff/pcap_simplify/cli"
+	"github.com/JustinAzoff/pcap_simplify/live"
+)
+
+func main() {
+	cli.OpenInterface = live.OpenInterface
+	cli.OpenCapture = live.OpenCapture
+	cli.CompileFilter = live.CompileFilter
+	os.Exit(cli.Main(os.Args[1:]))
+}
@@ -0,0 +1,153 @@
+package pkt
+
+import (
+	"fmt"
+	"io"
+)
+
+// stream is everything one side of a conversation sent, along with where
+// each data record starts in it.
+type stream struct {
+	data []byte
+	// starts holds the offset of each record, and records its index among
+	// all the data records of the file
+	starts  []int
+	records []int
+}
+
+// locate returns the index of the record holding offset and where in that
+// record offset is.
+func (s *stream) locate(offset int) (int, int) {
+	i := len(s.starts) - 1
+	for i > 0 && s.starts[i] > offset {
+		i--
+	}
+	return s.records[i], offset - s.starts[i]
+}
+
+func streams(data []byte) (orig, resp *stream, err error) {
+	orig, resp = &stream{}, &stream{}
+	if len(data) == 0 {
+		// Nothing was extracted at all
+		return orig, resp, nil
+	}
+	r, err := NewReader(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	for index := 0; ; index++ {
+		isOrig, payload, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		s := resp
+		if isOrig {
+			s = orig
+		}
+		// Empty records such as bare ACKs can't hold the divergent byte
+		if len(payload) > 0 {
+			s.starts = append(s.starts, len(s.data))
+			s.records = append(s.records, index)
+			s.data = append(s.data, payload...)
+		}
+	}
+	return orig, resp, nil
+}
+
+// Divergence is the first place where one direction of two .pkt files
+// stops carrying the same data.
+type Divergence struct {
+	IsOrig bool
+	// Offset is where the streams of that direction first differ
+	Offset int
+	// WantRecord and GotRecord are the data records holding Offset,
+	// numbered like inspect does, or -1 if the stream ended before it
+	WantRecord, GotRecord             int
+	WantRecordOffset, GotRecordOffset int
+	// WantByte and GotByte are the differing bytes, unless a stream ended
+	WantByte, GotByte byte
+	WantLen, GotLen   int
+}
+
+func (d Divergence) String() string {
+	dir := "server to client"
+	if d.IsOrig {
+		dir = "client to server"
+	}
+	where := func(record, offset int) string {
+		if record < 0 {
+			return "past the end"
+		}
+		return fmt.Sprintf("record #%d byte %d", record, offset)
+	}
+	if d.Offset == d.WantLen || d.Offset == d.GotLen {
+		return fmt.Sprintf("%s stream differs in length: expected %d bytes, got %d bytes, first missing byte at offset %d (expected %s, got %s)",
+			dir, d.WantLen, d.GotLen, d.Offset, where(d.WantRecord, d.WantRecordOffset), where(d.GotRecord, d.GotRecordOffset))
+	}
+	return fmt.Sprintf("%s stream differs at offset %d: expected 0x%02x at %s, got 0x%02x at %s",
+		dir, d.Offset, d.WantByte, where(d.WantRecord, d.WantRecordOffset), d.GotByte, where(d.GotRecord, d.GotRecordOffset))
+}
+
+// Comparison is the result of Compare.
+type Comparison struct {
+	// OrigBytes and RespBytes are the number of bytes each side sent in the
+	// expected file
+	OrigBytes, RespBytes int
+	// Divergences has an entry for each direction that differs
+	Divergences []Divergence
+}
+
+// Compare compares the data each side sent in the .pkt files want and got,
+// ignoring how it was split into records. An empty file counts as a file
+// without records.
+func Compare(want, got []byte) (Comparison, error) {
+	var c Comparison
+	wantOrig, wantResp, err := streams(want)
+	if err != nil {
+		return c, err
+	}
+	gotOrig, gotResp, err := streams(got)
+	if err != nil {
+		return c, err
+	}
+	c.OrigBytes, c.RespBytes = len(wantOrig.data), len(wantResp.data)
+	for _, dir := range []struct {
+		isOrig    bool
+		want, got *stream
+	}{{true, wantOrig, gotOrig}, {false, wantResp, gotResp}} {
+		if d, ok := compareStreams(dir.want, dir.got); ok {
+			d.IsOrig = dir.isOrig
+			c.Divergences = append(c.Divergences, d)
+		}
+	}
+	return c, nil
+}
+
+func compareStreams(want, got *stream) (Divergence, bool) {
+	offset := 0
+	for offset < len(want.data) && offset < len(got.data) && want.data[offset] == got.data[offset] {
+		offset++
+	}
+	if offset == len(want.data) && offset == len(got.data) {
+		return Divergence{}, false
+	}
+	d := Divergence{
+		Offset:  offset,
+		WantLen: len(want.data),
+		GotLen:  len(got.data),
+	}
+	d.WantRecord, d.WantRecordOffset = -1, 0
+	if offset < len(want.data) {
+		d.WantRecord, d.WantRecordOffset = want.locate(offset)
+		d.WantByte = want.data[offset]
+	}
+	d.GotRecord, d.GotRecordOffset = -1, 0
+	if offset < len(got.data) {
+		d.GotRecord, d.GotRecordOffset = got.locate(offset)
+		d.GotByte = got.data[offset]
+	}
+	return d, true
+}
@@ -0,0 +1,61 @@
+package pkt
+
+import (
+	"bytes"
+	"testing"
+)
+
+func pktFile(records ...interface{}) []byte {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	for i := 0; i < len(records); i += 2 {
+		w.Write(records[i].(bool), []byte(records[i+1].(string)))
+	}
+	return buf.Bytes()
+}
+
+func TestCompareResegmented(t *testing.T) {
+	want := pktFile(true, "hello world", false, "ok")
+	got := pktFile(true, "", true, "hello", false, "o", true, " world", false, "k")
+	c, err := Compare(want, got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Divergences) != 0 {
+		t.Errorf("got divergences %v, expected none", c.Divergences)
+	}
+	if c.OrigBytes != 11 || c.RespBytes != 2 {
+		t.Errorf("got %d and %d bytes, expected 11 and 2", c.OrigBytes, c.RespBytes)
+	}
+}
+
+func TestCompareDivergence(t *testing.T) {
+	want := pktFile(true, "GET /", false, "200 OK", true, "more")
+	got := pktFile(true, "GET /", true, "mORe", false, "200")
+	c, err := Compare(want, got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wants := []Divergence{
+		{IsOrig: true, Offset: 6, WantRecord: 2, WantRecordOffset: 1, GotRecord: 1, GotRecordOffset: 1, WantByte: 'o', GotByte: 'O', WantLen: 9, GotLen: 9},
+		{IsOrig: false, Offset: 3, WantRecord: 1, WantRecordOffset: 3, GotRecord: -1, WantByte: ' ', WantLen: 6, GotLen: 3},
+	}
+	if len(c.Divergences) != len(wants) {
+		t.Fatalf("got divergences %v, expected %v", c.Divergences, wants)
+	}
+	for i, d := range c.Divergences {
+		if d != wants[i] {
+			t.Errorf("got %+v, expected %+v", d, wants[i])
+		}
+	}
+}
+
+func TestCompareEmpty(t *testing.T) {
+	c, err := Compare(pktFile(true, "x"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Divergences) != 1 || c.Divergences[0].GotLen != 0 {
+		t.Errorf("got %v, expected the client stream to be missing", c.Divergences)
+	}
+}
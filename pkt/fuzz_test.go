@@ -0,0 +1,66 @@
+package pkt
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+// FuzzReader reads arbitrary bytes as a .pkt file. Whatever reads without
+// an error has to come out the same when the records are written back, and
+// survive a dump and compile.
+func FuzzReader(f *testing.F) {
+	f.Add(pktFile(true, "GET / HTTP/1.0\r\n\r\n", false, "HTTP/1.0 200 OK\r\n\r\n"))
+	f.Add([]byte("\x01PKT\x80linktype=1\n\x01PKT\x01\x01PKT\x02\x00"))
+	f.Add([]byte("\x01PKT\x01\x01PKT"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		r, err := NewReader(data)
+		if err != nil {
+			return
+		}
+		var out bytes.Buffer
+		w := NewWriter(&out)
+		for {
+			rec, err := r.NextRecord()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return
+			}
+			w.WriteRecord(rec)
+		}
+		if !bytes.Equal(out.Bytes(), data) {
+			t.Fatalf("records written back differ\ngot  %q\nwant %q", out.Bytes(), data)
+		}
+
+		var text, compiled bytes.Buffer
+		if err := Dump(&text, data, false); err != nil {
+			t.Fatal(err)
+		}
+		if err := Compile(&text, &compiled); err != nil {
+			t.Fatalf("%v\n%s", err, text.Bytes())
+		}
+		if !bytes.Equal(compiled.Bytes(), data) {
+			t.Fatalf("dump and compile changed the file\ngot  %q\nwant %q", compiled.Bytes(), data)
+		}
+	})
+}
+
+func TestTruncatedRecord(t *testing.T) {
+	for _, data := range []string{"\x01PKT\x01\x01PKT", "\x01PKT\x01data\x01PKT"} {
+		r, err := NewReader([]byte(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := r.Next(); err != nil {
+			t.Fatalf("%q: first record: %v", data, err)
+		}
+		if _, _, err := r.Next(); err == nil || err == io.EOF {
+			t.Errorf("%q: got %v, expected an error for the truncated record", data, err)
+		}
+		if _, _, err := r.Next(); err != io.EOF {
+			t.Errorf("%q: got %v after the truncated record, expected EOF", data, err)
+		}
+	}
+}
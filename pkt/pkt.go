@@ -0,0 +1,180 @@
+// Package pkt reads and writes .pkt files.
+//
+// A .pkt file is a sequence of records. Each record starts with MAGIC and a
+// flag byte, and runs until the next MAGIC or the end of the file. The flag
+// byte says which side of the conversation sent the record, or marks the
+// record as metadata. Metadata records hold key=value lines, and the ones at
+// the start of the file act as the file header.
+package pkt
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+var MAGIC = []byte("\x01PKT")
+
+const (
+	FLOW_ORIG = byte('\x01')
+	FLOW_RESP = byte('\x02')
+	FLOW_META = byte('\x80')
+)
+
+// Metadata holds the key=value pairs stored in metadata records.
+type Metadata map[string]string
+
+type Reader struct {
+	data []byte
+
+	// Metadata accumulates every metadata record read so far. The file
+	// header is already present once NewReader returns.
+	Metadata Metadata
+}
+
+func NewReader(data []byte) (*Reader, error) {
+	if len(data) < 5 {
+		return nil, fmt.Errorf("File too small (%d bytes)", len(data))
+	}
+	start := bytes.Index(data, MAGIC)
+	if start != 0 {
+		return nil, fmt.Errorf("Invalid Magic %v", data[:4])
+	}
+	r := &Reader{data: data, Metadata: Metadata{}}
+	// Read the file header without consuming it, so NextRecord still
+	// returns it. Merging the same records again later is harmless.
+	header := &Reader{data: data, Metadata: r.Metadata}
+	for header.peekMeta() {
+		if _, err := header.NextRecord(); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+func (r *Reader) peekMeta() bool {
+	return len(r.data) > len(MAGIC) && r.data[len(MAGIC)]&FLOW_META == FLOW_META
+}
+
+// Record is a single record of a .pkt file.
+type Record struct {
+	Flags byte
+	Data  []byte
+}
+
+func (rec Record) IsOrig() bool {
+	return (rec.Flags & FLOW_ORIG) == FLOW_ORIG
+}
+
+func (rec Record) IsMeta() bool {
+	return (rec.Flags & FLOW_META) == FLOW_META
+}
+
+// Next returns the next data record, merging any metadata records found on
+// the way into r.Metadata.
+func (r *Reader) Next() (bool, []byte, error) {
+	for {
+		rec, err := r.NextRecord()
+		if err != nil {
+			return false, rec.Data, err
+		}
+		if !rec.IsMeta() {
+			return rec.IsOrig(), rec.Data, nil
+		}
+	}
+}
+
+// NextRecord returns the next record, including metadata records. Those
+// are merged into r.Metadata as well.
+func (r *Reader) NextRecord() (Record, error) {
+	if len(r.data) == 0 {
+		return Record{Data: []byte{}}, io.EOF
+	}
+	if len(r.data) <= len(MAGIC) {
+		r.data = nil
+		return Record{Data: []byte{}}, fmt.Errorf("Truncated record, no flag byte after the magic")
+	}
+	r.data = r.data[len(MAGIC):]
+	rec := Record{Flags: r.data[0]}
+	r.data = r.data[1:]
+	end := bytes.Index(r.data, MAGIC)
+	if end == -1 {
+		end = len(r.data)
+	}
+	rec.Data = r.data[:end]
+	r.data = r.data[end:]
+	if rec.IsMeta() {
+		if err := r.Metadata.parse(rec.Data); err != nil {
+			return rec, err
+		}
+	}
+	return rec, nil
+}
+
+func (m Metadata) parse(data []byte) error {
+	for _, line := range strings.Split(string(data), "\n") {
+		if line == "" {
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("Invalid metadata line %q", line)
+		}
+		m[kv[0]] = kv[1]
+	}
+	return nil
+}
+
+type Writer struct {
+	w io.Writer
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w}
+}
+
+// Write writes one data record.
+func (w *Writer) Write(isOrig bool, payload []byte) error {
+	flags := FLOW_RESP
+	if isOrig {
+		flags = FLOW_ORIG
+	}
+	return w.write(flags, payload)
+}
+
+// WriteMetadata writes a metadata record. Metadata written before the first
+// data record makes up the file header.
+func (w *Writer) WriteMetadata(m Metadata) error {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var buf bytes.Buffer
+	for _, k := range keys {
+		v := m[k]
+		if k == "" || strings.ContainsAny(k, "=\n\x01") || strings.ContainsAny(v, "\n\x01") {
+			return fmt.Errorf("Invalid metadata %q=%q", k, v)
+		}
+		fmt.Fprintf(&buf, "%s=%s\n", k, v)
+	}
+	return w.write(FLOW_META, buf.Bytes())
+}
+
+// WriteRecord writes rec as it is.
+func (w *Writer) WriteRecord(rec Record) error {
+	return w.write(rec.Flags, rec.Data)
+}
+
+func (w *Writer) write(flags byte, payload []byte) error {
+	if _, err := w.w.Write(MAGIC); err != nil {
+		return err
+	}
+	if _, err := w.w.Write([]byte{flags}); err != nil {
+		return err
+	}
+	_, err := w.w.Write(payload)
+	return err
+}
@@ -0,0 +1,149 @@
+package pkt
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The offsets file written by SplitStreams lists the records of the .pkt
+// file in order, one per line. Data records are the direction marker used
+// by Dump followed by where the record starts in its stream and how long
+// it is. Records from the originator are in the client stream and all
+// others in the server stream:
+//
+//	> 0 18
+//	< 0 1024
+//	> 18 0
+//
+// Metadata records are "meta" followed by their contents as a quoted Go
+// string. Blank lines and lines starting with "#" are ignored.
+
+// SplitStreams writes what each side sent in the .pkt file in data to
+// client and server as plain byte streams, and where each record falls in
+// them to offsets. JoinStreams turns them back into the same file.
+func SplitStreams(data []byte, client, server, offsets io.Writer) error {
+	r, err := NewReader(data)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(offsets)
+	clientOffset, serverOffset := 0, 0
+	for {
+		rec, err := r.NextRecord()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if rec.IsMeta() {
+			fmt.Fprintf(bw, "meta %s\n", strconv.Quote(string(rec.Data)))
+			continue
+		}
+		w, offset := server, &serverOffset
+		if rec.IsOrig() {
+			w, offset = client, &clientOffset
+		}
+		if _, err := w.Write(rec.Data); err != nil {
+			return err
+		}
+		fmt.Fprintf(bw, "%s %d %d\n", marker(rec.Flags), *offset, len(rec.Data))
+		*offset += len(rec.Data)
+	}
+	return bw.Flush()
+}
+
+// JoinStreams reads the offsets written by SplitStreams and writes the
+// records they describe, cut from the client and server streams, to w as
+// a .pkt file. Every byte of both streams has to belong to a record, records
+// may overlap and come in any order.
+func JoinStreams(client, server []byte, offsets io.Reader, w io.Writer) error {
+	pw := NewWriter(w)
+	// the parts of the client and the server stream used by the records
+	used := map[bool][]span{}
+	scanner := bufio.NewScanner(offsets)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.SplitN(line, " ", 2)
+		flags, err := parseMarker(fields[0])
+		if err != nil {
+			return fmt.Errorf("Line %d: %v", lineno, err)
+		}
+		rec := Record{Flags: flags, Data: []byte{}}
+		if rec.IsMeta() {
+			if len(fields) == 2 {
+				if err := parseText(&rec, strings.TrimSpace(fields[1])); err != nil {
+					return fmt.Errorf("Line %d: %v", lineno, err)
+				}
+			}
+		} else {
+			stream, name := server, "server"
+			if rec.IsOrig() {
+				stream, name = client, "client"
+			}
+			var offset, length int
+			if len(fields) != 2 {
+				return fmt.Errorf("Line %d: expected an offset and a length after %s", lineno, fields[0])
+			}
+			if n, err := fmt.Sscanf(fields[1], "%d %d", &offset, &length); n != 2 || err != nil || offset < 0 || length < 0 {
+				return fmt.Errorf("Line %d: invalid offset and length %q", lineno, fields[1])
+			}
+			if offset > len(stream) || length > len(stream)-offset {
+				return fmt.Errorf("Line %d: bytes %d to %d are past the end of the %s stream, which has %d", lineno, offset, offset+length, name, len(stream))
+			}
+			rec.Data = stream[offset : offset+length]
+			used[rec.IsOrig()] = append(used[rec.IsOrig()], span{offset, offset + length})
+		}
+		if bytes.Contains(rec.Data, MAGIC) {
+			return fmt.Errorf("Line %d: the record contains the record marker %q, which can't be stored in a .pkt file", lineno, MAGIC)
+		}
+		if err := pw.WriteRecord(rec); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if gap, ok := firstGap(used[true], len(client)); ok {
+		return fmt.Errorf("Bytes %d to %d of the client stream aren't in any record", gap.start, gap.end)
+	}
+	if gap, ok := firstGap(used[false], len(server)); ok {
+		return fmt.Errorf("Bytes %d to %d of the server stream aren't in any record", gap.start, gap.end)
+	}
+	return nil
+}
+
+// span is the part of a stream from start up to end.
+type span struct {
+	start, end int
+}
+
+// firstGap returns the first part of a stream of size bytes that none of
+// the spans cover. Spans may overlap and come in any order.
+func firstGap(spans []span, size int) (span, bool) {
+	sort.Slice(spans, func(i, j int) bool { return spans[i].start < spans[j].start })
+	covered := 0
+	for _, s := range spans {
+		if s.start > covered {
+			return span{covered, s.start}, true
+		}
+		if s.end > covered {
+			covered = s.end
+		}
+	}
+	if covered < size {
+		return span{covered, size}, true
+	}
+	return span{}, false
+}
@@ -0,0 +1,70 @@
+package pkt
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestStreamsRoundTrip(t *testing.T) {
+	var in bytes.Buffer
+	w := NewWriter(&in)
+	w.WriteMetadata(Metadata{"linktype": "1", "tunnels": "vlan:100"})
+	w.Write(true, []byte("GET / HTTP/1.1\r\n\r\n"))
+	w.Write(false, []byte("HTTP/1.1 200 OK\r\n"))
+	w.Write(true, []byte{})
+	w.Write(false, []byte("\r\nbody"))
+	w.WriteRecord(Record{Flags: 0x41, Data: []byte("odd flags")})
+
+	var client, server, offsets, out bytes.Buffer
+	if err := SplitStreams(in.Bytes(), &client, &server, &offsets); err != nil {
+		t.Fatal(err)
+	}
+	if got := client.String(); got != "GET / HTTP/1.1\r\n\r\nodd flags" {
+		t.Errorf("client stream is %q", got)
+	}
+	if got := server.String(); got != "HTTP/1.1 200 OK\r\n\r\nbody" {
+		t.Errorf("server stream is %q", got)
+	}
+	if err := JoinStreams(client.Bytes(), server.Bytes(), bytes.NewReader(offsets.Bytes()), &out); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(in.Bytes(), out.Bytes()) {
+		t.Errorf("round trip changed the file\ngot  %q\nwant %q\noffsets:\n%s", out.Bytes(), in.Bytes(), offsets.String())
+	}
+}
+
+func TestJoinStreamsOverlap(t *testing.T) {
+	// Records may repeat bytes and come in any order, as long as every
+	// byte is in one
+	var out bytes.Buffer
+	if err := JoinStreams([]byte("hello"), nil, strings.NewReader("> 2 3\n> 0 4\n"), &out); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestJoinStreamsInvalid(t *testing.T) {
+	client := []byte("hello")
+	server := []byte("world")
+	for _, tt := range []struct {
+		offsets string
+		err     string
+	}{
+		{"> 0 5\n< 0 6\n", "past the end of the server stream"},
+		{"> 0 4\n< 0 5\n", "Bytes 4 to 5 of the client stream"},
+		{"< 0 5\n", "Bytes 0 to 5 of the client stream"},
+		// The end of the stream is used, but not the middle
+		{"> 0 2\n> 3 2\n< 0 5\n", "Bytes 2 to 3 of the client stream"},
+		{"> 0 5\n< 2 3\n< 0 1\n", "Bytes 1 to 2 of the server stream"},
+		{"> 0\n", "invalid offset"},
+		{">\n", "expected an offset"},
+		{"> -1 5\n", "invalid offset"},
+		{"? 0 5\n", "Invalid direction marker"},
+		{"meta \"unterminated\n", "Invalid quoted string"},
+	} {
+		err := JoinStreams(client, server, strings.NewReader(tt.offsets), &bytes.Buffer{})
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%q: got %v, expected an error containing %q", tt.offsets, err, tt.err)
+		}
+	}
+}
@@ -0,0 +1,258 @@
+package pkt
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// The text form of a .pkt file has one block per record. The first line of
+// a block holds the direction marker, ">" for the originator, "<" for the
+// responder, "meta" for metadata or the flag byte in hex such as "0x41" for
+// anything else. Mostly printable records follow the marker as quoted Go
+// strings, split after every newline, one per line:
+//
+//	> "GET / HTTP/1.1\r\n"
+//	  "Host: example.com\r\n"
+//	  "\r\n"
+//
+// Everything else is written as "hex" followed by a hexdump:
+//
+//	< hex
+//	  00000000  16 03 01 00 05 01 00 00  01 00                    |..........|
+//
+// The offsets and the text after "|" are only there for the reader and are
+// ignored by Compile, so bytes can be added or removed freely and the offsets
+// may be left out. Blank lines and lines starting with "#" are ignored as
+// well.
+
+const hexLine = 16
+
+// Dump writes the records of the .pkt file in data as text. Records are
+// written as quoted strings when they are mostly printable, unless forceHex
+// is set.
+func Dump(w io.Writer, data []byte, forceHex bool) error {
+	r, err := NewReader(data)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(w)
+	for first := true; ; first = false {
+		rec, err := r.NextRecord()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if !first {
+			bw.WriteString("\n")
+		}
+		bw.WriteString(marker(rec.Flags))
+		if forceHex || !printable(rec.Data) {
+			dumpHex(bw, rec.Data)
+		} else {
+			dumpText(bw, rec.Data)
+		}
+	}
+	return bw.Flush()
+}
+
+func marker(flags byte) string {
+	switch flags {
+	case FLOW_ORIG:
+		return ">"
+	case FLOW_RESP:
+		return "<"
+	case FLOW_META:
+		return "meta"
+	}
+	return fmt.Sprintf("0x%02x", flags)
+}
+
+func parseMarker(s string) (byte, error) {
+	switch s {
+	case ">":
+		return FLOW_ORIG, nil
+	case "<":
+		return FLOW_RESP, nil
+	case "meta":
+		return FLOW_META, nil
+	}
+	if strings.HasPrefix(s, "0x") {
+		if b, err := strconv.ParseUint(s[2:], 16, 8); err == nil {
+			return byte(b), nil
+		}
+	}
+	return 0, fmt.Errorf("Invalid direction marker %q, expected >, <, meta or a flag byte like 0x01", s)
+}
+
+// printable reports whether data reads better as a string than as a
+// hexdump, which is the case when at least 3 in 4 bytes are printable.
+func printable(data []byte) bool {
+	if !utf8.Valid(data) {
+		return false
+	}
+	n := 0
+	for _, b := range data {
+		if (b >= 0x20 && b < 0x7f) || b == '\r' || b == '\n' || b == '\t' {
+			n++
+		}
+	}
+	return n*4 >= len(data)*3
+}
+
+func dumpText(w *bufio.Writer, data []byte) {
+	if len(data) == 0 {
+		w.WriteString(" \"\"\n")
+		return
+	}
+	prefix := " "
+	for len(data) > 0 {
+		end := bytes.IndexByte(data, '\n') + 1
+		if end == 0 {
+			end = len(data)
+		}
+		fmt.Fprintf(w, "%s%s\n", prefix, strconv.QuoteToASCII(string(data[:end])))
+		data = data[end:]
+		prefix = "  "
+	}
+}
+
+func dumpHex(w *bufio.Writer, data []byte) {
+	w.WriteString(" hex\n")
+	for offset := 0; offset < len(data); offset += hexLine {
+		line := data[offset:]
+		if len(line) > hexLine {
+			line = line[:hexLine]
+		}
+		fmt.Fprintf(w, "  %08x ", offset)
+		for i := 0; i < hexLine; i++ {
+			if i == hexLine/2 {
+				w.WriteString(" ")
+			}
+			if i < len(line) {
+				fmt.Fprintf(w, " %02x", line[i])
+			} else {
+				w.WriteString("   ")
+			}
+		}
+		w.WriteString("  |")
+		for _, b := range line {
+			if b < 0x20 || b >= 0x7f {
+				b = '.'
+			}
+			w.WriteByte(b)
+		}
+		w.WriteString("|\n")
+	}
+}
+
+// Compile parses the text written by Dump, possibly edited by hand, and
+// writes it to w as a binary .pkt file.
+func Compile(r io.Reader, w io.Writer) error {
+	pw := NewWriter(w)
+	var rec *Record
+	isHex := false
+	records := 0
+	flush := func() error {
+		if rec == nil {
+			return nil
+		}
+		if bytes.Contains(rec.Data, MAGIC) {
+			return fmt.Errorf("Record %d contains the record marker %q, which can't be stored in a .pkt file", records, MAGIC)
+		}
+		records++
+		err := pw.WriteRecord(*rec)
+		rec = nil
+		return err
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		line := scanner.Text()
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			// Continuation of the current record
+			if rec == nil {
+				return fmt.Errorf("Line %d: data before the first direction marker", lineno)
+			}
+			var err error
+			if isHex {
+				err = parseHex(rec, trimmed)
+			} else {
+				err = parseText(rec, trimmed)
+			}
+			if err != nil {
+				return fmt.Errorf("Line %d: %v", lineno, err)
+			}
+			continue
+		}
+		if err := flush(); err != nil {
+			return err
+		}
+		fields := strings.SplitN(trimmed, " ", 2)
+		flags, err := parseMarker(fields[0])
+		if err != nil {
+			return fmt.Errorf("Line %d: %v", lineno, err)
+		}
+		rec = &Record{Flags: flags, Data: []byte{}}
+		isHex = false
+		if len(fields) == 1 {
+			continue
+		}
+		rest := strings.TrimSpace(fields[1])
+		if rest == "hex" {
+			isHex = true
+			continue
+		}
+		if err := parseText(rec, rest); err != nil {
+			return fmt.Errorf("Line %d: %v", lineno, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return flush()
+}
+
+func parseText(rec *Record, s string) error {
+	str, err := strconv.Unquote(s)
+	if err != nil {
+		return fmt.Errorf("Invalid quoted string %s", s)
+	}
+	rec.Data = append(rec.Data, str...)
+	return nil
+}
+
+func parseHex(rec *Record, s string) error {
+	if i := strings.IndexByte(s, '|'); i != -1 {
+		s = s[:i]
+	}
+	// Dump starts the line with the offset, 8 hex digits and two spaces.
+	// Anything else is taken for bytes, so a mistyped byte is an error.
+	if len(s) >= 10 && s[8:10] == "  " {
+		if _, err := hex.DecodeString(s[:8]); err == nil {
+			s = s[10:]
+		}
+	}
+	for _, f := range strings.Fields(s) {
+		b, err := hex.DecodeString(f)
+		if err != nil || len(b) != 1 {
+			return fmt.Errorf("Invalid hex byte %q", f)
+		}
+		rec.Data = append(rec.Data, b[0])
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package pkt
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestDumpCompileRoundTrip(t *testing.T) {
+	var in bytes.Buffer
+	w := NewWriter(&in)
+	w.WriteMetadata(Metadata{"linktype": "1", "tunnels": "vlan:100"})
+	w.Write(true, []byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	w.Write(false, []byte{0x16, 0x03, 0x01, 0x00, 0x05, 0x01, 0x00, 0x00, 0x01, 0x00, 0xff, 0x7f, 0x80, '|', 0x01, 'P', 'K', 0x00})
+	w.Write(true, []byte{})
+	w.Write(false, []byte("caf\xc3\xa9 \"quoted\"\tand no newline"))
+	w.WriteRecord(Record{Flags: 0x41, Data: []byte("odd flags")})
+	w.Write(true, bytes.Repeat([]byte{0xaa}, 40))
+
+	for _, forceHex := range []bool{false, true} {
+		var text, out bytes.Buffer
+		if err := Dump(&text, in.Bytes(), forceHex); err != nil {
+			t.Fatal(err)
+		}
+		if err := Compile(&text, &out); err != nil {
+			t.Fatalf("hex=%v: %v", forceHex, err)
+		}
+		if !bytes.Equal(in.Bytes(), out.Bytes()) {
+			t.Errorf("hex=%v: round trip changed the file\ngot  %q\nwant %q", forceHex, out.Bytes(), in.Bytes())
+		}
+	}
+}
+
+func TestCompileHandEdited(t *testing.T) {
+	text := `# an edited exploit
+> "hello "
+  "world\n"
+< hex
+  de ad
+  00000010  be ef  |..|
+  0a 0b
+
+meta "linktype=1\n"
+`
+	var out bytes.Buffer
+	if err := Compile(strings.NewReader(text), &out); err != nil {
+		t.Fatal(err)
+	}
+	want := "\x01PKT\x01hello world\n\x01PKT\x02\xde\xad\xbe\xef\x0a\x0b\x01PKT\x80linktype=1\n"
+	if out.String() != want {
+		t.Errorf("got %q, want %q", out.String(), want)
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	for _, text := range []string{
+		"  \"data without a marker\"\n",
+		"? \"bad marker\"\n",
+		"> \"unterminated\n",
+		"< hex\n  00000000  zz\n",
+		// Without an offset every field has to be a byte
+		"< hex\n  deadbeef 00 01\n",
+		"< hex\n  dead 00\n",
+		"< hex\n  0000000  00\n",
+		"> \"\\x01PKT\\x02\"\n",
+	} {
+		if err := Compile(strings.NewReader(text), &bytes.Buffer{}); err == nil {
+			t.Errorf("Compile(%q) succeeded, expected an error", text)
+		}
+	}
+}
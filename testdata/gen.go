@@ -0,0 +1,346 @@
+//go:build ignore
+// +build ignore
+
+// gen writes the pcap fixtures used by the tests.
+//
+//	go run testdata/gen.go
+package main
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+var (
+	clientMAC = net.HardwareAddr{0, 0, 0, 0, 0, 1}
+	serverMAC = net.HardwareAddr{0, 0, 0, 0, 0, 2}
+	clientIP  = net.IP{10, 0, 0, 1}
+	serverIP  = net.IP{10, 0, 0, 2}
+	clientIP6 = net.ParseIP("2001:db8::1")
+	serverIP6 = net.ParseIP("2001:db8::2")
+)
+
+// message is one packet of the fixture conversation
+type message struct {
+	isOrig  bool
+	payload string
+}
+
+var conversation = []message{
+	{true, "hello"},
+	{false, "world"},
+}
+
+// ipPacket serializes a TCP segment carrying payload, starting at the IP header
+func ipPacket(m message, v6 bool) []byte {
+	var nl gopacket.NetworkLayer
+	var ip gopacket.SerializableLayer
+	if v6 {
+		l := &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: layers.IPProtocolTCP, SrcIP: clientIP6, DstIP: serverIP6}
+		if !m.isOrig {
+			l.SrcIP, l.DstIP = l.DstIP, l.SrcIP
+		}
+		nl, ip = l, l
+	} else {
+		l := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: clientIP, DstIP: serverIP}
+		if !m.isOrig {
+			l.SrcIP, l.DstIP = l.DstIP, l.SrcIP
+		}
+		nl, ip = l, l
+	}
+	tcp := &layers.TCP{SrcPort: 40000, DstPort: 80, ACK: true, PSH: true, Window: 1024}
+	if !m.isOrig {
+		tcp.SrcPort, tcp.DstPort = tcp.DstPort, tcp.SrcPort
+	}
+	tcp.SetNetworkLayerForChecksum(nl)
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, ip, tcp, gopacket.Payload(m.payload)); err != nil {
+		log.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func ethernet(m message, ip []byte) []byte {
+	src, dst := clientMAC, serverMAC
+	if !m.isOrig {
+		src, dst = dst, src
+	}
+	hdr := append(append(append([]byte{}, dst...), src...), 0x08, 0x00)
+	return append(hdr, ip...)
+}
+
+func null(m message, ip []byte) []byte {
+	hdr := make([]byte, 4)
+	binary.LittleEndian.PutUint32(hdr, uint32(layers.ProtocolFamilyIPv4))
+	return append(hdr, ip...)
+}
+
+func sll(m message, ip []byte) []byte {
+	hdr := make([]byte, 16)
+	if !m.isOrig {
+		binary.BigEndian.PutUint16(hdr[0:2], uint16(layers.LinuxSLLPacketTypeOutgoing))
+	}
+	binary.BigEndian.PutUint16(hdr[2:4], 1)
+	binary.BigEndian.PutUint16(hdr[4:6], 6)
+	copy(hdr[6:], clientMAC)
+	binary.BigEndian.PutUint16(hdr[14:16], uint16(layers.EthernetTypeIPv4))
+	return append(hdr, ip...)
+}
+
+func sll2(m message, ip []byte) []byte {
+	hdr := make([]byte, 20)
+	binary.BigEndian.PutUint16(hdr[0:2], uint16(layers.EthernetTypeIPv4))
+	binary.BigEndian.PutUint32(hdr[4:8], 2)
+	binary.BigEndian.PutUint16(hdr[8:10], 1)
+	if !m.isOrig {
+		hdr[10] = byte(layers.LinuxSLLPacketTypeOutgoing)
+	}
+	hdr[11] = 6
+	copy(hdr[12:], clientMAC)
+	return append(hdr, ip...)
+}
+
+func dot11(m message, ip []byte) []byte {
+	hdr := make([]byte, 24)
+	hdr[0] = 0x08 // data frame
+	hdr[1] = 0x01 // to DS
+	copy(hdr[4:], serverMAC)
+	copy(hdr[10:], clientMAC)
+	copy(hdr[16:], serverMAC)
+	snap := []byte{0xaa, 0xaa, 0x03, 0x00, 0x00, 0x00, 0x08, 0x00}
+	return append(append(hdr, snap...), ip...)
+}
+
+// dot11FCS is a data frame followed by its frame check sequence
+func dot11FCS(m message, ip []byte) []byte {
+	frame := dot11(m, ip)
+	fcs := make([]byte, 4)
+	binary.LittleEndian.PutUint32(fcs, crc32.ChecksumIEEE(frame))
+	return append(frame, fcs...)
+}
+
+func radiotap(m message, ip []byte) []byte {
+	hdr := []byte{0, 0, 8, 0, 0, 0, 0, 0}
+	return append(hdr, dot11(m, ip)...)
+}
+
+func raw(m message, ip []byte) []byte {
+	return ip
+}
+
+func create(name string) *os.File {
+	f, err := os.Create(filepath.Join("testdata", name))
+	if err != nil {
+		log.Fatal(err)
+	}
+	return f
+}
+
+func writeFrames(name string, linkType uint32, frames [][]byte) {
+	f := create(name)
+	defer f.Close()
+	var hdr [24]byte
+	binary.LittleEndian.PutUint32(hdr[0:4], 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(hdr[4:6], 2)
+	binary.LittleEndian.PutUint16(hdr[6:8], 4)
+	binary.LittleEndian.PutUint32(hdr[16:20], 65536)
+	binary.LittleEndian.PutUint32(hdr[20:24], linkType)
+	if _, err := f.Write(hdr[:]); err != nil {
+		log.Fatal(err)
+	}
+	w := pcapgo.NewWriter(f)
+	ts := time.Unix(1600000000, 0).UTC()
+	for _, data := range frames {
+		ci := gopacket.CaptureInfo{Timestamp: ts, CaptureLength: len(data), Length: len(data)}
+		if err := w.WritePacket(ci, data); err != nil {
+			log.Fatal(err)
+		}
+		ts = ts.Add(time.Second)
+	}
+}
+
+func write(name string, linkType uint32, v6 bool, frame func(message, []byte) []byte) {
+	var frames [][]byte
+	for _, m := range conversation {
+		frames = append(frames, frame(m, ipPacket(m, v6)))
+	}
+	writeFrames(name, linkType, frames)
+}
+
+func writeNg(name string, frames [][]byte) {
+	f := create(name)
+	defer f.Close()
+	w, err := pcapgo.NewNgWriter(f, layers.LinkTypeEthernet)
+	if err != nil {
+		log.Fatal(err)
+	}
+	ts := time.Unix(1600000000, 0).UTC()
+	for _, data := range frames {
+		ci := gopacket.CaptureInfo{Timestamp: ts, CaptureLength: len(data), Length: len(data)}
+		if err := w.WritePacket(ci, data); err != nil {
+			log.Fatal(err)
+		}
+		ts = ts.Add(time.Second)
+	}
+	if err := w.Flush(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func serialize(l ...gopacket.SerializableLayer) []byte {
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, l...); err != nil {
+		log.Fatal(err)
+	}
+	return append([]byte{}, buf.Bytes()...)
+}
+
+// endpoints returns the Ethernet and IPv4 layers for a packet in the
+// direction isOrig says
+func endpoints(isOrig bool, proto layers.IPProtocol) (*layers.Ethernet, *layers.IPv4) {
+	eth := &layers.Ethernet{SrcMAC: clientMAC, DstMAC: serverMAC, EthernetType: layers.EthernetTypeIPv4}
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: proto, SrcIP: clientIP, DstIP: serverIP}
+	if !isOrig {
+		eth.SrcMAC, eth.DstMAC = eth.DstMAC, eth.SrcMAC
+		ip.SrcIP, ip.DstIP = ip.DstIP, ip.SrcIP
+	}
+	return eth, ip
+}
+
+// segment is one packet of the TCP fixture session
+type segment struct {
+	isOrig        bool
+	syn, fin, psh bool
+	payload       string
+}
+
+// tcpSession is a whole HTTP exchange with the handshake and teardown
+var tcpSession = []segment{
+	{isOrig: true, syn: true},
+	{isOrig: false, syn: true},
+	{isOrig: true},
+	{isOrig: true, psh: true, payload: "GET / HTTP/1.0\r\n\r\n"},
+	{isOrig: false},
+	{isOrig: false, psh: true, payload: "HTTP/1.0 200 OK\r\nContent-Length: 2\r\n\r\nhi"},
+	{isOrig: true, fin: true},
+	{isOrig: false, fin: true},
+	{isOrig: true},
+}
+
+func tcpFrames() [][]byte {
+	var frames [][]byte
+	seq := map[bool]uint32{true: 1000, false: 5000}
+	for _, s := range tcpSession {
+		eth, ip := endpoints(s.isOrig, layers.IPProtocolTCP)
+		tcp := &layers.TCP{SrcPort: 40000, DstPort: 80, Seq: seq[s.isOrig], SYN: s.syn, FIN: s.fin, PSH: s.psh, Window: 1024}
+		if !s.isOrig {
+			tcp.SrcPort, tcp.DstPort = tcp.DstPort, tcp.SrcPort
+		}
+		if !(s.syn && s.isOrig) {
+			tcp.ACK = true
+			tcp.Ack = seq[!s.isOrig]
+		}
+		tcp.SetNetworkLayerForChecksum(ip)
+		frames = append(frames, serialize(eth, ip, tcp, gopacket.Payload(s.payload)))
+		seq[s.isOrig] += uint32(len(s.payload))
+		if s.syn || s.fin {
+			seq[s.isOrig]++
+		}
+	}
+	return frames
+}
+
+func udpFrame(isOrig bool, payload []byte) []byte {
+	eth, ip := endpoints(isOrig, layers.IPProtocolUDP)
+	udp := &layers.UDP{SrcPort: 40000, DstPort: 53}
+	if !isOrig {
+		udp.SrcPort, udp.DstPort = udp.DstPort, udp.SrcPort
+	}
+	udp.SetNetworkLayerForChecksum(ip)
+	return serialize(eth, ip, udp, gopacket.Payload(payload))
+}
+
+func udpFrames() [][]byte {
+	return [][]byte{
+		udpFrame(true, []byte("query")),
+		udpFrame(false, []byte("answer")),
+	}
+}
+
+// fragmentFrames sends a UDP datagram too big for one packet, split in
+// three IPv4 fragments, and a short reply
+func fragmentFrames() [][]byte {
+	payload := make([]byte, 2000)
+	for i := range payload {
+		payload[i] = byte('a' + i%26)
+	}
+	whole := udpFrame(true, payload)
+	eth, ip := endpoints(true, layers.IPProtocolUDP)
+	ip.Id = 42
+	// The UDP header and payload, after the 14 byte Ethernet and 20 byte
+	// IPv4 headers
+	data := whole[34:]
+	var frames [][]byte
+	for offset := 0; offset < len(data); offset += 800 {
+		end := offset + 800
+		frag := *ip
+		frag.Flags = layers.IPv4MoreFragments
+		if end >= len(data) {
+			end = len(data)
+			frag.Flags = 0
+		}
+		frag.FragOffset = uint16(offset / 8)
+		frames = append(frames, serialize(eth, &frag, gopacket.Payload(data[offset:end])))
+	}
+	return append(frames, udpFrame(false, []byte("ok")))
+}
+
+func vlanFrames() [][]byte {
+	var frames [][]byte
+	for _, m := range conversation {
+		eth, _ := endpoints(m.isOrig, layers.IPProtocolTCP)
+		eth.EthernetType = layers.EthernetTypeDot1Q
+		dot1q := &layers.Dot1Q{VLANIdentifier: 100, Type: layers.EthernetTypeIPv4}
+		frames = append(frames, serialize(eth, dot1q, gopacket.Payload(ipPacket(m, false))))
+	}
+	return frames
+}
+
+func ethernetFrames() [][]byte {
+	var frames [][]byte
+	for _, m := range conversation {
+		frames = append(frames, ethernet(m, ipPacket(m, false)))
+	}
+	return frames
+}
+
+func main() {
+	write("ethernet.pcap", uint32(layers.LinkTypeEthernet), false, ethernet)
+	write("null.pcap", uint32(layers.LinkTypeNull), false, null)
+	write("raw.pcap", uint32(layers.LinkTypeRaw), false, raw)
+	write("ipv4.pcap", uint32(layers.LinkTypeIPv4), false, raw)
+	write("ipv6.pcap", uint32(layers.LinkTypeIPv6), true, raw)
+	write("sll.pcap", uint32(layers.LinkTypeLinuxSLL), false, sll)
+	write("sll2.pcap", 276, false, sll2)
+	write("dot11.pcap", uint32(layers.LinkTypeIEEE802_11), false, dot11FCS)
+	write("radiotap.pcap", uint32(layers.LinkTypeIEEE80211Radio), false, radiotap)
+	// LINKTYPE_USER0, which nothing knows how to decode
+	write("unsupported.pcap", 147, false, raw)
+
+	writeFrames("tcp.pcap", uint32(layers.LinkTypeEthernet), tcpFrames())
+	writeFrames("udp.pcap", uint32(layers.LinkTypeEthernet), udpFrames())
+	writeFrames("fragments.pcap", uint32(layers.LinkTypeEthernet), fragmentFrames())
+	writeFrames("vlan.pcap", uint32(layers.LinkTypeEthernet), vlanFrames())
+	writeNg("ethernet.pcapng", ethernetFrames())
+}